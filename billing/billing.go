@@ -17,7 +17,14 @@ const StripeURL = "https://api.stripe.com"
 type Context struct {
 	APIKey      string
 	CallbackURL string
-	Cache       *redis.Client
+	Cache       Cache
+}
+
+// Cache is the subset of the Redis client caching product names, satisfied by *redis.Client and by in-memory
+// implementations in tests
+type Cache interface {
+	Get(key string) *redis.StringCmd
+	Set(key string, value interface{}, expiration time.Duration) *redis.StatusCmd
 }
 
 type Profile struct {
@@ -246,7 +253,7 @@ func (ctx *Context) CreateUser(p *Profile) (string, error) {
 	return response.ID, nil
 }
 
-func New(key string, cb string, cache *redis.Client) (*Context, error) {
+func New(key string, cb string, cache Cache) (*Context, error) {
 	if key == "" {
 		return nil, fmt.Errorf("the API key is required")
 	}
@@ -255,7 +262,7 @@ func New(key string, cb string, cache *redis.Client) (*Context, error) {
 		return nil, fmt.Errorf("the callback URL is required")
 	}
 
-	if cache == nil {
+	if c, ok := cache.(*redis.Client); cache == nil || ok && c == nil {
 		return nil, fmt.Errorf("redis cache client handle is required")
 	}
 
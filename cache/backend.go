@@ -0,0 +1,274 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/go-redsync/redsync/v4"
+
+	redis "github.com/go-redis/redis/v8"
+)
+
+// Backend is the storage underlying a cache Context.  It follows the Redis data model: each entry is a hash of
+// string fields with an optional expiry, and locks and counters live alongside entries in the same key space, as
+// plain values under keys of their own.  Operations on a key holding a different kind of value than they expect return errWrongType.
+type Backend interface {
+	// Now returns the current time as seen by the backend, against which entry expiry is measured
+	Now() time.Time
+	// HGet returns a single field of an entry, ErrNotFound if either is missing, or errWrongType if the key does not
+	// hold an entry
+	HGet(ctx context.Context, key, field string) (string, error)
+	// HMGet returns the given fields of an entry, omitting those that are not set, or errWrongType if the key does
+	// not hold an entry
+	HMGet(ctx context.Context, key string, fields ...string) (map[string]string, error)
+	// HGetAll returns all fields of an entry along with its remaining time to live, which is negative if the
+	// entry does not expire, or errWrongType if the key does not hold an entry
+	HGetAll(ctx context.Context, key string) (map[string]string, time.Duration, error)
+	// HSet sets fields of an entry, and its expiry if ttl is non-zero, or returns errWrongType if the key does not
+	// hold an entry
+	HSet(ctx context.Context, key string, fields map[string]string, ttl time.Duration) error
+	// Replace atomically replaces an entry with the given fields, and sets its expiry if ttl is non-zero
+	Replace(ctx context.Context, key string, fields map[string]string, ttl time.Duration) error
+	// HGetMany returns a single field of several entries, omitting entries where it is not set, or errWrongType if
+	// any of the keys does not hold an entry
+	HGetMany(ctx context.Context, keys []string, field string) (map[string]string, error)
+	// HSetMany sets fields of several entries, and their expiry if ttl is non-zero
+	HSetMany(ctx context.Context, entries map[string]map[string]string, ttl time.Duration) error
+	// Del removes entries
+	Del(ctx context.Context, keys ...string) error
+	// Exists reports whether a key holds a value of any kind
+	Exists(ctx context.Context, key string) (bool, error)
+	// ScanPrefix calls fn with successive batches of the keys starting with prefix.  Keys added or removed during
+	// the scan may or may not be returned.
+	ScanPrefix(ctx context.Context, prefix string, fn func(keys []string) error) error
+	// Incr atomically increments a counter, returning its new value, and resets its expiry to ttl if non-zero.  It
+	// returns errWrongType if the key holds an entry, and an error if it holds a lock.
+	Incr(ctx context.Context, key string, ttl time.Duration) (int64, error)
+	// NewMutex returns a distributed mutex on name
+	NewMutex(name string, opts MutexOptions) Mutex
+}
+
+// MutexOptions configures a Mutex returned by a Backend
+type MutexOptions struct {
+	Expiry     time.Duration
+	Tries      int
+	RetryDelay func(tries int) time.Duration
+}
+
+// Mutex is a distributed mutual exclusion lock
+type Mutex interface {
+	// LockContext acquires the lock, returning ErrLockNotAcquired if all attempts failed or ctx is done
+	LockContext(ctx context.Context) error
+	// ExtendContext resets the expiry of a held lock, returning false if it is no longer held
+	ExtendContext(ctx context.Context) (bool, error)
+	// UnlockContext releases a held lock, returning false if it is no longer held
+	UnlockContext(ctx context.Context) (bool, error)
+	// Until returns the time at which the lock expires
+	Until() time.Time
+}
+
+// errWrongType is returned when operating on a key holding a different kind of value, such as reading the fields of
+// a key which is held by a lock, see Backend
+var errWrongType = errors.New("key holds the wrong kind of value")
+
+// wrongType translates the WRONGTYPE errors of Redis to errWrongType
+func wrongType(err error) error {
+	if err != nil && strings.HasPrefix(err.Error(), "WRONGTYPE") {
+		return errWrongType
+	}
+	return err
+}
+
+// redisBackend is a Backend backed by a Redis server, using RedSync for locks
+type redisBackend struct {
+	client  *redis.Client
+	redsync *redsync.Redsync
+}
+
+func (b *redisBackend) Now() time.Time {
+	return time.Now()
+}
+
+func (b *redisBackend) HGet(ctx context.Context, key, field string) (string, error) {
+	ret, err := b.client.HGet(ctx, key, field).Result()
+	if err == redis.Nil {
+		return "", ErrNotFound
+	}
+	return ret, wrongType(err)
+}
+
+func (b *redisBackend) HMGet(ctx context.Context, key string, fields ...string) (map[string]string, error) {
+
+	values, err := b.client.HMGet(ctx, key, fields...).Result()
+	if err != nil {
+		return nil, wrongType(err)
+	}
+
+	ret := make(map[string]string)
+	for i, v := range values {
+		if s, ok := v.(string); ok {
+			ret[fields[i]] = s
+		}
+	}
+
+	return ret, nil
+}
+
+func (b *redisBackend) HGetAll(ctx context.Context, key string) (map[string]string, time.Duration, error) {
+
+	var all *redis.StringStringMapCmd
+	var ttl *redis.DurationCmd
+	_, err := b.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		all = pipe.HGetAll(ctx, key)
+		ttl = pipe.PTTL(ctx, key)
+		return nil
+	})
+	if err != nil {
+		return nil, 0, wrongType(err)
+	}
+
+	return all.Val(), ttl.Val(), nil
+}
+
+func (b *redisBackend) HSet(ctx context.Context, key string, fields map[string]string, ttl time.Duration) error {
+	_, err := b.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, key, fields)
+		if ttl > 0 {
+			pipe.Expire(ctx, key, ttl)
+		}
+		return nil
+	})
+	return wrongType(err)
+}
+
+func (b *redisBackend) Replace(ctx context.Context, key string, fields map[string]string, ttl time.Duration) error {
+	_, err := b.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, key)
+		pipe.HSet(ctx, key, fields)
+		if ttl > 0 {
+			pipe.Expire(ctx, key, ttl)
+		}
+		return nil
+	})
+	return err
+}
+
+func (b *redisBackend) HGetMany(ctx context.Context, keys []string, field string) (map[string]string, error) {
+
+	cmds := make([]*redis.StringCmd, len(keys))
+	_, err := b.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, key := range keys {
+			cmds[i] = pipe.HGet(ctx, key, field)
+		}
+		return nil
+	})
+	if err != nil && err != redis.Nil {
+		return nil, wrongType(err)
+	}
+
+	ret := make(map[string]string)
+	for i, cmd := range cmds {
+		v, err := cmd.Result()
+		if err == redis.Nil {
+			continue
+		}
+		if err != nil {
+			return nil, wrongType(err)
+		}
+		ret[keys[i]] = v
+	}
+
+	return ret, nil
+}
+
+func (b *redisBackend) HSetMany(ctx context.Context, entries map[string]map[string]string, ttl time.Duration) error {
+	_, err := b.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for key, fields := range entries {
+			pipe.HSet(ctx, key, fields)
+			if ttl > 0 {
+				pipe.Expire(ctx, key, ttl)
+			}
+		}
+		return nil
+	})
+	return wrongType(err)
+}
+
+func (b *redisBackend) Del(ctx context.Context, keys ...string) error {
+	return b.client.Del(ctx, keys...).Err()
+}
+
+func (b *redisBackend) Exists(ctx context.Context, key string) (bool, error) {
+	n, err := b.client.Exists(ctx, key).Result()
+	return n > 0, err
+}
+
+// scanBatch is the number of keys requested from Redis per SCAN iteration
+const scanBatch = 500
+
+func (b *redisBackend) ScanPrefix(ctx context.Context, prefix string, fn func(keys []string) error) error {
+
+	pattern := globEscaper.Replace(prefix) + "*"
+
+	var cursor uint64
+	for {
+		keys, next, err := b.client.Scan(ctx, cursor, pattern, scanBatch).Result()
+		if err != nil {
+			return err
+		}
+		if len(keys) > 0 {
+			if err := fn(keys); err != nil {
+				return err
+			}
+		}
+		if next == 0 {
+			return nil
+		}
+		cursor = next
+	}
+}
+
+// globEscaper escapes the characters that have a special meaning in Redis glob-style patterns
+var globEscaper = strings.NewReplacer(`\`, `\\`, "*", `\*`, "?", `\?`, "[", `\[`, "]", `\]`)
+
+func (b *redisBackend) Incr(ctx context.Context, key string, ttl time.Duration) (int64, error) {
+
+	var incr *redis.IntCmd
+	_, err := b.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		incr = pipe.Incr(ctx, key)
+		if ttl > 0 {
+			pipe.Expire(ctx, key, ttl)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, wrongType(err)
+	}
+
+	return incr.Val(), nil
+}
+
+func (b *redisBackend) NewMutex(name string, opts MutexOptions) Mutex {
+	return redisMutex{b.redsync.NewMutex(name,
+		redsync.WithExpiry(opts.Expiry),
+		redsync.WithTries(opts.Tries),
+		redsync.WithRetryDelayFunc(opts.RetryDelay),
+	)}
+}
+
+// redisMutex adapts a RedSync mutex to the Mutex interface
+type redisMutex struct {
+	*redsync.Mutex
+}
+
+func (m redisMutex) LockContext(ctx context.Context) error {
+	if err := m.Mutex.LockContext(ctx); err != nil {
+		if err == redsync.ErrFailed {
+			return ErrLockNotAcquired
+		}
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,254 @@
+package cache
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/9spokes/go/logging/v3"
+)
+
+// GetMany retrieves several entries in a single round-trip.  It returns the serialised documents found, keyed by ID,
+// along with the IDs that were not found.
+func (ctx *Context) GetMany(lckCtx context.Context, ids []string) (map[string]string, []string, error) {
+
+	raw, missing, err := ctx.getManyRaw(lckCtx, ids)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	found := make(map[string]string, len(raw))
+	for id, data := range raw {
+		found[id] = string(data)
+	}
+
+	return found, missing, nil
+}
+
+// SetMany commits several key/value pairs in a single round-trip, each expiring after ttl if it is non-zero
+func (ctx *Context) SetMany(lckCtx context.Context, entries map[string]interface{}, ttl time.Duration) error {
+
+	raw := make(map[string][]byte, len(entries))
+	for id, data := range entries {
+		str, err := json.Marshal(data)
+		if err != nil {
+			logging.Errorf("[%s] failed to serialise data: %s", id, err.Error())
+			return fmt.Errorf("failed to serialise data for %s: %s", id, err.Error())
+		}
+		raw[id] = str
+	}
+
+	return ctx.setManyRaw(lckCtx, raw, ttl)
+}
+
+// DeleteMany removes several entries in a single round-trip
+func (ctx *Context) DeleteMany(lckCtx context.Context, ids []string) error {
+
+	if len(ids) == 0 {
+		return nil
+	}
+
+	logging.Debugf("Removing %d cache entries", len(ids))
+	if err := ctx.store().Del(lckCtx, ids...); err != nil {
+		logging.Errorf("Failed to remove cache entries: %s", err.Error())
+		return fmt.Errorf("failed to remove documents in cache: %s", err.Error())
+	}
+
+	ctx.invalidate(lckCtx, ids...)
+
+	return nil
+}
+
+// ClearPrefix removes every entry whose key starts with prefix and returns the number of entries removed.  Keys are
+// enumerated incrementally with SCAN so that Redis is not blocked on large key spaces.  The locks and fencing counters
+// kept alongside entries are left in place, so that locks held stay exclusive and fencing tokens keep increasing.
+func (ctx *Context) ClearPrefix(lckCtx context.Context, prefix string) (int, error) {
+
+	if prefix == "" {
+		return 0, fmt.Errorf("refusing to clear the cache with an empty prefix")
+	}
+
+	logging.Debugf("[%s*] Removing cache entries", prefix)
+
+	removed := 0
+	err := ctx.store().ScanPrefix(lckCtx, prefix, func(keys []string) error {
+		entries := keys[:0]
+		for _, key := range keys {
+			if !isInternalKey(key) {
+				entries = append(entries, key)
+			}
+		}
+		if err := ctx.DeleteMany(lckCtx, entries); err != nil {
+			return err
+		}
+		removed += len(entries)
+		return nil
+	})
+	if err != nil {
+		logging.Errorf("[%s*] Failed to remove cache entries: %s", prefix, err.Error())
+		return removed, fmt.Errorf("failed to remove documents in cache: %s", err.Error())
+	}
+
+	logging.Debugf("[%s*] Removed %d cache entries", prefix, removed)
+	return removed, nil
+}
+
+// isInternalKey reports whether a key holds a lock or a fencing counter rather than an entry
+func isInternalKey(key string) bool {
+	return strings.HasSuffix(key, lockSuffix) || strings.HasSuffix(key, fenceSuffix)
+}
+
+func (ctx *Context) getManyRaw(lckCtx context.Context, ids []string) (map[string][]byte, []string, error) {
+
+	found := make(map[string][]byte, len(ids))
+
+	pending := ids
+	if local := ctx.localCache(); local != nil {
+		pending = nil
+		for _, id := range ids {
+			if fields, ok := local.get(id); ok {
+				if data, ok := fields["data"]; ok {
+					found[id] = []byte(data)
+					continue
+				}
+			}
+			pending = append(pending, id)
+		}
+	}
+
+	if len(pending) > 0 {
+		logging.Debugf("Retrieving %d cache entries", len(pending))
+		values, err := ctx.store().HGetMany(lckCtx, pending, "data")
+		if err != nil {
+			logging.Errorf("Failed to read from Redis: %s", err.Error())
+			return nil, nil, fmt.Errorf("failed to read documents from cache: %s", err.Error())
+		}
+		for id, data := range values {
+			found[id] = []byte(data)
+		}
+	}
+
+	var missing []string
+	for _, id := range ids {
+		data, ok := found[id]
+		if !ok {
+			missing = append(missing, id)
+			continue
+		}
+		decrypted, err := ctx.open(lckCtx, id, data)
+		if err != nil {
+			return nil, nil, err
+		}
+		found[id] = decrypted
+	}
+
+	return found, missing, nil
+}
+
+func (ctx *Context) setManyRaw(lckCtx context.Context, entries map[string][]byte, ttl time.Duration) error {
+
+	if len(entries) == 0 {
+		return nil
+	}
+
+	fields := make(map[string]map[string]string, len(entries))
+	for id, data := range entries {
+		sealed, err := ctx.seal(lckCtx, id, data)
+		if err != nil {
+			logging.Errorf("[%s] Failed to encrypt cache entry: %s", id, err.Error())
+			return fmt.Errorf("failed to encrypt document: %s", err.Error())
+		}
+		fields[id] = map[string]string{"data": string(sealed)}
+	}
+
+	logging.Debugf("Writing %d cache entries", len(entries))
+	if err := ctx.store().HSetMany(lckCtx, fields, ttl); err != nil {
+		logging.Errorf("Failed to write to Redis: %s", err.Error())
+		return fmt.Errorf("failed to save documents in cache: %s", err.Error())
+	}
+
+	ids := make([]string, 0, len(entries))
+	for id := range entries {
+		ids = append(ids, id)
+	}
+	ctx.invalidate(lckCtx, ids...)
+
+	return nil
+}
+
+// GetMany retrieves and deserialises several entries in a single round-trip.  It returns the entries found, keyed by
+// key, along with the keys that were not found.
+func (t *Typed[T]) GetMany(ctx context.Context, keys []string) (map[string]T, []string, error) {
+
+	ids := make([]string, len(keys))
+	for i, key := range keys {
+		ids[i] = t.Key(key)
+	}
+
+	raw, _, err := t.Cache.getManyRaw(ctx, ids)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	found := make(map[string]T, len(raw))
+	var missing []string
+	for i, key := range keys {
+		data, ok := raw[ids[i]]
+		if !ok {
+			missing = append(missing, key)
+			continue
+		}
+		var v T
+		if err := t.codec().Unmarshal(data, &v); err != nil {
+			logging.Errorf("[%s] failed to deserialise data: %s", ids[i], err.Error())
+			return nil, nil, fmt.Errorf("failed to deserialise data for %s: %s", key, err.Error())
+		}
+		found[key] = v
+	}
+
+	return found, missing, nil
+}
+
+// SetMany serialises and stores several entries in a single round-trip.  The entries expire after ttl, or after the
+// default TTL if ttl is zero.
+func (t *Typed[T]) SetMany(ctx context.Context, values map[string]T, ttl time.Duration) error {
+
+	raw := make(map[string][]byte, len(values))
+	for key, value := range values {
+		data, err := t.codec().Marshal(value)
+		if err != nil {
+			logging.Errorf("[%s] failed to serialise data: %s", t.Key(key), err.Error())
+			return fmt.Errorf("failed to serialise data for %s: %s", key, err.Error())
+		}
+		raw[t.Key(key)] = data
+	}
+
+	if ttl == 0 {
+		ttl = t.TTL
+	}
+
+	return t.Cache.setManyRaw(ctx, raw, ttl)
+}
+
+// DeleteMany removes several entries in a single round-trip
+func (t *Typed[T]) DeleteMany(ctx context.Context, keys []string) error {
+
+	ids := make([]string, len(keys))
+	for i, key := range keys {
+		ids[i] = t.Key(key)
+	}
+
+	return t.Cache.DeleteMany(ctx, ids)
+}
+
+// Clear removes every entry of the namespace and returns the number of entries removed
+func (t *Typed[T]) Clear(ctx context.Context) (int, error) {
+
+	if t.Namespace == "" {
+		return 0, fmt.Errorf("cannot clear a cache without a namespace")
+	}
+
+	return t.Cache.ClearPrefix(ctx, t.Namespace+":")
+}
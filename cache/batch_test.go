@@ -0,0 +1,71 @@
+package cache
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBatch(t *testing.T) {
+
+	ctx := context.Background()
+	cache, mem := NewMemory()
+
+	require.NoError(t, cache.SetMany(ctx, map[string]interface{}{
+		"tile:1": "one",
+		"tile:2": "two",
+		"tile:3": "three",
+	}, time.Minute))
+	require.NoError(t, cache.Save(ctx, "other", "keep"))
+
+	found, missing, err := cache.GetMany(ctx, []string{"tile:1", "tile:2", "tile:4"})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"tile:1": `"one"`, "tile:2": `"two"`}, found)
+	assert.Equal(t, []string{"tile:4"}, missing)
+
+	require.NoError(t, cache.DeleteMany(ctx, []string{"tile:1"}))
+	_, missing, _ = cache.GetMany(ctx, []string{"tile:1", "tile:2"})
+	assert.Equal(t, []string{"tile:1"}, missing)
+
+	lock, err := cache.LockContext(ctx, "tile:5", LockOptions{Tries: 1})
+	require.NoError(t, err)
+
+	// Locks survive so that they stay exclusive, and fencing counters so that tokens keep increasing
+	removed, err := cache.ClearPrefix(ctx, "tile:")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, removed)
+	assert.Equal(t, 3, mem.Len())
+	require.NoError(t, lock.Unlock())
+
+	lock, err = cache.LockContext(ctx, "tile:5", LockOptions{Tries: 1})
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), lock.Token)
+	require.NoError(t, lock.Unlock())
+
+	_, err = cache.ClearPrefix(ctx, "")
+	assert.Error(t, err)
+}
+
+func TestTypedBatch(t *testing.T) {
+
+	ctx := context.Background()
+	cache, mem := NewMemory()
+	tiles := NewTyped[[]int](cache, "tiles")
+
+	require.NoError(t, tiles.SetMany(ctx, map[string][]int{"a": {1, 2}, "b": {3}}, time.Minute))
+	require.NoError(t, cache.Save(ctx, "tilesx", "unrelated"))
+
+	found, missing, err := tiles.GetMany(ctx, []string{"a", "b", "c"})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string][]int{"a": {1, 2}, "b": {3}}, found)
+	assert.Equal(t, []string{"c"}, missing)
+
+	require.NoError(t, tiles.DeleteMany(ctx, []string{"a"}))
+	removed, err := tiles.Clear(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, removed)
+	assert.Equal(t, 1, mem.Len())
+}
@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"sync"
 	"time"
 
 	"github.com/9spokes/go/logging/v3"
@@ -23,6 +24,14 @@ type Context struct {
 	MaxRetries int
 	Wait       int
 	RedSync    *redsync.Redsync
+	Keys       KeyProvider // If set, entries are encrypted at rest with keys from this provider
+	// Accept entries which are not encrypted although Keys is set, only meant for the time it takes entries
+	// written before enabling encryption to expire
+	AllowPlaintext bool
+	backend        Backend
+	localMu        sync.RWMutex
+	local          *lru
+	pubsub         *redis.PubSub
 }
 
 // MaxRetries is the number of times we re-attempt to access the cache when it is locked
@@ -31,6 +40,11 @@ const MaxRetries = 20
 // Wait is the amount of time (in seconds) we wait before trying
 const Wait = 2
 
+var (
+	// ErrNotFound is returned when an entry does not exist in the cache
+	ErrNotFound = errors.New("not found")
+)
+
 const (
 	LckRetryTTLMin = 50  //MS
 	LckRetryTTLMax = 600 //MS
@@ -66,6 +80,7 @@ func New(url string) (*Context, error) {
 		MaxRetries: MaxRetries,
 		Wait:       Wait,
 		RedSync:    rs,
+		backend:    &redisBackend{client: client, redsync: rs},
 	}
 
 	_, err = ctx.Redis.Ping(context.Background()).Result()
@@ -76,6 +91,24 @@ func New(url string) (*Context, error) {
 	return &ctx, nil
 }
 
+// NewWithBackend returns a cache context storing its entries in the given backend, such as an in-memory one for
+// unit tests (see NewMemory)
+func NewWithBackend(b Backend) *Context {
+	return &Context{
+		MaxRetries: MaxRetries,
+		Wait:       Wait,
+		backend:    b,
+	}
+}
+
+// store returns the backend of the context, defaulting to its Redis client for contexts not created through New
+func (ctx *Context) store() Backend {
+	if ctx.backend == nil {
+		return &redisBackend{client: ctx.Redis, redsync: ctx.RedSync}
+	}
+	return ctx.backend
+}
+
 // Get grabs an entry from the Redis cache matching the key identified by the "id" parameter and returns the associated
 // unmarkshaled document. If lock is true it first checks if there is a lock on the entry and if found waits until the
 // lock is released.
@@ -84,14 +117,30 @@ func (ctx *Context) Get(lckCtx context.Context, id string, lock bool) (string, e
 	if lock {
 		for i := 0; i < ctx.MaxRetries; i++ {
 			logging.Debugf("[%s] Checking if entry has a cache lock, attempt #%d", id, i+1)
-			if ret, err := ctx.Redis.HGet(lckCtx, id, "lock").Result(); err != redis.Nil {
+			held, err := ctx.store().Exists(lckCtx, id+lockSuffix)
+			if err != nil {
+				logging.Errorf("[%s] Failed to read from Redis: %s", id, err.Error())
+				return "", fmt.Errorf("failed to read document from cache: %s", err.Error())
+			}
+			if held {
+				// A Lock is held on the entry, wait for it to be released or to expire
+				logging.Warningf("[%s] a lock is held on the document, sleeping for %d seconds", id, Wait)
+				time.Sleep(time.Second * Wait)
+				continue
+			}
+			ret, err := ctx.store().HGet(lckCtx, id, "lock")
+			if err != nil && err != ErrNotFound {
+				logging.Errorf("[%s] Failed to read from Redis: %s", id, err.Error())
+				return "", fmt.Errorf("failed to read document from cache: %s", err.Error())
+			}
+			if err != ErrNotFound {
 				expiry, err := time.Parse(time.RFC3339, ret)
 				if err != nil {
 					logging.Errorf("[%s] Could not parse expiry of cache entry %s: %s", id, expiry, err.Error())
 					ctx.Clear(lckCtx, id)
 					break
 				}
-				if expiry.Before(time.Now()) {
+				if expiry.Before(ctx.store().Now()) {
 					logging.Errorf("[%s] The lock for this entry has expired", id)
 					ctx.Clear(lckCtx, id)
 					break
@@ -104,20 +153,22 @@ func (ctx *Context) Get(lckCtx context.Context, id string, lock bool) (string, e
 		}
 	}
 
-	logging.Debugf("[%s] Retrieving cache entry", id)
-	cached, err := ctx.Redis.HGet(lckCtx, id, "data").Result()
-	if err == redis.Nil {
-		logging.Debugf("[%s] Entry not found in cache", id)
-		return "", errors.New("not found")
+	cached, err := ctx.getRaw(lckCtx, id)
+	if err != nil {
+		return "", err
 	}
 
-	logging.Debugf("[%s] Entry found in cache", id)
-
-	return cached, nil
+	return string(cached), nil
 }
 
 // Save commits a key/value pair into Redis
 func (ctx *Context) Save(lckCtx context.Context, id string, data interface{}) error {
+	return ctx.SaveWithTTL(lckCtx, id, data, 0)
+}
+
+// SaveWithTTL commits a key/value pair into Redis which expires after the given ttl.  A zero ttl leaves the expiry
+// of an existing entry untouched.
+func (ctx *Context) SaveWithTTL(lckCtx context.Context, id string, data interface{}, ttl time.Duration) error {
 
 	logging.Debugf("[%s] Saving cache entry", id)
 	str, err := json.Marshal(data)
@@ -126,48 +177,115 @@ func (ctx *Context) Save(lckCtx context.Context, id string, data interface{}) er
 		return fmt.Errorf("failed to serialise data: %s", err.Error())
 	}
 
-	logging.Debugf("[%s] Writing to Redis", id)
-	if _, err = ctx.Redis.HSet(lckCtx, id, "data", str).Result(); err != nil {
-		logging.Errorf("[%s] Failed to write to Redis: %s", id, err.Error())
-		return fmt.Errorf("failed to save document in cache: %s", err.Error())
-	}
-	logging.Debugf("[%s] Cache write was successful", id)
-	return nil
+	return ctx.setRaw(lckCtx, id, str, ttl)
 }
 
-func (ctx *Context) Lock(id string) (func(), error) {
+// getRaw reads the serialised data of a cache entry, returning ErrNotFound if there is none
+func (ctx *Context) getRaw(lckCtx context.Context, id string) ([]byte, error) {
 
-	mutex := ctx.RedSync.NewMutex(id)
+	logging.Debugf("[%s] Retrieving cache entry", id)
 
-	for i := 0; i < ctx.MaxRetries; i++ {
-		err := mutex.Lock()
-		//Failed to acquire lock after exhausting all retries, keep try until its unlocked
-		if err == redsync.ErrFailed {
-			logging.Debugf("failed to acquire lock after exhausting all retries, sleeping for %d seconds before retrying", Wait)
-			time.Sleep(time.Second * Wait)
-			continue
-		}
+	if local := ctx.localCache(); local != nil {
+		fields, err := ctx.readLocal(lckCtx, local, id)
 		if err != nil {
 			return nil, err
 		}
-		break
+		data, ok := fields["data"]
+		if !ok {
+			return nil, ErrNotFound
+		}
+		return ctx.open(lckCtx, id, []byte(data))
 	}
 
-	return func() {
-		if ok, err := mutex.Unlock(); !ok || err != nil {
-			logging.Errorf("failed to unlock, ok: %t, err: %s", ok, err.Error())
+	cached, err := ctx.store().HGet(lckCtx, id, "data")
+	if err == ErrNotFound {
+		logging.Debugf("[%s] Entry not found in cache", id)
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		logging.Errorf("[%s] Failed to read from Redis: %s", id, err.Error())
+		return nil, fmt.Errorf("failed to read document from cache: %s", err.Error())
+	}
+
+	logging.Debugf("[%s] Entry found in cache", id)
+
+	return ctx.open(lckCtx, id, []byte(cached))
+}
+
+// getFields reads the given fields of a cache entry, omitting those that are not set.  ErrNotFound is returned if
+// none of them are set.
+func (ctx *Context) getFields(lckCtx context.Context, id string, fields ...string) (map[string]string, error) {
+
+	if local := ctx.localCache(); local != nil {
+		all, err := ctx.readLocal(lckCtx, local, id)
+		if err != nil {
+			return nil, err
+		}
+		ret := make(map[string]string)
+		for _, f := range fields {
+			if v, ok := all[f]; ok {
+				ret[f] = v
+			}
+		}
+		if len(ret) == 0 {
+			return nil, ErrNotFound
 		}
-	}, nil
+		return ret, nil
+	}
+
+	ret, err := ctx.store().HMGet(lckCtx, id, fields...)
+	if err != nil {
+		logging.Errorf("[%s] Failed to read from Redis: %s", id, err.Error())
+		return nil, fmt.Errorf("failed to read document from cache: %s", err.Error())
+	}
+
+	if len(ret) == 0 {
+		return nil, ErrNotFound
+	}
+
+	return ret, nil
+}
+
+// replaceFields atomically replaces a cache entry with the given fields and sets its expiry if ttl is non-zero
+func (ctx *Context) replaceFields(lckCtx context.Context, id string, fields map[string]string, ttl time.Duration) error {
+
+	if err := ctx.store().Replace(lckCtx, id, fields, ttl); err != nil {
+		logging.Errorf("[%s] Failed to write to Redis: %s", id, err.Error())
+		return fmt.Errorf("failed to save document in cache: %s", err.Error())
+	}
+	ctx.invalidate(lckCtx, id)
+
+	return nil
+}
+
+// setRaw writes the serialised data of a cache entry and sets its expiry if ttl is non-zero
+func (ctx *Context) setRaw(lckCtx context.Context, id string, data []byte, ttl time.Duration) error {
+
+	data, err := ctx.seal(lckCtx, id, data)
+	if err != nil {
+		logging.Errorf("[%s] Failed to encrypt cache entry: %s", id, err.Error())
+		return fmt.Errorf("failed to encrypt document: %s", err.Error())
+	}
+
+	logging.Debugf("[%s] Writing to Redis", id)
+	if err := ctx.store().HSet(lckCtx, id, map[string]string{"data": string(data)}, ttl); err != nil {
+		logging.Errorf("[%s] Failed to write to Redis: %s", id, err.Error())
+		return fmt.Errorf("failed to save document in cache: %s", err.Error())
+	}
+	ctx.invalidate(lckCtx, id)
+	logging.Debugf("[%s] Cache write was successful", id)
+	return nil
 }
 
 // Clear removes a Redis cache entry identified by the "id" parameter
 func (ctx *Context) Clear(lckCtx context.Context, id string) error {
 
 	logging.Debugf("[%s] Removing cache entry", id)
-	if _, err := ctx.Redis.Del(lckCtx, id).Result(); err != nil {
+	if err := ctx.store().Del(lckCtx, id); err != nil {
 		logging.Errorf("[%s] Failed to remove cache entry: %s", id, err.Error())
 		return fmt.Errorf("failed to remove document in cache: %s", err.Error())
 	}
+	ctx.invalidate(lckCtx, id)
 	logging.Debugf("[%s] Successfully removed the record", id)
 	return nil
 }
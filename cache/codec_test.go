@@ -0,0 +1,43 @@
+package cache
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCodecs(t *testing.T) {
+
+	type entry struct {
+		Name  string
+		Count int
+		Tags  []string
+	}
+
+	tests := []struct {
+		Name  string
+		Codec Codec
+	}{
+		{Name: "json", Codec: JSON},
+		{Name: "gob", Codec: Gob},
+		{Name: "msgpack", Codec: MsgPack},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			in := entry{Name: "xero", Count: 3, Tags: []string{"a", "b"}}
+
+			data, err := test.Codec.Marshal(in)
+			assert.NoError(t, err)
+
+			var out entry
+			assert.NoError(t, test.Codec.Unmarshal(data, &out))
+			assert.Equal(t, in, out)
+		})
+	}
+}
+
+func TestTypedKey(t *testing.T) {
+	assert.Equal(t, "token:abc", NewTyped[string](nil, "token").Key("abc"))
+	assert.Equal(t, "abc", NewTyped[string](nil, "").Key("abc"))
+}
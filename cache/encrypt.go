@@ -0,0 +1,83 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+
+	"github.com/9spokes/go/crypto"
+)
+
+// sealedPrefix marks a value encrypted by Seal
+const sealedPrefix = "enc2."
+
+// ErrNotEncrypted is returned when opening a value which was not sealed
+var ErrNotEncrypted = errors.New("value is not encrypted")
+
+// KeyProvider wraps the data keys encrypting cache entries at rest, see crypto.KeyProvider
+type KeyProvider = crypto.KeyProvider
+
+// StaticKeys is a KeyProvider holding a fixed set of keys, see crypto.Keyring.  Keys can be rotated by adding a new
+// key, making it primary, and removing the old one once the entries it encrypted have expired.
+type StaticKeys = crypto.Keyring
+
+// Seal encrypts data with a new data key wrapped by the key provider, see crypto.Sealer.  The additional data,
+// typically the cache key, is authenticated but not stored, preventing sealed values from being swapped between
+// entries.  The result is of the form "enc2.<base64 sealed value>".
+func Seal(ctx context.Context, keys KeyProvider, data, aad []byte) ([]byte, error) {
+
+	sealed, err := crypto.Sealer{Provider: keys}.Seal(ctx, data, aad)
+	if err != nil {
+		return nil, err
+	}
+
+	return []byte(sealedPrefix + base64.RawStdEncoding.EncodeToString(sealed)), nil
+}
+
+// Open decrypts a value produced by Seal with the same additional data.  Values that were not sealed are rejected
+// with ErrNotEncrypted.
+func Open(ctx context.Context, keys KeyProvider, value, aad []byte) ([]byte, error) {
+
+	if !IsSealed(value) {
+		return nil, ErrNotEncrypted
+	}
+
+	sealed, err := base64.RawStdEncoding.DecodeString(string(value[len(sealedPrefix):]))
+	if err != nil {
+		return nil, fmt.Errorf("malformed encrypted value: %s", err.Error())
+	}
+
+	data, err := crypto.Sealer{Provider: keys}.Open(ctx, sealed, aad)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt value: %w", err)
+	}
+
+	return data, nil
+}
+
+// IsSealed reports whether a value was produced by Seal
+func IsSealed(value []byte) bool {
+	return bytes.HasPrefix(value, []byte(sealedPrefix))
+}
+
+// seal encrypts the data field of an entry if the context has encryption keys configured
+func (ctx *Context) seal(lckCtx context.Context, id string, data []byte) ([]byte, error) {
+	if ctx.Keys == nil {
+		return data, nil
+	}
+	return Seal(lckCtx, ctx.Keys, data, []byte(id))
+}
+
+// open decrypts the data field of an entry if the context has encryption keys configured.  Entries which are not
+// encrypted are only accepted with AllowPlaintext, as anyone able to write to the cache could forge them otherwise.
+func (ctx *Context) open(lckCtx context.Context, id string, data []byte) ([]byte, error) {
+	if ctx.Keys == nil {
+		return data, nil
+	}
+	if ctx.AllowPlaintext && !IsSealed(data) {
+		return data, nil
+	}
+	return Open(lckCtx, ctx.Keys, data, []byte(id))
+}
@@ -0,0 +1,108 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"github.com/9spokes/go/crypto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSealOpen(t *testing.T) {
+
+	keys := &StaticKeys{Primary: "k1", Keys: map[string][]byte{"k1": bytes.Repeat([]byte{1}, 32)}}
+
+	sealed, err := Seal(context.Background(), keys, []byte(`{"token":"secret"}`), []byte("conn-1"))
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(sealed), "enc2."))
+	assert.NotContains(t, string(sealed), "secret")
+
+	opened, err := Open(context.Background(), keys, sealed, []byte("conn-1"))
+	assert.NoError(t, err)
+	assert.Equal(t, `{"token":"secret"}`, string(opened))
+
+	_, err = Open(context.Background(), keys, sealed, []byte("conn-2"))
+	assert.Error(t, err, "value moved to another entry must not decrypt")
+
+	_, err = Open(context.Background(), keys, []byte(`{"legacy":true}`), []byte("conn-1"))
+	assert.ErrorIs(t, err, ErrNotEncrypted)
+
+	// After rotation, values sealed with the previous key remain readable
+	keys.Keys["k2"] = bytes.Repeat([]byte{2}, 32)
+	keys.Primary = "k2"
+	opened, err = Open(context.Background(), keys, sealed, []byte("conn-1"))
+	assert.NoError(t, err)
+	assert.Equal(t, `{"token":"secret"}`, string(opened))
+
+	resealed, err := Seal(context.Background(), keys, opened, []byte("conn-1"))
+	require.NoError(t, err)
+	id, err := crypto.SealedKeyID(mustDecode(t, resealed))
+	assert.NoError(t, err)
+	assert.Equal(t, "k2", id)
+
+	delete(keys.Keys, "k1")
+	_, err = Open(context.Background(), keys, sealed, []byte("conn-1"))
+	assert.Error(t, err)
+}
+
+func TestEncryptedContext(t *testing.T) {
+
+	ctx := context.Background()
+	cache, mem := NewMemory()
+	cache.Keys = &StaticKeys{Primary: "k1", Keys: map[string][]byte{"k1": bytes.Repeat([]byte{1}, 32)}}
+
+	require.NoError(t, cache.Save(ctx, "conn-1", map[string]string{"access_token": "secret"}))
+
+	stored, err := mem.HGet(ctx, "conn-1", "data")
+	require.NoError(t, err)
+	assert.NotContains(t, stored, "secret")
+
+	ret, err := cache.Get(ctx, "conn-1", false)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"access_token":"secret"}`, ret)
+
+	typed := NewTyped[map[string]string](cache, "token")
+	v, err := typed.GetOrLoad(ctx, "conn-2", 0, func(context.Context) (map[string]string, error) {
+		return map[string]string{"access_token": "other"}, nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "other", v["access_token"])
+
+	stored, err = mem.HGet(ctx, "token:conn-2", "data")
+	require.NoError(t, err)
+	assert.NotContains(t, stored, "other")
+
+	v, err = typed.Get(ctx, "conn-2")
+	assert.NoError(t, err)
+	assert.Equal(t, "other", v["access_token"])
+}
+
+func TestPlaintextEntries(t *testing.T) {
+
+	ctx := context.Background()
+	cache, mem := NewMemory()
+	require.NoError(t, cache.Save(ctx, "conn-1", map[string]string{"access_token": "forged"}))
+
+	cache.Keys = &StaticKeys{Primary: "k1", Keys: map[string][]byte{"k1": bytes.Repeat([]byte{1}, 32)}}
+	_, err := cache.Get(ctx, "conn-1", false)
+	assert.ErrorIs(t, err, ErrNotEncrypted)
+
+	cache.AllowPlaintext = true
+	ret, err := cache.Get(ctx, "conn-1", false)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"access_token":"forged"}`, ret)
+
+	stored, err := mem.HGet(ctx, "conn-1", "data")
+	require.NoError(t, err)
+	assert.Equal(t, `{"access_token":"forged"}`, stored)
+}
+
+func mustDecode(t *testing.T, sealed []byte) []byte {
+	b, err := base64.RawStdEncoding.DecodeString(strings.TrimPrefix(string(sealed), "enc2."))
+	require.NoError(t, err)
+	return b
+}
@@ -0,0 +1,206 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/9spokes/go/logging/v3"
+	"github.com/9spokes/go/middleware/recoverer"
+)
+
+// loadSuffix is appended to the key of an entry to name the lock coalescing its loads across instances
+const loadSuffix = ":load"
+
+// DefaultLoadTimeout bounds a loader call of GetOrLoad unless configured otherwise
+const DefaultLoadTimeout = 30 * time.Second
+
+// detached carries the values of a context without its cancellation or deadline, as context.WithoutCancel of later
+// Go versions
+type detached struct {
+	context.Context
+}
+
+func (detached) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detached) Done() <-chan struct{}       { return nil }
+func (detached) Err() error                  { return nil }
+
+// entry is a cache entry written by GetOrLoad.  Alongside the data it records the time at which the entry becomes
+// stale, which is earlier than its expiry in Redis when stale-while-revalidate is enabled.
+type entry[T any] struct {
+	value   T
+	missing bool
+	expires time.Time
+}
+
+func (e entry[T]) fresh(now time.Time) bool {
+	return e.expires.IsZero() || now.Before(e.expires)
+}
+
+// GetOrLoad returns the entry for key, calling loader on a miss and caching its result for ttl (or the default TTL if
+// ttl is zero).  The loader should return ErrNotFound if the value does not exist, which is cached for NegativeTTL.
+//
+// Concurrent misses for the same key within this process share a single loader call, which is bounded by LoadTimeout
+// rather than cancelled along with the context of any one caller, each caller still returning once its own ctx is
+// done.  If Distributed is set, misses are also coalesced across instances using a RedSync lock held for as long as
+// the loader runs.  If Stale is set, an expired entry is still served for that long while it is refreshed in the
+// background.
+func (t *Typed[T]) GetOrLoad(ctx context.Context, key string, ttl time.Duration, loader func(context.Context) (T, error)) (T, error) {
+
+	if ttl == 0 {
+		ttl = t.TTL
+	}
+
+	e, err := t.read(ctx, key)
+	if err == nil {
+		if e.fresh(t.Cache.store().Now()) {
+			if e.missing {
+				return e.value, ErrNotFound
+			}
+			return e.value, nil
+		}
+		if !e.missing {
+			logging.Debugf("[%s] Serving stale cache entry while refreshing", t.Key(key))
+			go func() {
+				defer recoverer.RecoverGoroutinePanic("cache refresh "+t.Key(key), nil, nil)
+				if _, err := t.load(context.Background(), key, ttl, loader); err != nil && err != ErrNotFound {
+					logging.Warningf("[%s] Failed to refresh stale cache entry: %s", t.Key(key), err.Error())
+				}
+			}()
+			return e.value, nil
+		}
+	} else if err != ErrNotFound {
+		logging.Warningf("[%s] Cache lookup failed, falling back to loader: %s", t.Key(key), err.Error())
+	}
+
+	return t.load(ctx, key, ttl, loader)
+}
+
+func (t *Typed[T]) load(ctx context.Context, key string, ttl time.Duration, loader func(context.Context) (T, error)) (T, error) {
+
+	ret, err := t.group.do(ctx, key, func() (interface{}, error) {
+
+		// Shared by every caller waiting for the load
+		timeout := t.LoadTimeout
+		if timeout == 0 {
+			timeout = DefaultLoadTimeout
+		}
+		ctx, cancel := context.WithTimeout(detached{ctx}, timeout)
+		defer cancel()
+
+		if t.Distributed {
+			lock, err := t.Cache.LockContext(ctx, t.Key(key)+loadSuffix, LockOptions{AutoExtend: true})
+			if err != nil {
+				logging.Warningf("[%s] Failed to acquire load lock, loading without it: %s", t.Key(key), err.Error())
+			} else {
+				defer func() {
+					if err := lock.Unlock(); err != nil {
+						logging.Warningf("[%s] %s", t.Key(key), err.Error())
+					}
+				}()
+				// Another instance may have loaded the entry while we were waiting for the lock
+				if e, err := t.read(ctx, key); err == nil && e.fresh(t.Cache.store().Now()) {
+					if e.missing {
+						return e.value, ErrNotFound
+					}
+					return e.value, nil
+				}
+			}
+		}
+
+		logging.Debugf("[%s] Loading cache entry", t.Key(key))
+		v, err := loader(ctx)
+		if errors.Is(err, ErrNotFound) {
+			if t.NegativeTTL > 0 {
+				if err := t.write(ctx, key, nil, t.NegativeTTL); err != nil {
+					logging.Warningf("[%s] Failed to cache not-found result: %s", t.Key(key), err.Error())
+				}
+			}
+			return v, ErrNotFound
+		}
+		if err != nil {
+			return v, err
+		}
+
+		if err := t.write(ctx, key, &v, ttl); err != nil {
+			logging.Warningf("[%s] Failed to cache loaded entry: %s", t.Key(key), err.Error())
+		}
+
+		return v, nil
+	})
+
+	v, _ := ret.(T)
+	return v, err
+}
+
+func (t *Typed[T]) read(ctx context.Context, key string) (entry[T], error) {
+
+	var e entry[T]
+
+	fields, err := t.Cache.getFields(ctx, t.Key(key), "data", "expires", "missing")
+	if err != nil {
+		return e, err
+	}
+
+	if expires, ok := fields["expires"]; ok {
+		ms, err := strconv.ParseInt(expires, 10, 64)
+		if err != nil {
+			return e, fmt.Errorf("invalid expiry on cache entry: %s", err.Error())
+		}
+		if ms > 0 {
+			e.expires = time.UnixMilli(ms)
+		}
+	}
+
+	if _, ok := fields["missing"]; ok {
+		e.missing = true
+		return e, nil
+	}
+
+	data, ok := fields["data"]
+	if !ok {
+		return e, ErrNotFound
+	}
+
+	decrypted, err := t.Cache.open(ctx, t.Key(key), []byte(data))
+	if err != nil {
+		return e, err
+	}
+
+	if err := t.codec().Unmarshal(decrypted, &e.value); err != nil {
+		return e, fmt.Errorf("failed to deserialise data: %s", err.Error())
+	}
+
+	return e, nil
+}
+
+// write replaces the entry for key with value, or with a not-found marker if value is nil.  The entry is kept in
+// Redis for an additional Stale period past its ttl so that it can be served while being refreshed.
+func (t *Typed[T]) write(ctx context.Context, key string, value *T, ttl time.Duration) error {
+
+	fields := map[string]string{}
+
+	if ttl > 0 {
+		fields["expires"] = strconv.FormatInt(t.Cache.store().Now().Add(ttl).UnixMilli(), 10)
+		ttl += t.Stale
+	} else {
+		fields["expires"] = "0"
+	}
+
+	if value == nil {
+		fields["missing"] = "1"
+	} else {
+		data, err := t.codec().Marshal(*value)
+		if err != nil {
+			return fmt.Errorf("failed to serialise data: %s", err.Error())
+		}
+		if data, err = t.Cache.seal(ctx, t.Key(key), data); err != nil {
+			return fmt.Errorf("failed to encrypt document: %s", err.Error())
+		}
+		fields["data"] = string(data)
+	}
+
+	return t.Cache.replaceFields(ctx, t.Key(key), fields, ttl)
+}
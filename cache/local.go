@@ -0,0 +1,281 @@
+package cache
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/9spokes/go/logging/v3"
+	"github.com/9spokes/go/middleware/recoverer"
+
+	redis "github.com/go-redis/redis/v8"
+)
+
+// InvalidationChannel is the Redis pub/sub channel on which local cache invalidations are broadcast to all instances.
+// Each message holds the newline-separated keys of the entries to evict.
+const InvalidationChannel = "cache:invalidate"
+
+// lru is a size and time bounded in-process cache of Redis hash entries
+type lru struct {
+	mu    sync.Mutex
+	size  int
+	ttl   time.Duration
+	epoch uint64              // Incremented by purge
+	reads map[string]*lruRead // Reads through in flight, by key
+	ll    *list.List
+	items map[string]*list.Element
+}
+
+// lruRead tracks the reads through of a key in flight, so that those racing with an invalidation of the key can be
+// discarded
+type lruRead struct {
+	gen  uint64
+	refs int
+}
+
+// lruGen is the generation of a key when a read through started, see generation
+type lruGen struct {
+	epoch, gen uint64
+}
+
+type lruItem struct {
+	key     string
+	fields  map[string]string
+	expires time.Time
+}
+
+func newLRU(size int, ttl time.Duration) *lru {
+	return &lru{size: size, ttl: ttl, reads: make(map[string]*lruRead), ll: list.New(), items: make(map[string]*list.Element)}
+}
+
+func (c *lru) get(key string) (map[string]string, bool) {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+
+	item := el.Value.(*lruItem)
+	if time.Now().After(item.expires) {
+		c.ll.Remove(el)
+		delete(c.items, key)
+		return nil, false
+	}
+
+	c.ll.MoveToFront(el)
+	return item.fields, true
+}
+
+// generation starts a read through of key and returns a token to pass to add, which discards the entry if the key
+// was invalidated in the meantime.  Every call must be followed by a call to add or release.
+func (c *lru) generation(key string) lruGen {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	r, ok := c.reads[key]
+	if !ok {
+		r = &lruRead{}
+		c.reads[key] = r
+	}
+	r.refs++
+
+	return lruGen{epoch: c.epoch, gen: r.gen}
+}
+
+// release ends a read through of key started with generation without adding an entry
+func (c *lru) release(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.end(key)
+}
+
+// end ends a read through of key and returns its current generation.  The caller must hold c.mu.
+func (c *lru) end(key string) (uint64, bool) {
+
+	r, ok := c.reads[key]
+	if !ok {
+		return 0, false
+	}
+
+	if r.refs--; r.refs == 0 {
+		delete(c.reads, key)
+	}
+
+	return r.gen, true
+}
+
+// add ends a read through of key started with generation and stores the entry read for at most the cache TTL, or ttl
+// if it is shorter and non-zero
+func (c *lru) add(key string, fields map[string]string, ttl time.Duration, gen lruGen) {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	current, ok := c.end(key)
+	if !ok || current != gen.gen || c.epoch != gen.epoch {
+		return
+	}
+
+	if ttl <= 0 || ttl > c.ttl {
+		ttl = c.ttl
+	}
+
+	item := &lruItem{key: key, fields: fields, expires: time.Now().Add(ttl)}
+
+	if el, ok := c.items[key]; ok {
+		el.Value = item
+		c.ll.MoveToFront(el)
+		return
+	}
+
+	c.items[key] = c.ll.PushFront(item)
+
+	for c.ll.Len() > c.size {
+		el := c.ll.Back()
+		c.ll.Remove(el)
+		delete(c.items, el.Value.(*lruItem).key)
+	}
+}
+
+func (c *lru) remove(key string) {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if r, ok := c.reads[key]; ok {
+		r.gen++
+	}
+	if el, ok := c.items[key]; ok {
+		c.ll.Remove(el)
+		delete(c.items, key)
+	}
+}
+
+func (c *lru) purge() {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.epoch++
+	c.ll.Init()
+	c.items = make(map[string]*list.Element)
+}
+
+// EnableLocal places an in-process LRU cache of up to size entries in front of Redis.  Entries are kept locally for
+// at most ttl, and are evicted on every instance whenever they are saved or cleared through any cache Context
+// subscribed to the InvalidationChannel.  It must be called before the Context is shared between goroutines.
+func (ctx *Context) EnableLocal(size int, ttl time.Duration) error {
+
+	if size <= 0 || ttl <= 0 {
+		return fmt.Errorf("local cache size and TTL must be positive")
+	}
+
+	if ctx.Redis == nil {
+		return fmt.Errorf("local cache invalidation requires a Redis client")
+	}
+
+	sub := ctx.Redis.Subscribe(context.Background(), InvalidationChannel)
+	if _, err := sub.Receive(context.Background()); err != nil {
+		sub.Close()
+		return fmt.Errorf("failed to subscribe to cache invalidations: %s", err.Error())
+	}
+
+	local := newLRU(size, ttl)
+	ctx.localMu.Lock()
+	ctx.local = local
+	ctx.pubsub = sub
+	ctx.localMu.Unlock()
+
+	go func() {
+		defer recoverer.RecoverGoroutinePanic("cache invalidation listener", nil, nil)
+		for msg := range sub.ChannelWithSubscriptions(context.Background(), 100) {
+			switch m := msg.(type) {
+			case *redis.Message:
+				for _, id := range strings.Split(m.Payload, "\n") {
+					logging.Debugf("[%s] Evicting local cache entry", id)
+					local.remove(id)
+				}
+			case *redis.Subscription:
+				// Invalidations may have been missed while reconnecting
+				logging.Debugf("Resubscribed to cache invalidations, purging local cache")
+				local.purge()
+			}
+		}
+	}()
+
+	return nil
+}
+
+// DisableLocal removes the in-process cache and stops listening for invalidations.  It may be called while the
+// Context is in use.
+func (ctx *Context) DisableLocal() error {
+
+	ctx.localMu.Lock()
+	sub := ctx.pubsub
+	ctx.local = nil
+	ctx.pubsub = nil
+	ctx.localMu.Unlock()
+
+	if sub == nil {
+		return nil
+	}
+
+	return sub.Close()
+}
+
+// localCache returns the in-process cache, or nil if it is disabled
+func (ctx *Context) localCache() *lru {
+	ctx.localMu.RLock()
+	defer ctx.localMu.RUnlock()
+	return ctx.local
+}
+
+// readLocal returns all fields of a cache entry from the local cache, reading them through from Redis on a miss
+func (ctx *Context) readLocal(lckCtx context.Context, local *lru, id string) (map[string]string, error) {
+
+	if fields, ok := local.get(id); ok {
+		logging.Debugf("[%s] Entry found in local cache", id)
+		return fields, nil
+	}
+
+	gen := local.generation(id)
+
+	fields, ttl, err := ctx.store().HGetAll(lckCtx, id)
+	if err != nil {
+		local.release(id)
+		logging.Errorf("[%s] Failed to read from Redis: %s", id, err.Error())
+		return nil, fmt.Errorf("failed to read document from cache: %s", err.Error())
+	}
+
+	if len(fields) == 0 {
+		local.release(id)
+		return nil, ErrNotFound
+	}
+
+	local.add(id, fields, ttl, gen)
+
+	return fields, nil
+}
+
+// invalidate evicts entries from the local cache of every instance with a single broadcast
+func (ctx *Context) invalidate(lckCtx context.Context, ids ...string) {
+
+	local := ctx.localCache()
+	if local == nil || len(ids) == 0 {
+		return
+	}
+
+	for _, id := range ids {
+		local.remove(id)
+	}
+	if err := ctx.Redis.Publish(lckCtx, InvalidationChannel, strings.Join(ids, "\n")).Err(); err != nil {
+		logging.Warningf("Failed to broadcast the invalidation of %d cache entries: %s", len(ids), err.Error())
+	}
+}
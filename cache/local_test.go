@@ -0,0 +1,57 @@
+package cache
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLRU(t *testing.T) {
+
+	t.Run("evicts least recently used entries beyond its size", func(t *testing.T) {
+		c := newLRU(2, time.Minute)
+		c.add("a", map[string]string{"data": "1"}, 0, c.generation("a"))
+		c.add("b", map[string]string{"data": "2"}, 0, c.generation("b"))
+		c.get("a")
+		c.add("c", map[string]string{"data": "3"}, 0, c.generation("c"))
+
+		_, ok := c.get("b")
+		assert.False(t, ok)
+		_, ok = c.get("a")
+		assert.True(t, ok)
+		_, ok = c.get("c")
+		assert.True(t, ok)
+	})
+
+	t.Run("expires entries after the shortest TTL", func(t *testing.T) {
+		c := newLRU(2, time.Minute)
+		c.add("a", map[string]string{"data": "1"}, 10*time.Millisecond, c.generation("a"))
+		_, ok := c.get("a")
+		assert.True(t, ok)
+		time.Sleep(20 * time.Millisecond)
+		_, ok = c.get("a")
+		assert.False(t, ok)
+	})
+
+	t.Run("discards reads racing with an invalidation of the same key", func(t *testing.T) {
+		c := newLRU(2, time.Minute)
+		a, b := c.generation("a"), c.generation("b")
+		c.remove("a")
+		c.add("a", map[string]string{"data": "stale"}, 0, a)
+		c.add("b", map[string]string{"data": "2"}, 0, b)
+		_, ok := c.get("a")
+		assert.False(t, ok)
+		_, ok = c.get("b")
+		assert.True(t, ok)
+		assert.Empty(t, c.reads)
+	})
+
+	t.Run("purge removes all entries", func(t *testing.T) {
+		c := newLRU(2, time.Minute)
+		c.add("a", map[string]string{"data": "1"}, 0, c.generation("a"))
+		c.purge()
+		_, ok := c.get("a")
+		assert.False(t, ok)
+	})
+}
@@ -0,0 +1,195 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/9spokes/go/logging/v3"
+	"github.com/9spokes/go/middleware/recoverer"
+)
+
+// lockSuffix is appended to a locked key to name the lock itself, so that it never takes the place of the entry
+const lockSuffix = ":lock"
+
+// fenceSuffix is appended to a locked key to name the counter its fencing tokens are drawn from
+const fenceSuffix = ":fence"
+
+// fenceTTL is how long the fencing counter of a key is kept after it was last locked
+const fenceTTL = 30 * 24 * time.Hour
+
+// ErrLockNotAcquired is returned when a lock could not be acquired before retries were exhausted or the context ended
+var ErrLockNotAcquired = errors.New("lock not acquired")
+
+// LockOptions configures the acquisition of a distributed lock
+type LockOptions struct {
+	TTL        time.Duration // Expiry of the lock, defaults to LckLockTTL seconds
+	Tries      int           // Number of acquisition attempts, defaults to LckRetryCount
+	RetryDelay time.Duration // Delay between attempts, defaults to a random delay between LckRetryTTLMin and LckRetryTTLMax milliseconds
+	AutoExtend bool          // Whether to keep extending the lock in the background until it is unlocked
+}
+
+// Lock is a distributed lock held on a cache key
+type Lock struct {
+	Key   string // The locked key
+	Token int64  // Fencing token, strictly increasing with every acquisition of the key unless unlocked for 30 days
+
+	mutex Mutex
+	stop  chan struct{}
+	done  chan struct{}
+	lost  chan struct{}
+	once  sync.Once
+	mu    sync.Mutex
+	err   error
+}
+
+// LockContext acquires a distributed lock on id, retrying until the configured number of attempts is exhausted or
+// lckCtx is done, in which case an error wrapping ErrLockNotAcquired is returned.  The returned Lock carries a fencing
+// token which callers should pass along to the resources they protect, so that writes made by a holder whose lock
+// has since expired can be rejected.
+func (ctx *Context) LockContext(lckCtx context.Context, id string, opts LockOptions) (*Lock, error) {
+
+	if opts.TTL == 0 {
+		opts.TTL = LckLockTTL * time.Second
+	}
+
+	if opts.Tries == 0 {
+		opts.Tries = LckRetryCount
+	}
+
+	mutexOpts := MutexOptions{Expiry: opts.TTL, Tries: opts.Tries}
+	if opts.RetryDelay > 0 {
+		mutexOpts.RetryDelay = func(tries int) time.Duration { return opts.RetryDelay }
+	} else {
+		mutexOpts.RetryDelay = func(tries int) time.Duration {
+			return time.Duration(rand.Intn(LckRetryTTLMax-LckRetryTTLMin)+LckRetryTTLMin) * time.Millisecond
+		}
+	}
+
+	mutex := ctx.store().NewMutex(id+lockSuffix, mutexOpts)
+
+	logging.Debugf("[%s] Acquiring lock", id)
+	if err := mutex.LockContext(lckCtx); err != nil {
+		if err == ErrLockNotAcquired {
+			if lckCtx.Err() != nil {
+				return nil, fmt.Errorf("%w: %s", ErrLockNotAcquired, lckCtx.Err().Error())
+			}
+			return nil, fmt.Errorf("%w: retries exhausted", ErrLockNotAcquired)
+		}
+		return nil, fmt.Errorf("failed to acquire lock: %s", err.Error())
+	}
+
+	token, err := ctx.store().Incr(lckCtx, id+fenceSuffix, fenceTTL)
+	if err != nil {
+		mutex.UnlockContext(context.Background())
+		return nil, fmt.Errorf("failed to generate fencing token: %s", err.Error())
+	}
+
+	lock := &Lock{
+		Key:   id,
+		Token: token,
+		mutex: mutex,
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+		lost:  make(chan struct{}),
+	}
+
+	if opts.AutoExtend {
+		go lock.watchdog(opts.TTL / 3)
+	} else {
+		close(lock.done)
+	}
+
+	logging.Debugf("[%s] Lock acquired with fencing token %d", id, token)
+	return lock, nil
+}
+
+// Lock acquires a distributed lock on id and returns a function releasing it
+func (ctx *Context) Lock(id string) (func(), error) {
+
+	lock, err := ctx.LockContext(context.Background(), id, LockOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	return func() {
+		if err := lock.Unlock(); err != nil {
+			logging.Errorf("[%s] %s", id, err.Error())
+		}
+	}, nil
+}
+
+// Lost returns a channel which is closed if the lock could not be extended and may now be held by someone else
+func (l *Lock) Lost() <-chan struct{} {
+	return l.lost
+}
+
+// Err returns the reason the lock was lost, if any
+func (l *Lock) Err() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.err
+}
+
+// Until returns the time at which the lock expires unless it is extended
+func (l *Lock) Until() time.Time {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.mutex.Until()
+}
+
+// Unlock stops extending the lock and releases it.  An error is returned if the lock could not be released or was
+// no longer held.
+func (l *Lock) Unlock() error {
+
+	l.once.Do(func() { close(l.stop) })
+	<-l.done
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	ok, err := l.mutex.UnlockContext(context.Background())
+	if err != nil {
+		return fmt.Errorf("failed to release lock: %s", err.Error())
+	}
+	if !ok {
+		return fmt.Errorf("failed to release lock: lock was no longer held")
+	}
+
+	logging.Debugf("[%s] Lock released", l.Key)
+	return nil
+}
+
+func (l *Lock) watchdog(interval time.Duration) {
+
+	defer recoverer.RecoverGoroutinePanic("lock watchdog "+l.Key, nil, nil)
+	defer close(l.done)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+			l.mu.Lock()
+			ok, err := l.mutex.ExtendContext(context.Background())
+			if !ok || err != nil {
+				if err == nil {
+					err = errors.New("lock is no longer held")
+				}
+				l.err = fmt.Errorf("failed to extend lock: %s", err.Error())
+				l.mu.Unlock()
+				logging.Errorf("[%s] %s", l.Key, l.err.Error())
+				close(l.lost)
+				return
+			}
+			l.mu.Unlock()
+			logging.Debugf("[%s] Lock extended", l.Key)
+		}
+	}
+}
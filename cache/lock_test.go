@@ -0,0 +1,116 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLockContext(t *testing.T) {
+
+	ctx := context.Background()
+	cache, mem := NewMemory()
+	opts := LockOptions{TTL: time.Minute, Tries: 3, RetryDelay: time.Millisecond}
+
+	first, err := cache.LockContext(ctx, "etl", opts)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), first.Token)
+
+	_, err = cache.LockContext(ctx, "etl", opts)
+	assert.True(t, errors.Is(err, ErrLockNotAcquired))
+
+	timeout, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	_, err = cache.LockContext(timeout, "etl", LockOptions{TTL: time.Minute, RetryDelay: 5 * time.Millisecond})
+	assert.True(t, errors.Is(err, ErrLockNotAcquired))
+
+	require.NoError(t, first.Unlock())
+
+	second, err := cache.LockContext(ctx, "etl", opts)
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), second.Token)
+
+	// Once expired, the lock can be taken over and the previous holder fails to release it
+	mem.Advance(time.Minute)
+	third, err := cache.LockContext(ctx, "etl", opts)
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), third.Token)
+	assert.Error(t, second.Unlock())
+	assert.NoError(t, third.Unlock())
+}
+
+func TestLockAutoExtend(t *testing.T) {
+
+	ctx := context.Background()
+	cache, mem := NewMemory()
+
+	lock, err := cache.LockContext(ctx, "etl", LockOptions{TTL: 30 * time.Millisecond, Tries: 1, AutoExtend: true})
+	require.NoError(t, err)
+
+	// The watchdog keeps the lock alive well past its TTL
+	time.Sleep(100 * time.Millisecond)
+	_, err = cache.LockContext(ctx, "etl", LockOptions{Tries: 1})
+	assert.True(t, errors.Is(err, ErrLockNotAcquired))
+
+	// Expiring it behind the watchdog's back is reported as lost
+	mem.Advance(time.Minute)
+	select {
+	case <-lock.Lost():
+		assert.Error(t, lock.Err())
+	case <-time.After(time.Second):
+		t.Fatal("lock loss was not reported")
+	}
+	assert.Error(t, lock.Unlock())
+}
+
+func TestFencingTokens(t *testing.T) {
+
+	ctx := context.Background()
+	cache, mem := NewMemory()
+	opts := LockOptions{TTL: time.Minute, Tries: 1}
+
+	for i := 1; i <= 3; i++ {
+		lock, err := cache.LockContext(ctx, "etl", opts)
+		require.NoError(t, err)
+		assert.Equal(t, int64(i), lock.Token)
+		require.NoError(t, lock.Unlock())
+
+		// Every acquisition keeps the counter for another fenceTTL
+		mem.Advance(fenceTTL - time.Hour)
+	}
+
+	mem.Advance(time.Hour)
+	assert.Equal(t, 0, mem.Len())
+
+	lock, err := cache.LockContext(ctx, "etl", opts)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), lock.Token)
+}
+
+func TestLockLost(t *testing.T) {
+
+	ctx := context.Background()
+	cache, mem := NewMemory()
+
+	lock, err := cache.LockContext(ctx, "etl", LockOptions{TTL: 300 * time.Millisecond, Tries: 1, AutoExtend: true})
+	require.NoError(t, err)
+
+	// The lock expires before the watchdog extends it and is taken over
+	mem.Advance(time.Second)
+	other, err := cache.LockContext(ctx, "etl", LockOptions{TTL: time.Minute, Tries: 1})
+	require.NoError(t, err)
+	assert.Greater(t, other.Token, lock.Token)
+
+	select {
+	case <-lock.Lost():
+	case <-time.After(time.Second):
+		t.Fatal("lost lock not detected")
+	}
+	assert.Error(t, lock.Err())
+	assert.Error(t, lock.Unlock())
+	assert.NoError(t, other.Unlock())
+}
@@ -0,0 +1,336 @@
+package cache
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Memory is an in-process Backend meant for unit tests.  It mirrors the Redis semantics relied upon by the cache
+// package, including entry expiry and lock contention, against a clock that can be moved forward with Advance.
+type Memory struct {
+	mu      sync.Mutex
+	offset  time.Duration
+	entries map[string]*memoryEntry
+}
+
+type memoryEntry struct {
+	fields  map[string]string
+	counter int64
+	lock    string // Owner of the lock held on the key, in which case the entry has no fields
+	expires time.Time
+}
+
+// hash reports whether the entry holds fields, as opposed to a lock or a counter
+func (e *memoryEntry) hash() bool {
+	return e.fields != nil
+}
+
+// NewMemory returns a cache Context backed by a new in-memory backend, which is also returned so that tests can
+// control its clock
+func NewMemory() (*Context, *Memory) {
+	m := &Memory{entries: make(map[string]*memoryEntry)}
+	return NewWithBackend(m), m
+}
+
+// Advance moves the backend clock forward, expiring entries and locks whose time to live has elapsed
+func (m *Memory) Advance(d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.offset += d
+}
+
+// Len returns the number of live entries, including locks and counters
+func (m *Memory) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	n := 0
+	for key := range m.entries {
+		if m.entry(key) != nil {
+			n++
+		}
+	}
+	return n
+}
+
+func (m *Memory) Now() time.Time {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.now()
+}
+
+func (m *Memory) now() time.Time {
+	return time.Now().Add(m.offset)
+}
+
+// entry returns the live entry for key, dropping it if it has expired.  The caller must hold m.mu.
+func (m *Memory) entry(key string) *memoryEntry {
+	e, ok := m.entries[key]
+	if !ok {
+		return nil
+	}
+	if !e.expires.IsZero() && !m.now().Before(e.expires) {
+		delete(m.entries, key)
+		return nil
+	}
+	return e
+}
+
+func (m *Memory) HGet(ctx context.Context, key, field string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	e := m.entry(key)
+	if e == nil {
+		return "", ErrNotFound
+	}
+	if !e.hash() {
+		return "", errWrongType
+	}
+	v, ok := e.fields[field]
+	if !ok {
+		return "", ErrNotFound
+	}
+	return v, nil
+}
+
+func (m *Memory) HMGet(ctx context.Context, key string, fields ...string) (map[string]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	ret := make(map[string]string)
+	if e := m.entry(key); e != nil {
+		if !e.hash() {
+			return nil, errWrongType
+		}
+		for _, f := range fields {
+			if v, ok := e.fields[f]; ok {
+				ret[f] = v
+			}
+		}
+	}
+	return ret, nil
+}
+
+func (m *Memory) HGetAll(ctx context.Context, key string) (map[string]string, time.Duration, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	e := m.entry(key)
+	if e == nil {
+		return map[string]string{}, -2, nil
+	}
+	if !e.hash() {
+		return nil, 0, errWrongType
+	}
+
+	ret := make(map[string]string, len(e.fields))
+	for k, v := range e.fields {
+		ret[k] = v
+	}
+
+	if e.expires.IsZero() {
+		return ret, -1, nil
+	}
+	return ret, e.expires.Sub(m.now()), nil
+}
+
+func (m *Memory) HSet(ctx context.Context, key string, fields map[string]string, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	e := m.entry(key)
+	if e == nil {
+		e = &memoryEntry{fields: make(map[string]string)}
+		m.entries[key] = e
+	}
+	if !e.hash() {
+		return errWrongType
+	}
+	for k, v := range fields {
+		e.fields[k] = v
+	}
+	if ttl > 0 {
+		e.expires = m.now().Add(ttl)
+	}
+	return nil
+}
+
+func (m *Memory) Replace(ctx context.Context, key string, fields map[string]string, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	e := &memoryEntry{fields: make(map[string]string, len(fields))}
+	for k, v := range fields {
+		e.fields[k] = v
+	}
+	if ttl > 0 {
+		e.expires = m.now().Add(ttl)
+	}
+	m.entries[key] = e
+	return nil
+}
+
+func (m *Memory) HGetMany(ctx context.Context, keys []string, field string) (map[string]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	ret := make(map[string]string)
+	for _, key := range keys {
+		if e := m.entry(key); e != nil {
+			if !e.hash() {
+				return nil, errWrongType
+			}
+			if v, ok := e.fields[field]; ok {
+				ret[key] = v
+			}
+		}
+	}
+	return ret, nil
+}
+
+func (m *Memory) HSetMany(ctx context.Context, entries map[string]map[string]string, ttl time.Duration) error {
+	for key, fields := range entries {
+		if err := m.HSet(ctx, key, fields, ttl); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *Memory) Del(ctx context.Context, keys ...string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, key := range keys {
+		delete(m.entries, key)
+	}
+	return nil
+}
+
+func (m *Memory) Exists(ctx context.Context, key string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.entry(key) != nil, nil
+}
+
+func (m *Memory) ScanPrefix(ctx context.Context, prefix string, fn func(keys []string) error) error {
+
+	m.mu.Lock()
+	var keys []string
+	for key := range m.entries {
+		if strings.HasPrefix(key, prefix) && m.entry(key) != nil {
+			keys = append(keys, key)
+		}
+	}
+	m.mu.Unlock()
+
+	if len(keys) == 0 {
+		return nil
+	}
+	return fn(keys)
+}
+
+func (m *Memory) Incr(ctx context.Context, key string, ttl time.Duration) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	e := m.entry(key)
+	if e == nil {
+		e = &memoryEntry{}
+		m.entries[key] = e
+	}
+	if e.hash() {
+		return 0, errWrongType
+	}
+	if e.lock != "" {
+		return 0, errors.New("value is not an integer or out of range")
+	}
+	e.counter++
+	if ttl > 0 {
+		e.expires = m.now().Add(ttl)
+	}
+	return e.counter, nil
+}
+
+func (m *Memory) NewMutex(name string, opts MutexOptions) Mutex {
+	return &memoryMutex{m: m, name: name, opts: opts}
+}
+
+// memoryMutex is a lock stored as a plain value holding a random owner, like RedSync does in Redis
+type memoryMutex struct {
+	m     *Memory
+	name  string
+	opts  MutexOptions
+	value string
+	until time.Time
+}
+
+func (l *memoryMutex) LockContext(ctx context.Context) error {
+
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+	value := hex.EncodeToString(b)
+
+	for i := 0; i < l.opts.Tries; i++ {
+		if i != 0 {
+			select {
+			case <-ctx.Done():
+				return ErrLockNotAcquired
+			case <-time.After(l.opts.RetryDelay(i)):
+			}
+		}
+
+		l.m.mu.Lock()
+		if l.m.entry(l.name) == nil {
+			l.until = l.m.now().Add(l.opts.Expiry)
+			l.m.entries[l.name] = &memoryEntry{lock: value, expires: l.until}
+			l.value = value
+			l.m.mu.Unlock()
+			return nil
+		}
+		l.m.mu.Unlock()
+	}
+
+	return ErrLockNotAcquired
+}
+
+// held reports whether the lock is still owned by l.  The caller must hold l.m.mu.
+func (l *memoryMutex) held() bool {
+	e := l.m.entry(l.name)
+	return e != nil && e.lock == l.value
+}
+
+func (l *memoryMutex) ExtendContext(ctx context.Context) (bool, error) {
+	l.m.mu.Lock()
+	defer l.m.mu.Unlock()
+
+	if !l.held() {
+		return false, nil
+	}
+	l.until = l.m.now().Add(l.opts.Expiry)
+	l.m.entries[l.name].expires = l.until
+	return true, nil
+}
+
+func (l *memoryMutex) UnlockContext(ctx context.Context) (bool, error) {
+	l.m.mu.Lock()
+	defer l.m.mu.Unlock()
+
+	if !l.held() {
+		return false, nil
+	}
+	delete(l.m.entries, l.name)
+	return true, nil
+}
+
+func (l *memoryMutex) Until() time.Time {
+	return l.until
+}
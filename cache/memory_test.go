@@ -0,0 +1,273 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemorySaveGet(t *testing.T) {
+
+	cache, mem := NewMemory()
+	ctx := context.Background()
+
+	_, err := cache.Get(ctx, "missing", false)
+	assert.Equal(t, ErrNotFound, err)
+
+	require.NoError(t, cache.Save(ctx, "forever", map[string]string{"a": "b"}))
+	require.NoError(t, cache.SaveWithTTL(ctx, "short", "value", time.Minute))
+
+	ret, err := cache.Get(ctx, "forever", false)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"a":"b"}`, ret)
+
+	ret, err = cache.Get(ctx, "short", false)
+	assert.NoError(t, err)
+	assert.Equal(t, `"value"`, ret)
+
+	mem.Advance(time.Minute)
+
+	_, err = cache.Get(ctx, "short", false)
+	assert.Equal(t, ErrNotFound, err)
+	_, err = cache.Get(ctx, "forever", false)
+	assert.NoError(t, err)
+
+	require.NoError(t, cache.Clear(ctx, "forever"))
+	_, err = cache.Get(ctx, "forever", false)
+	assert.Equal(t, ErrNotFound, err)
+}
+
+func TestTyped(t *testing.T) {
+
+	type product struct {
+		ID   string
+		Name string
+	}
+
+	cache, mem := NewMemory()
+	ctx := context.Background()
+
+	for _, codec := range []Codec{JSON, Gob, MsgPack} {
+		products := NewTyped[product](cache, "billing")
+		products.Codec = codec
+		products.TTL = time.Hour
+
+		require.NoError(t, products.Set(ctx, "prod_1", product{ID: "prod_1", Name: "Premium"}, 0))
+		require.NoError(t, products.Set(ctx, "prod_2", product{ID: "prod_2", Name: "Basic"}, time.Minute))
+
+		p, err := products.Get(ctx, "prod_1")
+		assert.NoError(t, err)
+		assert.Equal(t, "Premium", p.Name)
+
+		mem.Advance(time.Minute)
+		_, err = products.Get(ctx, "prod_2")
+		assert.Equal(t, ErrNotFound, err)
+
+		require.NoError(t, products.Delete(ctx, "prod_1"))
+		_, err = products.Get(ctx, "prod_1")
+		assert.Equal(t, ErrNotFound, err)
+	}
+}
+
+func TestGetOrLoad(t *testing.T) {
+
+	ctx := context.Background()
+
+	t.Run("coalesces concurrent misses", func(t *testing.T) {
+		cache, _ := NewMemory()
+		osps := NewTyped[string](cache, "osp")
+
+		var calls int32
+		loader := func(context.Context) (string, error) {
+			atomic.AddInt32(&calls, 1)
+			time.Sleep(50 * time.Millisecond)
+			return "xero", nil
+		}
+
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				v, err := osps.GetOrLoad(ctx, "xero", time.Minute, loader)
+				assert.NoError(t, err)
+				assert.Equal(t, "xero", v)
+			}()
+		}
+		wg.Wait()
+
+		assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+
+		v, err := osps.Get(ctx, "xero")
+		assert.NoError(t, err)
+		assert.Equal(t, "xero", v)
+	})
+
+	t.Run("keeps loading when the first caller gives up", func(t *testing.T) {
+		cache, _ := NewMemory()
+		osps := NewTyped[string](cache, "osp")
+		osps.Distributed = true
+
+		release := make(chan struct{})
+		loader := func(ctx context.Context) (string, error) {
+			<-release
+			return "xero", ctx.Err()
+		}
+
+		first, cancel := context.WithCancel(ctx)
+		started := make(chan error)
+		go func() {
+			_, err := osps.GetOrLoad(first, "xero", time.Minute, loader)
+			started <- err
+		}()
+
+		time.Sleep(50 * time.Millisecond)
+		waiting := make(chan string)
+		go func() {
+			v, _ := osps.GetOrLoad(ctx, "xero", time.Minute, loader)
+			waiting <- v
+		}()
+
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+		assert.ErrorIs(t, <-started, context.Canceled)
+
+		close(release)
+		assert.Equal(t, "xero", <-waiting)
+	})
+
+	t.Run("caches not found results", func(t *testing.T) {
+		cache, mem := NewMemory()
+		osps := NewTyped[string](cache, "osp")
+		osps.NegativeTTL = time.Minute
+
+		var calls int32
+		loader := func(context.Context) (string, error) {
+			atomic.AddInt32(&calls, 1)
+			return "", ErrNotFound
+		}
+
+		for i := 0; i < 3; i++ {
+			_, err := osps.GetOrLoad(ctx, "unknown", time.Hour, loader)
+			assert.Equal(t, ErrNotFound, err)
+		}
+		assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+
+		mem.Advance(time.Minute)
+		osps.GetOrLoad(ctx, "unknown", time.Hour, loader)
+		assert.Equal(t, int32(2), atomic.LoadInt32(&calls))
+	})
+
+	t.Run("does not cache loader errors", func(t *testing.T) {
+		cache, _ := NewMemory()
+		osps := NewTyped[string](cache, "osp")
+
+		_, err := osps.GetOrLoad(ctx, "broken", time.Hour, func(context.Context) (string, error) {
+			return "", errors.New("token service unavailable")
+		})
+		assert.EqualError(t, err, "token service unavailable")
+
+		_, err = osps.Get(ctx, "broken")
+		assert.Equal(t, ErrNotFound, err)
+	})
+
+	t.Run("serves stale entries while refreshing", func(t *testing.T) {
+		cache, mem := NewMemory()
+		osps := NewTyped[string](cache, "osp")
+		osps.Stale = time.Minute
+
+		var version int32
+		refreshed := make(chan struct{}, 1)
+		loader := func(context.Context) (string, error) {
+			if atomic.AddInt32(&version, 1) > 1 {
+				defer func() { refreshed <- struct{}{} }()
+				return "v2", nil
+			}
+			return "v1", nil
+		}
+
+		v, _ := osps.GetOrLoad(ctx, "xero", time.Minute, loader)
+		assert.Equal(t, "v1", v)
+
+		mem.Advance(90 * time.Second)
+		v, err := osps.GetOrLoad(ctx, "xero", time.Minute, loader)
+		assert.NoError(t, err)
+		assert.Equal(t, "v1", v)
+
+		select {
+		case <-refreshed:
+		case <-time.After(time.Second):
+			t.Fatal("stale entry was not refreshed")
+		}
+
+		// Wait for the refreshed entry to be written after the loader returned
+		assert.Eventually(t, func() bool {
+			v, _ := osps.Get(ctx, "xero")
+			return v == "v2"
+		}, time.Second, 10*time.Millisecond)
+	})
+}
+
+func TestGetWhileLocked(t *testing.T) {
+
+	ctx := context.Background()
+	cache, _ := NewMemory()
+	cache.MaxRetries = 1
+
+	require.NoError(t, cache.Save(ctx, "etl", "value"))
+	lock, err := cache.LockContext(ctx, "etl", LockOptions{TTL: time.Minute, Tries: 1})
+	require.NoError(t, err)
+
+	// The entry can still be read without waiting for the lock, which is held alongside it
+	ret, err := cache.Get(ctx, "etl", false)
+	assert.NoError(t, err)
+	assert.Equal(t, `"value"`, ret)
+
+	// Waiting for the lock gives up after MaxRetries, and must not remove it
+	start := time.Now()
+	ret, err = cache.Get(ctx, "etl", true)
+	assert.NoError(t, err)
+	assert.Equal(t, `"value"`, ret)
+	assert.GreaterOrEqual(t, time.Since(start), Wait*time.Second)
+	assert.NoError(t, lock.Unlock())
+
+	ret, err = cache.Get(ctx, "etl", true)
+	assert.NoError(t, err)
+	assert.Equal(t, `"value"`, ret)
+}
+
+func TestMemoryWrongType(t *testing.T) {
+
+	ctx := context.Background()
+	_, mem := NewMemory()
+
+	lock := mem.NewMutex("locked", MutexOptions{Expiry: time.Minute, Tries: 1})
+	require.NoError(t, lock.LockContext(ctx))
+	require.NoError(t, mem.HSet(ctx, "entry", map[string]string{"data": "1"}, 0))
+	_, err := mem.Incr(ctx, "counter", 0)
+	require.NoError(t, err)
+
+	// Keys holding a lock or a counter are not entries, as in Redis
+	for _, key := range []string{"locked", "counter"} {
+		_, err = mem.HGet(ctx, key, "data")
+		assert.Equal(t, errWrongType, err, key)
+		_, err = mem.HMGet(ctx, key, "data")
+		assert.Equal(t, errWrongType, err, key)
+		_, _, err = mem.HGetAll(ctx, key)
+		assert.Equal(t, errWrongType, err, key)
+		_, err = mem.HGetMany(ctx, []string{"entry", key}, "data")
+		assert.Equal(t, errWrongType, err, key)
+		assert.Equal(t, errWrongType, mem.HSet(ctx, key, map[string]string{"data": "1"}, 0), key)
+	}
+
+	_, err = mem.Incr(ctx, "entry", 0)
+	assert.Equal(t, errWrongType, err)
+	_, err = mem.Incr(ctx, "locked", 0)
+	assert.EqualError(t, err, "value is not an integer or out of range")
+}
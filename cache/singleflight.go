@@ -0,0 +1,69 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/9spokes/go/logging/v3"
+)
+
+// call is an in-flight or completed group.do call
+type call struct {
+	done  chan struct{}
+	val   interface{}
+	err   error
+	panic interface{}
+}
+
+// group coalesces concurrent calls sharing the same key so that only one of them executes at a time, the others
+// waiting for and sharing its result.  The zero value is ready to use.
+type group struct {
+	mu    sync.Mutex
+	calls map[string]*call
+}
+
+// do executes fn unless a call with the same key is in flight, and waits for the result of the call until ctx is
+// done.  fn runs in its own goroutine so that it completes and its result is shared even if the caller that started
+// it gives up waiting.  If fn panics, the waiting callers get an error and the panic is propagated to the caller that
+// started it, if it is still waiting.
+func (g *group) do(ctx context.Context, key string, fn func() (interface{}, error)) (interface{}, error) {
+
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*call)
+	}
+	c, inFlight := g.calls[key]
+	if !inFlight {
+		c = &call{done: make(chan struct{})}
+		g.calls[key] = c
+		go g.run(key, c, fn)
+	}
+	g.mu.Unlock()
+
+	select {
+	case <-c.done:
+		if !inFlight && c.panic != nil {
+			panic(c.panic)
+		}
+		return c.val, c.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (g *group) run(key string, c *call, fn func() (interface{}, error)) {
+
+	defer func() {
+		if r := recover(); r != nil {
+			logging.Errorf("[%s] Loader panicked: %v", key, r)
+			c.val, c.err, c.panic = nil, fmt.Errorf("loader panicked: %v", r), r
+		}
+		g.mu.Lock()
+		delete(g.calls, key)
+		g.mu.Unlock()
+		close(c.done)
+	}()
+
+	c.val, c.err = fn()
+}
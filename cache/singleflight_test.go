@@ -0,0 +1,114 @@
+package cache
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGroup(t *testing.T) {
+
+	var g group
+	var calls int32
+	release := make(chan struct{})
+
+	var wg sync.WaitGroup
+	results := make([]interface{}, 10)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], _ = g.do(context.Background(), "key", func() (interface{}, error) {
+				atomic.AddInt32(&calls, 1)
+				<-release
+				return "value", nil
+			})
+		}(i)
+	}
+
+	// Give the goroutines time to pile up behind the first call
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+	for _, r := range results {
+		assert.Equal(t, "value", r)
+	}
+
+	// Once completed, a new call executes again
+	g.do(context.Background(), "key", func() (interface{}, error) {
+		atomic.AddInt32(&calls, 1)
+		return nil, nil
+	})
+	assert.Equal(t, int32(2), atomic.LoadInt32(&calls))
+}
+
+func TestGroupPanic(t *testing.T) {
+
+	var g group
+	release := make(chan struct{})
+
+	go func() {
+		defer func() { recover() }()
+		g.do(context.Background(), "key", func() (interface{}, error) {
+			<-release
+			panic("boom")
+		})
+	}()
+
+	// Wait behind the panicking call
+	time.Sleep(50 * time.Millisecond)
+	done := make(chan error)
+	go func() {
+		_, err := g.do(context.Background(), "key", func() (interface{}, error) { return "value", nil })
+		done <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+
+	err := <-done
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "boom")
+	}
+
+	assert.PanicsWithValue(t, "boom", func() {
+		g.do(context.Background(), "key", func() (interface{}, error) { panic("boom") })
+	})
+}
+
+func TestGroupCancel(t *testing.T) {
+
+	var g group
+	release := make(chan struct{})
+
+	// The caller that started the load gives up waiting
+	ctx, cancel := context.WithCancel(context.Background())
+	started := make(chan error)
+	go func() {
+		_, err := g.do(ctx, "key", func() (interface{}, error) {
+			<-release
+			return "value", nil
+		})
+		started <- err
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	done := make(chan interface{})
+	go func() {
+		v, _ := g.do(context.Background(), "key", func() (interface{}, error) { return "other", nil })
+		done <- v
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	assert.ErrorIs(t, <-started, context.Canceled)
+
+	// The load carries on for the other callers
+	close(release)
+	assert.Equal(t, "value", <-done)
+}
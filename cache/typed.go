@@ -0,0 +1,85 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/9spokes/go/logging/v3"
+)
+
+// Typed is a typed view over a cache Context.  Entries are serialised with the configured Codec and stored under
+// keys prefixed with the service namespace, so that several services can safely share a Redis instance.
+type Typed[T any] struct {
+	Cache     *Context
+	Namespace string        // Prefix applied to every key, eg: "token" stores "id" under "token:id"
+	Codec     Codec         // Defaults to JSON
+	TTL       time.Duration // Default expiry applied by Set when no TTL is given, zero means entries never expire
+
+	// The following only apply to entries loaded through GetOrLoad
+	Stale       time.Duration // How long an expired entry may still be served while it is refreshed in the background
+	NegativeTTL time.Duration // How long a not-found result from a loader is cached, zero disables negative caching
+	Distributed bool          // Whether to coalesce loads across instances with a RedSync lock
+	LoadTimeout time.Duration // Bound on a loader call, defaults to DefaultLoadTimeout
+
+	group group
+}
+
+// NewTyped returns a typed cache for values of type T stored under the given namespace using the JSON codec
+func NewTyped[T any](ctx *Context, namespace string) *Typed[T] {
+	return &Typed[T]{Cache: ctx, Namespace: namespace, Codec: JSON}
+}
+
+// Key returns the fully-qualified Redis key for an entry
+func (t *Typed[T]) Key(key string) string {
+	if t.Namespace == "" {
+		return key
+	}
+	return t.Namespace + ":" + key
+}
+
+// Get retrieves and deserialises an entry.  ErrNotFound is returned if the entry does not exist or has expired.
+func (t *Typed[T]) Get(ctx context.Context, key string) (T, error) {
+
+	var ret T
+
+	data, err := t.Cache.getRaw(ctx, t.Key(key))
+	if err != nil {
+		return ret, err
+	}
+
+	if err := t.codec().Unmarshal(data, &ret); err != nil {
+		logging.Errorf("[%s] failed to deserialise data: %s", t.Key(key), err.Error())
+		return ret, fmt.Errorf("failed to deserialise data: %s", err.Error())
+	}
+
+	return ret, nil
+}
+
+// Set serialises and stores an entry.  The entry expires after ttl, or after the default TTL if ttl is zero.
+func (t *Typed[T]) Set(ctx context.Context, key string, value T, ttl time.Duration) error {
+
+	data, err := t.codec().Marshal(value)
+	if err != nil {
+		logging.Errorf("[%s] failed to serialise data: %s", t.Key(key), err.Error())
+		return fmt.Errorf("failed to serialise data: %s", err.Error())
+	}
+
+	if ttl == 0 {
+		ttl = t.TTL
+	}
+
+	return t.Cache.setRaw(ctx, t.Key(key), data, ttl)
+}
+
+// Delete removes an entry
+func (t *Typed[T]) Delete(ctx context.Context, key string) error {
+	return t.Cache.Clear(ctx, t.Key(key))
+}
+
+func (t *Typed[T]) codec() Codec {
+	if t.Codec == nil {
+		return JSON
+	}
+	return t.Codec
+}
@@ -0,0 +1,203 @@
+package crypto
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/mergermarket/go-pkcs7"
+	"golang.org/x/crypto/hkdf"
+)
+
+// authenticatedCallbackPrefix marks the payloads produced by GenerateAuthenticatedCallbackURL, which cannot clash
+// with the base64 output of GenerateCallbackURL
+const authenticatedCallbackPrefix = "v2."
+
+// callbackAD binds authenticated callback payloads to their purpose
+var callbackAD = []byte("9spokes callback v2")
+
+// callbackKeyInfo labels the key derived from the callback secret for authenticated payloads, so that it differs
+// from the AES-CBC key of GenerateCallbackURL
+var callbackKeyInfo = []byte("9spokes callback v2 key")
+
+// callbackClockSkew is how far in the future a callback timestamp may be, to allow for clock differences
+const callbackClockSkew = time.Minute
+
+var (
+	// ErrCallbackExpired is returned when parsing a callback payload older than the maximum age
+	ErrCallbackExpired = errors.New("callback URL expired")
+	// ErrCallbackNotAuthenticated is returned when parsing a callback payload which is not authenticated where one
+	// is required
+	ErrCallbackNotAuthenticated = errors.New("callback URL is not authenticated")
+)
+
+type callbackPayload struct {
+	URL       string `json:"url"`
+	Timestamp int64  `json:"timestamp,omitempty"`
+	Callback  string `json:"callback"`
+}
+
+func newCallbackPayload(url, callback string, timeout bool) callbackPayload {
+
+	body := callbackPayload{
+		URL:      url,
+		Callback: callback,
+	}
+
+	if timeout {
+		body.Timestamp = time.Now().UnixNano() / 1e6
+	}
+
+	return body
+}
+
+// GenerateAuthenticatedCallbackURL is the authenticated counterpart of GenerateCallbackURL: the payload is sealed in
+// an envelope (see EncryptWithOptions) so that it cannot be tampered with, and prefixed with "v2." for the callback
+// handler to tell both formats apart.  The key is derived from the base64-encoded 32-byte secret with HKDF, so that
+// the same secret can be shared with GenerateCallbackURL during the migration without reusing its key.
+func GenerateAuthenticatedCallbackURL(url, callback, secret string, timeout bool) (string, error) {
+
+	plaintext, err := json.Marshal(newCallbackPayload(url, callback, timeout))
+	if err != nil {
+		return "", err
+	}
+
+	key, err := callbackKey(secret)
+	if err != nil {
+		return "", err
+	}
+
+	sealed, err := EncryptWithOptions(plaintext, key, Options{KDF: KDF{Kind: KDFNone}, AssociatedData: callbackAD})
+	if err != nil {
+		return "", err
+	}
+
+	return authenticatedCallbackPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// ParseCallbackURL decrypts a payload produced by GenerateCallbackURL or GenerateAuthenticatedCallbackURL and returns
+// the URL and callback it carries.  If maxAge is positive, the payload must carry a timestamp no older than maxAge.
+// The iv is only used for payloads produced by GenerateCallbackURL.
+//
+// Payloads produced by GenerateCallbackURL are encrypted with AES-CBC but not authenticated, so they can be altered
+// without knowing the secret.  ParseCallbackURL only exists for the time it takes generators to move to
+// GenerateAuthenticatedCallbackURL, after which the callback handler must call ParseAuthenticatedCallbackURL instead.
+func ParseCallbackURL(payload, secret, iv string, maxAge time.Duration) (url, callback string, err error) {
+
+	if strings.HasPrefix(payload, authenticatedCallbackPrefix) {
+		return ParseAuthenticatedCallbackURL(payload, secret, maxAge)
+	}
+
+	ciphertext, err := base64.StdEncoding.DecodeString(payload)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid callback payload: %s", err.Error())
+	}
+	if len(ciphertext) == 0 || len(ciphertext)%aes.BlockSize != 0 {
+		return "", "", fmt.Errorf("invalid callback payload: wrong block size")
+	}
+
+	key, err := base64.StdEncoding.DecodeString(secret)
+	if err != nil {
+		return "", "", err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return "", "", err
+	}
+
+	ivBytes, err := base64.StdEncoding.DecodeString(iv)
+	if err != nil || len(ivBytes) != aes.BlockSize {
+		return "", "", fmt.Errorf("invalid IV")
+	}
+
+	plaintext := make([]byte, len(ciphertext))
+	cipher.NewCBCDecrypter(block, ivBytes).CryptBlocks(plaintext, ciphertext)
+
+	if plaintext, err = pkcs7.Unpad(plaintext, aes.BlockSize); err != nil {
+		return "", "", fmt.Errorf("invalid callback payload: %s", err.Error())
+	}
+
+	return parseCallbackPayload(plaintext, maxAge)
+}
+
+// ParseAuthenticatedCallbackURL decrypts and authenticates a payload produced by GenerateAuthenticatedCallbackURL and
+// returns the URL and callback it carries, see ParseCallbackURL.  Unauthenticated payloads are rejected with
+// ErrCallbackNotAuthenticated.
+func ParseAuthenticatedCallbackURL(payload, secret string, maxAge time.Duration) (url, callback string, err error) {
+
+	if !strings.HasPrefix(payload, authenticatedCallbackPrefix) {
+		return "", "", ErrCallbackNotAuthenticated
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(payload, authenticatedCallbackPrefix))
+	if err != nil {
+		return "", "", fmt.Errorf("invalid callback payload: %s", err.Error())
+	}
+
+	// The key is never derived, so that forged payloads cannot make the handler run a costly key derivation
+	h, err := ParseHeader(sealed)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid callback payload: %w", err)
+	}
+	if h.KDF.Kind != KDFNone {
+		return "", "", fmt.Errorf("invalid callback payload: %w", ErrInvalidEnvelope)
+	}
+
+	key, err := callbackKey(secret)
+	if err != nil {
+		return "", "", err
+	}
+
+	plaintext, err := DecryptWithOptions(sealed, key, Options{AssociatedData: callbackAD})
+	if err != nil {
+		return "", "", err
+	}
+
+	return parseCallbackPayload(plaintext, maxAge)
+}
+
+// callbackKey derives the key of authenticated callback payloads from the base64-encoded callback secret
+func callbackKey(secret string) ([]byte, error) {
+
+	ikm, err := base64.StdEncoding.DecodeString(secret)
+	if err != nil {
+		return nil, err
+	}
+	if len(ikm) != keySize {
+		return nil, fmt.Errorf("callback secret must be %d bytes long", keySize)
+	}
+
+	key := make([]byte, keySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, ikm, nil, callbackKeyInfo), key); err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+func parseCallbackPayload(plaintext []byte, maxAge time.Duration) (string, string, error) {
+
+	var body callbackPayload
+	if err := json.Unmarshal(plaintext, &body); err != nil {
+		return "", "", fmt.Errorf("invalid callback payload: %s", err.Error())
+	}
+
+	if maxAge > 0 {
+		if body.Timestamp == 0 {
+			return "", "", fmt.Errorf("%w: no timestamp", ErrCallbackExpired)
+		}
+		issued := time.UnixMilli(body.Timestamp)
+		if time.Since(issued) > maxAge || time.Until(issued) > callbackClockSkew {
+			return "", "", fmt.Errorf("%w: issued at %s", ErrCallbackExpired, issued.UTC().Format(time.RFC3339))
+		}
+	}
+
+	return body.URL, body.Callback, nil
+}
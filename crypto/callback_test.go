@@ -0,0 +1,58 @@
+package crypto
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseCallbackURL(t *testing.T) {
+
+	secret := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte("s"), 32))
+	iv := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte("i"), 16))
+
+	payload, err := GenerateCallbackURL("https://app.example.com", "https://api.example.com/callback", secret, iv, true)
+	assert.Nil(t, err)
+
+	url, callback, err := ParseCallbackURL(payload, secret, iv, time.Minute)
+	assert.Nil(t, err)
+	assert.Equal(t, "https://app.example.com", url)
+	assert.Equal(t, "https://api.example.com/callback", callback)
+
+	_, _, err = ParseAuthenticatedCallbackURL(payload, secret, time.Minute)
+	assert.ErrorIs(t, err, ErrCallbackNotAuthenticated)
+
+	payload, err = GenerateCallbackURL("https://app.example.com", "https://api.example.com/callback", secret, iv, false)
+	assert.Nil(t, err)
+	_, _, err = ParseCallbackURL(payload, secret, iv, time.Minute)
+	assert.ErrorIs(t, err, ErrCallbackExpired)
+	_, _, err = ParseCallbackURL(payload, secret, iv, 0)
+	assert.Nil(t, err)
+
+	payload, err = GenerateAuthenticatedCallbackURL("https://app.example.com", "https://api.example.com/callback", secret, true)
+	assert.Nil(t, err)
+
+	url, callback, err = ParseCallbackURL(payload, secret, "", time.Minute)
+	assert.Nil(t, err)
+	assert.Equal(t, "https://app.example.com", url)
+	assert.Equal(t, "https://api.example.com/callback", callback)
+
+	// The payload is sealed with a key derived from the secret rather than with the AES-CBC key itself
+	sealed, _ := base64.StdEncoding.DecodeString(payload[3:])
+	_, err = DecryptWithOptions(sealed, bytes.Repeat([]byte("s"), 32), Options{AssociatedData: callbackAD})
+	assert.ErrorIs(t, err, ErrDecryptionFailed)
+
+	sealed[len(sealed)-1] ^= 1
+	_, _, err = ParseAuthenticatedCallbackURL("v2."+base64.StdEncoding.EncodeToString(sealed), secret, time.Minute)
+	assert.ErrorIs(t, err, ErrDecryptionFailed)
+
+	expired := newCallbackPayload("https://app.example.com", "https://api.example.com/callback", true)
+	expired.Timestamp = time.Now().Add(-2 * time.Minute).UnixMilli()
+	b, _ := json.Marshal(expired)
+	_, _, err = parseCallbackPayload(b, time.Minute)
+	assert.ErrorIs(t, err, ErrCallbackExpired)
+}
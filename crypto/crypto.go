@@ -1,7 +1,6 @@
 package crypto
 
 import (
-	"bytes"
 	"crypto"
 	"crypto/aes"
 	"crypto/cipher"
@@ -15,42 +14,57 @@ import (
 	"encoding/pem"
 	"errors"
 	"fmt"
-	"io"
 	"io/ioutil"
 	"net/url"
-	"time"
 
 	"github.com/mergermarket/go-pkcs7"
 	"golang.org/x/crypto/pbkdf2"
 )
 
-// Decrypt uses a PBKDF2 key encryption method with a AES-CBC 256 algorithm
+// Decrypt opens a ciphertext produced by Encrypt, see DecryptWithOptions.  Ciphertexts in the legacy AES-CBC format
+// are still accepted so that stored values can be re-encrypted lazily.
 func Decrypt(ciphertext []byte, secret []byte) (string, error) {
 
-	ciphertext = ciphertext[4:]
+	plaintext, err := DecryptWithOptions(ciphertext, secret, Options{AllowLegacy: true})
+	if err != nil {
+		return "", err
+	}
+
+	return string(plaintext), nil
+}
 
-	if len(ciphertext) < aes.BlockSize {
-		return "", errors.New("ciphertext too short")
+// Encrypt seals a string into an AES-256-GCM envelope with a key derived from the secret with DefaultKDF, see
+// EncryptWithOptions.  Passphrases must be encrypted with EncryptWithOptions and PassphraseKDF instead.
+func Encrypt(str string, secret []byte) ([]byte, error) {
+	return EncryptWithOptions([]byte(str), secret, Options{})
+}
+
+// decryptLegacy decrypts the format of earlier versions of Encrypt: 4 random bytes, an IV and the AES-256-CBC
+// ciphertext of the PKCS7-padded plaintext, with a key derived from the IV via PBKDF2.  It is unauthenticated.
+func decryptLegacy(ciphertext []byte, secret []byte) ([]byte, error) {
+
+	if len(ciphertext) < 4+2*aes.BlockSize {
+		return nil, errors.New("ciphertext too short")
 	}
 
-	iv := ciphertext[:aes.BlockSize]
-	ciphertext = ciphertext[aes.BlockSize:]
+	iv := ciphertext[4 : 4+aes.BlockSize]
+	ciphertext = append([]byte(nil), ciphertext[4+aes.BlockSize:]...)
 
 	if len(ciphertext)%aes.BlockSize != 0 {
-		return "", errors.New("ciphertext is not a multiple of the block size")
+		return nil, errors.New("ciphertext is not a multiple of the block size")
 	}
 
 	key := pbkdf2.Key(secret, iv, 2048, 32, sha256.New)
 
 	block, err := aes.NewCipher(key)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
 	mode := cipher.NewCBCDecrypter(block, iv)
 	mode.CryptBlocks(ciphertext, ciphertext)
 
-	unpadded, err := func(b []byte, blocksize int) ([]byte, error) {
+	return func(b []byte, blocksize int) ([]byte, error) {
 
 		if len(b)%blocksize != 0 {
 			return nil, errors.New("Invalid PKCS7 padding size")
@@ -67,44 +81,6 @@ func Decrypt(ciphertext []byte, secret []byte) (string, error) {
 		}
 		return b[:len(b)-n], nil
 	}(ciphertext, aes.BlockSize)
-
-	return string(unpadded), err
-
-}
-
-// Encrypt uses a PBKDF2 key encryption method with a AES-CBC 256 algorithm
-func Encrypt(str string, secret []byte) ([]byte, error) {
-
-	header := make([]byte, 4+aes.BlockSize)
-
-	if _, err := io.ReadFull(rand.Reader, header); err != nil {
-		return nil, err
-	}
-
-	iv := header[4:]
-
-	bytes := func(b []byte, blocksize int) []byte {
-		n := blocksize - (len(b) % blocksize)
-		pb := make([]byte, len(b)+n)
-		copy(pb, b)
-		copy(pb[len(b):], bytes.Repeat([]byte{byte(n)}, n))
-		return pb
-	}([]byte(str), aes.BlockSize)
-
-	key := pbkdf2.Key(secret, iv, 2048, 32, sha256.New)
-
-	block, err := aes.NewCipher(key)
-	if err != nil {
-		return nil, err
-	}
-
-	ciphertext := make([]byte, len(header)+len(bytes))
-	copy(ciphertext, header)
-
-	mode := cipher.NewCBCEncrypter(block, iv)
-	mode.CryptBlocks(ciphertext[len(header):], bytes)
-
-	return ciphertext, nil
 }
 
 // SignRSA creates the signature for oauth1 with rsa-sha1
@@ -140,25 +116,11 @@ func SignHMAC(message []byte, key string) (string, error) {
 }
 
 // GenerateCallbackURL is used to generate an encrypted URL where a user-agent can be directed.
-// It leverages the cb.9spokes.io/redirect callback handler which is used to decouple environments from callback URLs
+// It leverages the cb.9spokes.io/redirect callback handler which is used to decouple environments from callback URLs.
+// The payload is not authenticated, new code should use GenerateAuthenticatedCallbackURL (see ParseCallbackURL).
 func GenerateCallbackURL(url, callback, secret, iv string, timeout bool) (string, error) {
 
-	type payload struct {
-		URL       string `json:"url"`
-		Timestamp int64  `json:"timestamp,omitempty"`
-		Callback  string `json:"callback"`
-	}
-
-	body := payload{
-		URL:      url,
-		Callback: callback,
-	}
-
-	if timeout {
-		body.Timestamp = time.Now().UnixNano() / 1e6
-	}
-
-	unencrypted, err := json.Marshal(body)
+	unencrypted, err := json.Marshal(newCallbackPayload(url, callback, timeout))
 	if err != nil {
 		return "", err
 	}
@@ -0,0 +1,377 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// Envelope format (version 2):
+//
+//	magic "9SE" | version (1) | algorithm (1) | KDF (1) | KDF parameters | key ID length (1) | key ID | salt | nonce | ciphertext and tag
+//
+// The whole header, up to and including the nonce, is authenticated along with the caller's associated data.
+
+var envelopeMagic = []byte("9SE")
+
+const (
+	envelopeVersion = 2
+	saltSize        = 16
+	keySize         = 32
+
+	// Bounds on the KDF parameters read from an envelope, so that a forged header cannot exhaust resources
+	maxPBKDF2Iterations = 10000000
+	maxArgon2Passes     = 100
+	maxArgon2Memory     = 1 << 20 // 1 GiB
+)
+
+// Algorithm is the authenticated cipher of an envelope
+type Algorithm byte
+
+const (
+	// AES256GCM is AES-256 in Galois/Counter mode with a 96-bit random nonce
+	AES256GCM Algorithm = 1
+	// XChaCha20Poly1305 is XChaCha20-Poly1305 with a 192-bit random nonce
+	XChaCha20Poly1305 Algorithm = 2
+)
+
+// KDFKind identifies how the encryption key is derived from the secret
+type KDFKind byte
+
+const (
+	// KDFDefault selects DefaultKDF when encrypting, it never appears in an envelope
+	KDFDefault KDFKind = 0
+	// KDFNone uses the secret as the key, which must then be 32 bytes long
+	KDFNone KDFKind = 1
+	// KDFPBKDF2 derives the key from a passphrase with PBKDF2-SHA256 and a random salt
+	KDFPBKDF2 KDFKind = 2
+	// KDFArgon2id derives the key from a passphrase with Argon2id and a random salt
+	KDFArgon2id KDFKind = 3
+	// KDFHKDF derives the key from a high-entropy secret, such as 32 random bytes, with HKDF-SHA256 and a random
+	// salt.  It does not stretch the secret so it must not be used with passphrases.
+	KDFHKDF KDFKind = 4
+)
+
+// DefaultKDF is the key derivation used unless specified otherwise.  It is only suited to high-entropy secrets such
+// as the keys used for cache and field encryption, passphrases must be stretched with PassphraseKDF instead.
+var DefaultKDF = KDF{Kind: KDFHKDF}
+
+// PassphraseKDF is the key derivation to use when the secret is a passphrase.  These are the minimum Argon2id
+// parameters recommended by OWASP, costing about 19 MiB and a few tens of milliseconds per encryption or decryption.
+var PassphraseKDF = Argon2id(2, 19*1024, 1)
+
+// KDF configures the derivation of the encryption key from the secret.  The parameters are recorded in the
+// envelope so that they can be changed without breaking existing envelopes.
+type KDF struct {
+	Kind       KDFKind
+	Iterations uint32 // PBKDF2 iterations, or Argon2id passes
+	Memory     uint32 // Argon2id memory in KiB
+	Threads    uint8  // Argon2id parallelism
+}
+
+// PBKDF2 returns a PBKDF2-SHA256 key derivation with the given number of iterations
+func PBKDF2(iterations uint32) KDF {
+	return KDF{Kind: KDFPBKDF2, Iterations: iterations}
+}
+
+// Argon2id returns an Argon2id key derivation with the given number of passes, memory in KiB and parallelism
+func Argon2id(passes, memory uint32, threads uint8) KDF {
+	return KDF{Kind: KDFArgon2id, Iterations: passes, Memory: memory, Threads: threads}
+}
+
+// Options configures the envelope produced by EncryptWithOptions.  When decrypting, only AssociatedData is used, the
+// other settings being read from the envelope.
+type Options struct {
+	Algorithm      Algorithm // Defaults to AES256GCM
+	KDF            KDF       // Defaults to DefaultKDF, use PassphraseKDF for passphrases
+	KeyID          string    // Identifies the secret in the envelope header, at most 255 bytes
+	AssociatedData []byte    // Authenticated but not encrypted data the envelope is bound to, eg: a record ID
+	// Accept the unauthenticated AES-CBC ciphertexts of earlier versions of Encrypt when decrypting, only meant
+	// for reading values stored before the envelope format was introduced
+	AllowLegacy bool
+}
+
+// Header is the plaintext header of an envelope
+type Header struct {
+	Version   int
+	Algorithm Algorithm
+	KDF       KDF
+	KeyID     string
+	salt      []byte
+	nonce     []byte
+	size      int
+}
+
+var (
+	// ErrInvalidEnvelope is returned when a ciphertext is neither a valid envelope nor a legacy ciphertext
+	ErrInvalidEnvelope = errors.New("invalid ciphertext")
+	// ErrDecryptionFailed is returned when an envelope fails authentication, because of a wrong secret or associated
+	// data or tampering
+	ErrDecryptionFailed = errors.New("message authentication failed")
+)
+
+// EncryptWithOptions seals plaintext into a versioned, authenticated envelope
+func EncryptWithOptions(plaintext, secret []byte, opts Options) ([]byte, error) {
+
+	if opts.Algorithm == 0 {
+		opts.Algorithm = AES256GCM
+	}
+
+	if len(opts.KeyID) > 255 {
+		return nil, fmt.Errorf("key ID too long")
+	}
+
+	if opts.KDF.Kind == KDFDefault {
+		opts.KDF = DefaultKDF
+	}
+
+	h := Header{Version: envelopeVersion, Algorithm: opts.Algorithm, KDF: opts.KDF, KeyID: opts.KeyID}
+
+	if h.KDF.Kind != KDFNone {
+		h.salt = make([]byte, saltSize)
+		if _, err := io.ReadFull(rand.Reader, h.salt); err != nil {
+			return nil, err
+		}
+	}
+
+	key, err := h.KDF.derive(secret, h.salt)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := h.Algorithm.aead(key)
+	if err != nil {
+		return nil, err
+	}
+
+	h.nonce = make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, h.nonce); err != nil {
+		return nil, err
+	}
+
+	header := h.marshal()
+
+	return aead.Seal(header, h.nonce, plaintext, associatedData(header, opts.AssociatedData)), nil
+}
+
+// DecryptWithOptions opens an envelope produced by EncryptWithOptions with the same secret and associated data.
+// Legacy AES-CBC ciphertexts produced by earlier versions of Encrypt are only accepted with AllowLegacy, in which
+// case the associated data is ignored.  A ciphertext which parses as an envelope is never decrypted as a legacy one,
+// so the rare legacy ciphertext whose random prefix looks like an envelope header cannot be decrypted.
+func DecryptWithOptions(ciphertext, secret []byte, opts Options) ([]byte, error) {
+
+	h, err := ParseHeader(ciphertext)
+	if err != nil {
+		if opts.AllowLegacy && IsLegacy(ciphertext) {
+			return decryptLegacy(ciphertext, secret)
+		}
+		return nil, err
+	}
+
+	key, err := h.KDF.derive(secret, h.salt)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := h.Algorithm.aead(key)
+	if err != nil {
+		return nil, err
+	}
+
+	header := ciphertext[:h.size]
+	plaintext, err := aead.Open(nil, h.nonce, ciphertext[h.size:], associatedData(header, opts.AssociatedData))
+	if err != nil {
+		return nil, ErrDecryptionFailed
+	}
+
+	return plaintext, nil
+}
+
+// ParseHeader reads the header of an envelope, eg: to select the secret matching its key ID
+func ParseHeader(ciphertext []byte) (*Header, error) {
+
+	r := bytes.NewReader(ciphertext)
+
+	magic := make([]byte, len(envelopeMagic))
+	if _, err := io.ReadFull(r, magic); err != nil || !bytes.Equal(magic, envelopeMagic) {
+		return nil, ErrInvalidEnvelope
+	}
+
+	fields := make([]byte, 3)
+	if _, err := io.ReadFull(r, fields); err != nil {
+		return nil, ErrInvalidEnvelope
+	}
+
+	h := Header{Version: int(fields[0]), Algorithm: Algorithm(fields[1]), KDF: KDF{Kind: KDFKind(fields[2])}}
+	if h.Version != envelopeVersion {
+		return nil, fmt.Errorf("%w: unsupported version %d", ErrInvalidEnvelope, h.Version)
+	}
+
+	switch h.KDF.Kind {
+	case KDFPBKDF2:
+		if err := binary.Read(r, binary.BigEndian, &h.KDF.Iterations); err != nil {
+			return nil, ErrInvalidEnvelope
+		}
+	case KDFArgon2id:
+		if err := binary.Read(r, binary.BigEndian, &h.KDF.Iterations); err != nil {
+			return nil, ErrInvalidEnvelope
+		}
+		if err := binary.Read(r, binary.BigEndian, &h.KDF.Memory); err != nil {
+			return nil, ErrInvalidEnvelope
+		}
+		if err := binary.Read(r, binary.BigEndian, &h.KDF.Threads); err != nil {
+			return nil, ErrInvalidEnvelope
+		}
+	case KDFHKDF, KDFNone:
+	default:
+		return nil, fmt.Errorf("%w: unsupported key derivation %d", ErrInvalidEnvelope, h.KDF.Kind)
+	}
+
+	if h.KDF.Kind == KDFPBKDF2 && h.KDF.Iterations > maxPBKDF2Iterations ||
+		h.KDF.Kind == KDFArgon2id && (h.KDF.Iterations > maxArgon2Passes || h.KDF.Memory > maxArgon2Memory) {
+		return nil, fmt.Errorf("%w: key derivation parameters out of bounds", ErrInvalidEnvelope)
+	}
+
+	n, err := r.ReadByte()
+	if err != nil {
+		return nil, ErrInvalidEnvelope
+	}
+	keyID := make([]byte, n)
+	if _, err := io.ReadFull(r, keyID); err != nil {
+		return nil, ErrInvalidEnvelope
+	}
+	h.KeyID = string(keyID)
+
+	if h.KDF.Kind != KDFNone {
+		h.salt = make([]byte, saltSize)
+		if _, err := io.ReadFull(r, h.salt); err != nil {
+			return nil, ErrInvalidEnvelope
+		}
+	}
+
+	nonceSize, overhead := 0, 0
+	switch h.Algorithm {
+	case AES256GCM:
+		nonceSize, overhead = 12, 16
+	case XChaCha20Poly1305:
+		nonceSize, overhead = chacha20poly1305.NonceSizeX, chacha20poly1305.Overhead
+	default:
+		return nil, fmt.Errorf("%w: unsupported algorithm %d", ErrInvalidEnvelope, h.Algorithm)
+	}
+
+	h.nonce = make([]byte, nonceSize)
+	if _, err := io.ReadFull(r, h.nonce); err != nil {
+		return nil, ErrInvalidEnvelope
+	}
+
+	h.size = len(ciphertext) - r.Len()
+	if r.Len() < overhead {
+		return nil, ErrInvalidEnvelope
+	}
+
+	return &h, nil
+}
+
+// IsLegacy tells whether a ciphertext may have been produced by the AES-CBC format of earlier versions of Encrypt,
+// eg: to re-encrypt stored values into the current format
+func IsLegacy(ciphertext []byte) bool {
+	return legacyLength(ciphertext) && !isEnvelope(ciphertext)
+}
+
+// legacyLength tells whether a ciphertext has a length consistent with the legacy AES-CBC format
+func legacyLength(ciphertext []byte) bool {
+	n := len(ciphertext) - 4 - aes.BlockSize
+	return n >= aes.BlockSize && n%aes.BlockSize == 0
+}
+
+// isEnvelope tells whether a ciphertext is a well-formed envelope
+func isEnvelope(ciphertext []byte) bool {
+	_, err := ParseHeader(ciphertext)
+	return err == nil
+}
+
+func (h *Header) marshal() []byte {
+
+	var b bytes.Buffer
+
+	b.Write(envelopeMagic)
+	b.Write([]byte{byte(h.Version), byte(h.Algorithm), byte(h.KDF.Kind)})
+
+	switch h.KDF.Kind {
+	case KDFPBKDF2:
+		binary.Write(&b, binary.BigEndian, h.KDF.Iterations)
+	case KDFArgon2id:
+		binary.Write(&b, binary.BigEndian, h.KDF.Iterations)
+		binary.Write(&b, binary.BigEndian, h.KDF.Memory)
+		b.WriteByte(h.KDF.Threads)
+	}
+
+	b.WriteByte(byte(len(h.KeyID)))
+	b.WriteString(h.KeyID)
+	b.Write(h.salt)
+	b.Write(h.nonce)
+
+	return b.Bytes()
+}
+
+func (k KDF) derive(secret, salt []byte) ([]byte, error) {
+
+	switch k.Kind {
+	case KDFHKDF:
+		key := make([]byte, keySize)
+		if _, err := io.ReadFull(hkdf.New(sha256.New, secret, salt, []byte("9spokes envelope v2")), key); err != nil {
+			return nil, err
+		}
+		return key, nil
+	case KDFNone:
+		if len(secret) != keySize {
+			return nil, fmt.Errorf("secret must be %d bytes long when used as a key", keySize)
+		}
+		return secret, nil
+	case KDFPBKDF2:
+		if k.Iterations == 0 {
+			return nil, fmt.Errorf("PBKDF2 iterations must be set")
+		}
+		return pbkdf2.Key(secret, salt, int(k.Iterations), keySize, sha256.New), nil
+	case KDFArgon2id:
+		if k.Iterations == 0 || k.Memory == 0 || k.Threads == 0 {
+			return nil, fmt.Errorf("Argon2id passes, memory and threads must be set")
+		}
+		return argon2.IDKey(secret, salt, k.Iterations, k.Memory, k.Threads, keySize), nil
+	}
+
+	return nil, fmt.Errorf("unsupported key derivation %d", k.Kind)
+}
+
+func (a Algorithm) aead(key []byte) (cipher.AEAD, error) {
+
+	switch a {
+	case AES256GCM:
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		return cipher.NewGCM(block)
+	case XChaCha20Poly1305:
+		return chacha20poly1305.NewX(key)
+	}
+
+	return nil, fmt.Errorf("unsupported algorithm %d", a)
+}
+
+// associatedData binds the ciphertext to its header and to the caller's associated data
+func associatedData(header, ad []byte) []byte {
+	ret := make([]byte, 0, len(header)+len(ad))
+	return append(append(ret, header...), ad...)
+}
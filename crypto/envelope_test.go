@@ -0,0 +1,137 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// encryptLegacy reproduces the AES-CBC format of earlier versions of Encrypt
+func encryptLegacy(t *testing.T, str string, secret []byte) []byte {
+
+	header := make([]byte, 4+aes.BlockSize)
+	rand.Read(header)
+	iv := header[4:]
+
+	n := aes.BlockSize - len(str)%aes.BlockSize
+	padded := append([]byte(str), bytes.Repeat([]byte{byte(n)}, n)...)
+
+	block, err := aes.NewCipher(pbkdf2.Key(secret, iv, 2048, 32, sha256.New))
+	assert.Nil(t, err)
+
+	ciphertext := make([]byte, len(padded))
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(ciphertext, padded)
+
+	return append(header, ciphertext...)
+}
+
+func TestEnvelope(t *testing.T) {
+
+	secret := bytes.Repeat([]byte("k"), 32)
+
+	tests := []struct {
+		name string
+		opts Options
+	}{
+		{name: "defaults"},
+		{name: "XChaCha20-Poly1305", opts: Options{Algorithm: XChaCha20Poly1305}},
+		{name: "raw key", opts: Options{KDF: KDF{Kind: KDFNone}}},
+		{name: "HKDF", opts: Options{KDF: KDF{Kind: KDFHKDF}}},
+		{name: "PBKDF2", opts: Options{KDF: PBKDF2(1000), KeyID: "2023-01"}},
+		{name: "Argon2id", opts: Options{KDF: Argon2id(1, 1024, 1), AssociatedData: []byte("conn-1")}},
+		{name: "passphrase", opts: Options{KDF: PassphraseKDF}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			ciphertext, err := EncryptWithOptions([]byte("refresh-token"), secret, test.opts)
+			assert.Nil(t, err)
+
+			h, err := ParseHeader(ciphertext)
+			if assert.Nil(t, err) {
+				assert.Equal(t, 2, h.Version)
+				assert.Equal(t, test.opts.KeyID, h.KeyID)
+			}
+			assert.False(t, IsLegacy(ciphertext))
+
+			plaintext, err := DecryptWithOptions(ciphertext, secret, test.opts)
+			assert.Nil(t, err)
+			assert.Equal(t, "refresh-token", string(plaintext))
+
+			_, err = DecryptWithOptions(ciphertext, secret, Options{AssociatedData: []byte("conn-2")})
+			assert.ErrorIs(t, err, ErrDecryptionFailed)
+
+			tampered := append([]byte(nil), ciphertext...)
+			tampered[len(tampered)-1] ^= 1
+			_, err = DecryptWithOptions(tampered, secret, test.opts)
+			assert.ErrorIs(t, err, ErrDecryptionFailed)
+		})
+	}
+}
+
+func TestDecrypt(t *testing.T) {
+
+	secret := []byte("secret")
+
+	ciphertext, err := Encrypt("access-token", secret)
+	assert.Nil(t, err)
+	plaintext, err := Decrypt(ciphertext, secret)
+	assert.Nil(t, err)
+	assert.Equal(t, "access-token", plaintext)
+
+	_, err = Decrypt(ciphertext, []byte("wrong"))
+	assert.NotNil(t, err)
+
+	h, err := ParseHeader(ciphertext)
+	if assert.Nil(t, err) {
+		assert.Equal(t, DefaultKDF, h.KDF)
+	}
+
+	legacy := encryptLegacy(t, "access-token", secret)
+	assert.True(t, IsLegacy(legacy))
+
+	_, err = DecryptWithOptions(legacy, secret, Options{})
+	assert.ErrorIs(t, err, ErrInvalidEnvelope)
+
+	original := append([]byte(nil), legacy...)
+	plaintext, err = Decrypt(legacy, secret)
+	assert.Nil(t, err)
+	assert.Equal(t, "access-token", plaintext)
+	assert.Equal(t, original, legacy, "the ciphertext must not be decrypted in place")
+
+	for _, short := range [][]byte{nil, []byte("abc"), make([]byte, 20), []byte("9SE\x02\x01\x00")} {
+		assert.NotPanics(t, func() {
+			_, err := Decrypt(short, secret)
+			assert.NotNil(t, err)
+		})
+	}
+
+	forged := (&Header{Version: 2, Algorithm: AES256GCM, KDF: PBKDF2(1 << 30), salt: make([]byte, 16), nonce: make([]byte, 12)}).marshal()
+	_, err = ParseHeader(append(forged, make([]byte, 32)...))
+	assert.ErrorIs(t, err, ErrInvalidEnvelope)
+}
+
+func TestDecryptNoLegacyFallback(t *testing.T) {
+
+	secret := bytes.Repeat([]byte("k"), 32)
+	opts := Options{KDF: KDF{Kind: KDFNone}, AllowLegacy: true}
+
+	// Envelopes failing authentication must never be decrypted as legacy ciphertexts
+	for i := 0; i < 2000; i++ {
+		opts.AssociatedData = []byte("conn-1")
+		ciphertext, err := EncryptWithOptions(bytes.Repeat([]byte("x"), i%64), secret, opts)
+		assert.Nil(t, err)
+
+		opts.AssociatedData = []byte("conn-2")
+		if _, err := DecryptWithOptions(ciphertext, secret, opts); !assert.ErrorIs(t, err, ErrDecryptionFailed) {
+			return
+		}
+	}
+}
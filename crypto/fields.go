@@ -0,0 +1,363 @@
+package crypto
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+
+	"github.com/9spokes/go/types"
+	"golang.org/x/crypto/hkdf"
+)
+
+// EncryptedPrefix marks the string values encrypted by FieldEncryption
+const EncryptedPrefix = "enc:"
+
+// ErrNotEncrypted is returned when decrypting a value which is not encrypted outside of migration mode
+var ErrNotEncrypted = errors.New("value is not encrypted")
+
+// FieldEncryption encrypts and decrypts in place the fields of a struct tagged with `encrypt:"true"`, such as the
+// Token and Credentials of a types.Connection.  Tagged string and []byte fields are encrypted whole, while the values
+// of tagged types.Document fields are encrypted one by one so that their keys remain readable.  Encrypted values are
+// strings starting with EncryptedPrefix, each bound to its field name, to its document key and to the record ID held
+// by the string field tagged with `encrypt:"id"`, if any, so that values cannot be swapped between fields, keys or
+// records.  With Secret, the values of a record are encrypted with a key derived once from it for the record.
+//
+// Values to encrypt must not already start with EncryptedPrefix, and values to decrypt must, unless Migrate is set.
+type FieldEncryption struct {
+	Secret []byte  // High-entropy key the keys of the records are derived from with HKDF, not a passphrase
+	Sealer *Sealer // Encrypts values with envelope encryption instead of Secret if set
+	// The record and struct field the values of EncryptDocument and DecryptDocument are bound to, taken from the
+	// struct by Encrypt and Decrypt
+	RecordID string
+	Field    string
+	// Migration mode, in which values starting with EncryptedPrefix are assumed to be encrypted already and skipped
+	// when encrypting, and values which are not encrypted are left as they are when decrypting, so that records can
+	// be migrated lazily.  Plaintext values which happen to start with EncryptedPrefix are then never encrypted.
+	Migrate bool
+
+	key []byte
+}
+
+// EncryptFields encrypts the tagged fields of the struct pointed to by v with secret, see FieldEncryption
+func EncryptFields(v interface{}, secret []byte) error {
+	return FieldEncryption{Secret: secret}.Encrypt(context.Background(), v)
+}
+
+// DecryptFields decrypts the tagged fields of the struct pointed to by v with secret, see FieldEncryption
+func DecryptFields(v interface{}, secret []byte) error {
+	return FieldEncryption{Secret: secret}.Decrypt(context.Background(), v)
+}
+
+// Encrypt encrypts the tagged fields of the struct pointed to by v
+func (f FieldEncryption) Encrypt(ctx context.Context, v interface{}) error {
+	return f.fields(v, func(f FieldEncryption, name string, field reflect.Value) error {
+		return f.encryptField(ctx, name, field)
+	})
+}
+
+// Decrypt decrypts the tagged fields of the struct pointed to by v
+func (f FieldEncryption) Decrypt(ctx context.Context, v interface{}) error {
+	return f.fields(v, func(f FieldEncryption, name string, field reflect.Value) error {
+		return f.decryptField(ctx, name, field)
+	})
+}
+
+// EncryptDocument encrypts the values of a document under the given keys, or all of them if none is given.  Values
+// are serialised to JSON before being encrypted, so numbers are decrypted as float64 and nested documents as
+// map[string]interface{}.
+func (f FieldEncryption) EncryptDocument(ctx context.Context, doc types.Document, keys ...string) error {
+
+	f, err := f.withKey()
+	if err != nil {
+		return err
+	}
+
+	for _, key := range documentKeys(doc, keys) {
+
+		value, ok := doc[key]
+		if !ok {
+			continue
+		}
+		if isEncrypted(value) {
+			if f.Migrate {
+				continue
+			}
+			return fmt.Errorf("cannot encrypt %s: %w", key, errAlreadyEncrypted)
+		}
+
+		b, err := json.Marshal(value)
+		if err != nil {
+			return fmt.Errorf("failed to serialise %s: %s", key, err.Error())
+		}
+
+		encrypted, err := f.encrypt(ctx, b, key)
+		if err != nil {
+			return fmt.Errorf("failed to encrypt %s: %s", key, err.Error())
+		}
+		doc[key] = encrypted
+	}
+
+	return nil
+}
+
+// DecryptDocument decrypts the values of a document under the given keys, or all of them if none is given
+func (f FieldEncryption) DecryptDocument(ctx context.Context, doc types.Document, keys ...string) error {
+
+	f, err := f.withKey()
+	if err != nil {
+		return err
+	}
+
+	for _, key := range documentKeys(doc, keys) {
+
+		if _, ok := doc[key]; !ok {
+			continue
+		}
+		value, ok := doc[key].(string)
+		if !ok || !isEncrypted(value) {
+			if f.Migrate {
+				continue
+			}
+			return fmt.Errorf("failed to decrypt %s: %w", key, ErrNotEncrypted)
+		}
+
+		b, err := f.decrypt(ctx, value, key)
+		if err != nil {
+			return fmt.Errorf("failed to decrypt %s: %w", key, err)
+		}
+
+		var decrypted interface{}
+		if err := json.Unmarshal(b, &decrypted); err != nil {
+			return fmt.Errorf("failed to parse %s: %s", key, err.Error())
+		}
+		doc[key] = decrypted
+	}
+
+	return nil
+}
+
+// errAlreadyEncrypted is returned when encrypting a value starting with EncryptedPrefix outside of migration mode
+var errAlreadyEncrypted = fmt.Errorf("value already starts with %s", EncryptedPrefix)
+
+// fields calls fn on each tagged field of the struct pointed to by v, passing a copy of f bound to its record ID and
+// holding its key
+func (f FieldEncryption) fields(v interface{}, fn func(f FieldEncryption, name string, field reflect.Value) error) error {
+
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() || rv.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("expected a pointer to a struct, got %T", v)
+	}
+	rv = rv.Elem()
+
+	for i := 0; i < rv.NumField(); i++ {
+		sf := rv.Type().Field(i)
+		if sf.Tag.Get("encrypt") != "id" {
+			continue
+		}
+		if !sf.IsExported() || sf.Type.Kind() != reflect.String {
+			return fmt.Errorf("record ID field %s must be an exported string", sf.Name)
+		}
+		if f.RecordID = rv.Field(i).String(); f.RecordID == "" {
+			return fmt.Errorf("record ID field %s not set", sf.Name)
+		}
+	}
+
+	f, err := f.withKey()
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i < rv.NumField(); i++ {
+		sf := rv.Type().Field(i)
+		if sf.Tag.Get("encrypt") != "true" {
+			continue
+		}
+		if !sf.IsExported() {
+			return fmt.Errorf("cannot encrypt unexported field %s", sf.Name)
+		}
+		if err := fn(f, sf.Name, rv.Field(i)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+var documentType = reflect.TypeOf(types.Document{})
+
+func (f FieldEncryption) encryptField(ctx context.Context, name string, field reflect.Value) error {
+
+	switch {
+	case field.Type() == documentType:
+		if field.IsNil() {
+			return nil
+		}
+		f.Field = name
+		return f.EncryptDocument(ctx, field.Interface().(types.Document))
+
+	case field.Kind() == reflect.String:
+		if field.Len() == 0 || f.skipEncrypted(field.String()) {
+			return nil
+		}
+		if isEncrypted(field.String()) {
+			return fmt.Errorf("cannot encrypt %s: %w", name, errAlreadyEncrypted)
+		}
+		encrypted, err := f.encrypt(ctx, []byte(field.String()), name)
+		if err != nil {
+			return fmt.Errorf("failed to encrypt %s: %s", name, err.Error())
+		}
+		field.SetString(encrypted)
+
+	case field.Kind() == reflect.Slice && field.Type().Elem().Kind() == reflect.Uint8:
+		if field.Len() == 0 || f.skipEncrypted(string(field.Bytes())) {
+			return nil
+		}
+		if isEncrypted(string(field.Bytes())) {
+			return fmt.Errorf("cannot encrypt %s: %w", name, errAlreadyEncrypted)
+		}
+		encrypted, err := f.encrypt(ctx, field.Bytes(), name)
+		if err != nil {
+			return fmt.Errorf("failed to encrypt %s: %s", name, err.Error())
+		}
+		field.SetBytes([]byte(encrypted))
+
+	default:
+		return fmt.Errorf("cannot encrypt field %s of type %s", name, field.Type())
+	}
+
+	return nil
+}
+
+func (f FieldEncryption) decryptField(ctx context.Context, name string, field reflect.Value) error {
+
+	switch {
+	case field.Type() == documentType:
+		if field.IsNil() {
+			return nil
+		}
+		f.Field = name
+		return f.DecryptDocument(ctx, field.Interface().(types.Document))
+
+	case field.Kind() == reflect.String:
+		if field.Len() == 0 || f.skipPlaintext(field.String()) {
+			return nil
+		}
+		if !isEncrypted(field.String()) {
+			return fmt.Errorf("failed to decrypt %s: %w", name, ErrNotEncrypted)
+		}
+		b, err := f.decrypt(ctx, field.String(), name)
+		if err != nil {
+			return fmt.Errorf("failed to decrypt %s: %w", name, err)
+		}
+		field.SetString(string(b))
+
+	case field.Kind() == reflect.Slice && field.Type().Elem().Kind() == reflect.Uint8:
+		if field.Len() == 0 || f.skipPlaintext(string(field.Bytes())) {
+			return nil
+		}
+		if !isEncrypted(string(field.Bytes())) {
+			return fmt.Errorf("failed to decrypt %s: %w", name, ErrNotEncrypted)
+		}
+		b, err := f.decrypt(ctx, string(field.Bytes()), name)
+		if err != nil {
+			return fmt.Errorf("failed to decrypt %s: %w", name, err)
+		}
+		field.SetBytes(b)
+
+	default:
+		return fmt.Errorf("cannot decrypt field %s of type %s", name, field.Type())
+	}
+
+	return nil
+}
+
+// skipEncrypted reports whether a value to encrypt is left as it is, being encrypted already in migration mode
+func (f FieldEncryption) skipEncrypted(value string) bool {
+	return f.Migrate && isEncrypted(value)
+}
+
+// skipPlaintext reports whether a value to decrypt is left as it is, not being encrypted yet in migration mode
+func (f FieldEncryption) skipPlaintext(value string) bool {
+	return f.Migrate && !isEncrypted(value)
+}
+
+// withKey returns a copy of f holding the key of its record, derived from Secret unless values are sealed
+func (f FieldEncryption) withKey() (FieldEncryption, error) {
+
+	if f.Sealer != nil || f.key != nil {
+		return f, nil
+	}
+	if len(f.Secret) == 0 {
+		return f, fmt.Errorf("no secret to encrypt fields with")
+	}
+
+	f.key = make([]byte, keySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, f.Secret, nil, []byte("9spokes fields\x00"+f.RecordID)), f.key); err != nil {
+		return f, err
+	}
+
+	return f, nil
+}
+
+// associatedData binds a value to the name of its field or key, to the field of a document key and to the record
+// ID, if any
+func (f FieldEncryption) associatedData(name string) []byte {
+	return []byte(f.RecordID + "\x00" + f.Field + "\x00" + name)
+}
+
+// encrypt returns the encoded ciphertext of a value, bound to the name of its field or key
+func (f FieldEncryption) encrypt(ctx context.Context, plaintext []byte, name string) (string, error) {
+
+	var ciphertext []byte
+	var err error
+
+	if f.Sealer != nil {
+		ciphertext, err = f.Sealer.Seal(ctx, plaintext, f.associatedData(name))
+	} else {
+		ciphertext, err = EncryptWithOptions(plaintext, f.key, Options{KDF: KDF{Kind: KDFNone}, AssociatedData: f.associatedData(name)})
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return EncryptedPrefix + base64.StdEncoding.EncodeToString(ciphertext), nil
+}
+
+func (f FieldEncryption) decrypt(ctx context.Context, value, name string) ([]byte, error) {
+
+	ciphertext, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(value, EncryptedPrefix))
+	if err != nil {
+		return nil, ErrInvalidEnvelope
+	}
+
+	if f.Sealer != nil {
+		return f.Sealer.Open(ctx, ciphertext, f.associatedData(name))
+	}
+
+	return DecryptWithOptions(ciphertext, f.key, Options{AssociatedData: f.associatedData(name)})
+}
+
+func isEncrypted(v interface{}) bool {
+	s, ok := v.(string)
+	return ok && strings.HasPrefix(s, EncryptedPrefix)
+}
+
+func documentKeys(doc types.Document, keys []string) []string {
+
+	if len(keys) > 0 {
+		return keys
+	}
+
+	ret := make([]string, 0, len(doc))
+	for key := range doc {
+		ret = append(ret, key)
+	}
+
+	return ret
+}
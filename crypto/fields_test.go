@@ -0,0 +1,60 @@
+package crypto
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/9spokes/go/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEncryptFields(t *testing.T) {
+
+	secret := []byte("secret")
+
+	conn := types.Connection{
+		ID:          "conn-1",
+		Token:       types.Document{"access_token": "abc", "expires_in": 3600},
+		Credentials: types.Document{"api_key": "xyz"},
+		Settings:    types.Document{"currency": "NZD"},
+	}
+
+	assert.Nil(t, EncryptFields(&conn, secret))
+	assert.True(t, strings.HasPrefix(conn.Token["access_token"].(string), EncryptedPrefix))
+	assert.True(t, strings.HasPrefix(conn.Credentials["api_key"].(string), EncryptedPrefix))
+	assert.Equal(t, "NZD", conn.Settings["currency"])
+
+	b, _ := json.Marshal(conn)
+	assert.NotContains(t, string(b), "abc")
+
+	// Encrypting twice is rejected, unless migrating
+	sealed := conn.Token["access_token"]
+	assert.NotNil(t, EncryptFields(&conn, secret))
+	assert.Nil(t, FieldEncryption{Secret: secret, Migrate: true}.Encrypt(context.Background(), &conn))
+	assert.Equal(t, sealed, conn.Token["access_token"])
+
+	// Values cannot be swapped between keys nor records
+	swapped := types.Document{"refresh_token": sealed}
+	assert.ErrorIs(t, FieldEncryption{Secret: secret, RecordID: "conn-1"}.DecryptDocument(context.Background(), swapped), ErrDecryptionFailed)
+	other := types.Connection{ID: "conn-2", Token: types.Document{"access_token": sealed}}
+	assert.ErrorIs(t, DecryptFields(&other, secret), ErrDecryptionFailed)
+	moved := types.Connection{ID: "conn-1", Credentials: types.Document{"access_token": sealed}}
+	assert.ErrorIs(t, DecryptFields(&moved, secret), ErrDecryptionFailed)
+	assert.Nil(t, FieldEncryption{Secret: secret, RecordID: "conn-1", Field: "Token"}.DecryptDocument(context.Background(), types.Document{"access_token": sealed}))
+
+	assert.Nil(t, DecryptFields(&conn, secret))
+	assert.Equal(t, "abc", conn.Token["access_token"])
+	assert.Equal(t, float64(3600), conn.Token["expires_in"])
+	assert.Equal(t, "xyz", conn.Credentials["api_key"])
+
+	assert.NotNil(t, EncryptFields(conn, secret))
+	assert.NotNil(t, EncryptFields(&types.Connection{Token: types.Document{"access_token": "abc"}}, secret))
+
+	// Values which are not encrypted are rejected, unless migrating
+	plain := types.Connection{ID: "conn-1", Token: types.Document{"access_token": "abc"}}
+	assert.ErrorIs(t, DecryptFields(&plain, secret), ErrNotEncrypted)
+	assert.Nil(t, FieldEncryption{Secret: secret, Migrate: true}.Decrypt(context.Background(), &plain))
+	assert.Equal(t, "abc", plain.Token["access_token"])
+}
@@ -0,0 +1,270 @@
+package crypto
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"github.com/Azure/azure-sdk-for-go/sdk/security/keyvault/azkeys"
+)
+
+// KeyProvider wraps and unwraps data keys with the key encryption keys it holds
+type KeyProvider interface {
+	// WrapKey encrypts a data key with the current key encryption key and returns the ID of that key
+	WrapKey(ctx context.Context, dataKey []byte) (keyID string, wrapped []byte, err error)
+	// UnwrapKey decrypts a data key wrapped with the key encryption key of the given ID
+	UnwrapKey(ctx context.Context, keyID string, wrapped []byte) ([]byte, error)
+}
+
+// ErrUnknownKey is returned when unwrapping a data key with a key encryption key the provider does not hold
+var ErrUnknownKey = errors.New("unknown key encryption key")
+
+// minKeyringKeySize is the minimum length of the keys of a keyring, which are used as high-entropy secrets
+const minKeyringKeySize = 16
+
+// dataKeyAD binds wrapped data keys to their purpose
+var dataKeyAD = []byte("9spokes data key")
+
+// Keyring is a KeyProvider holding its key encryption keys locally.  New data keys are wrapped with the Primary key,
+// the other keys only being kept to unwrap the data keys wrapped before a rotation.
+type Keyring struct {
+	Primary string            `json:"primary"`
+	Keys    map[string][]byte `json:"keys"` // Base64-encoded in JSON
+}
+
+// LoadKeyring reads a keyring from a JSON file such as:
+//
+//	{"primary": "2023-06", "keys": {"2023-01": "<base64>", "2023-06": "<base64>"}}
+func LoadKeyring(path string) (*Keyring, error) {
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("while reading keyring: %w", err)
+	}
+
+	var k Keyring
+	if err := json.Unmarshal(b, &k); err != nil {
+		return nil, fmt.Errorf("while parsing keyring: %w", err)
+	}
+
+	if err := k.validate(); err != nil {
+		return nil, err
+	}
+
+	return &k, nil
+}
+
+// KeyringFromEnv reads a keyring from an environment variable holding comma-separated "<key ID>=<base64 key>"
+// pairs, the first one being the primary key, eg: TOKEN_KEYS="2023-06=...,2023-01=..."
+func KeyringFromEnv(name string) (*Keyring, error) {
+
+	v, ok := os.LookupEnv(name)
+	if !ok || v == "" {
+		return nil, fmt.Errorf("environment variable %s not set", name)
+	}
+
+	k := Keyring{Keys: make(map[string][]byte)}
+
+	for _, pair := range strings.Split(v, ",") {
+		id, encoded, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok || id == "" {
+			return nil, fmt.Errorf("invalid key in %s, expected <key ID>=<base64 key>", name)
+		}
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("invalid key %s in %s: %s", id, name, err.Error())
+		}
+		if k.Primary == "" {
+			k.Primary = id
+		}
+		k.Keys[id] = key
+	}
+
+	if err := k.validate(); err != nil {
+		return nil, err
+	}
+
+	return &k, nil
+}
+
+func (k *Keyring) validate() error {
+
+	if k.Primary == "" {
+		return fmt.Errorf("primary key not specified")
+	}
+
+	if _, ok := k.Keys[k.Primary]; !ok {
+		return fmt.Errorf("primary key %s not found", k.Primary)
+	}
+
+	for id, key := range k.Keys {
+		if len(id) > 255 {
+			return fmt.Errorf("key ID %s too long", id)
+		}
+		if len(key) < minKeyringKeySize {
+			return fmt.Errorf("key %s must be at least %d bytes long", id, minKeyringKeySize)
+		}
+	}
+
+	return nil
+}
+
+// WrapKey implements KeyProvider
+func (k *Keyring) WrapKey(_ context.Context, dataKey []byte) (string, []byte, error) {
+
+	key, ok := k.Keys[k.Primary]
+	if !ok {
+		return "", nil, fmt.Errorf("%w: %s", ErrUnknownKey, k.Primary)
+	}
+
+	wrapped, err := EncryptWithOptions(dataKey, key, Options{KDF: KDF{Kind: KDFHKDF}, KeyID: k.Primary, AssociatedData: dataKeyAD})
+	if err != nil {
+		return "", nil, err
+	}
+
+	return k.Primary, wrapped, nil
+}
+
+// UnwrapKey implements KeyProvider
+func (k *Keyring) UnwrapKey(_ context.Context, keyID string, wrapped []byte) ([]byte, error) {
+
+	key, ok := k.Keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownKey, keyID)
+	}
+
+	return DecryptWithOptions(wrapped, key, Options{AssociatedData: dataKeyAD})
+}
+
+// GenerateKey returns a random key suitable for a keyring
+func GenerateKey() ([]byte, error) {
+	key := make([]byte, keySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// AzureKeyVault is a KeyProvider wrapping data keys with a key held in Azure Key Vault Managed HSM, which never
+// leaves the HSM.  Key IDs are of the form "<key name>/<key version>".
+type AzureKeyVault struct {
+	Tenant     string // Tenant id
+	HSMName    string // HSM name
+	Key        string // Key encryption key name
+	KeyVersion string // Key encryption key version, defaults to the latest one
+
+	// Defaults to RSA-OAEP-256, use A256KW for AES keys
+	Algorithm azkeys.JSONWebKeyEncryptionAlgorithm
+
+	mu     sync.Mutex
+	client *azkeys.Client
+}
+
+func (kv *AzureKeyVault) validate() error {
+	if kv.HSMName == "" {
+		return fmt.Errorf("HSM name not specified")
+	}
+
+	if kv.Key == "" {
+		return fmt.Errorf("key name not specified")
+	}
+
+	return nil
+}
+
+func (kv *AzureKeyVault) connect() (*azkeys.Client, error) {
+
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	if kv.client != nil {
+		return kv.client, nil
+	}
+
+	if err := kv.validate(); err != nil {
+		return nil, err
+	}
+
+	creds, err := azidentity.NewDefaultAzureCredential(
+		&azidentity.DefaultAzureCredentialOptions{
+			TenantID: kv.Tenant,
+		})
+	if err != nil {
+		return nil, fmt.Errorf("while getting Azure credentials: %w", err)
+	}
+
+	url := fmt.Sprintf("https://%s.managedhsm.azure.net/", kv.HSMName)
+	az, err := azkeys.NewClient(url, creds, nil)
+	if err != nil {
+		return nil, fmt.Errorf("while creating Azure Key Vault client: %w", err)
+	}
+
+	kv.client = az
+	return az, nil
+}
+
+func (kv *AzureKeyVault) algorithm() *azkeys.JSONWebKeyEncryptionAlgorithm {
+	algo := kv.Algorithm
+	if algo == "" {
+		algo = azkeys.JSONWebKeyEncryptionAlgorithmRSAOAEP256
+	}
+	return &algo
+}
+
+// WrapKey implements KeyProvider
+func (kv *AzureKeyVault) WrapKey(ctx context.Context, dataKey []byte) (string, []byte, error) {
+
+	client, err := kv.connect()
+	if err != nil {
+		return "", nil, err
+	}
+
+	res, err := client.WrapKey(ctx, kv.Key, kv.KeyVersion, azkeys.KeyOperationsParameters{
+		Algorithm: kv.algorithm(),
+		Value:     dataKey,
+	}, nil)
+	if err != nil {
+		return "", nil, fmt.Errorf("while wrapping data key: %w", err)
+	}
+
+	version := kv.KeyVersion
+	if res.KID != nil {
+		version = res.KID.Version()
+	}
+	if version == "" {
+		return "", nil, fmt.Errorf("unable to determine the version of key %s", kv.Key)
+	}
+
+	return kv.Key + "/" + version, res.Result, nil
+}
+
+// UnwrapKey implements KeyProvider
+func (kv *AzureKeyVault) UnwrapKey(ctx context.Context, keyID string, wrapped []byte) ([]byte, error) {
+
+	name, version, ok := strings.Cut(keyID, "/")
+	if !ok || name == "" || version == "" {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownKey, keyID)
+	}
+
+	client, err := kv.connect()
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := client.UnwrapKey(ctx, name, version, azkeys.KeyOperationsParameters{
+		Algorithm: kv.algorithm(),
+		Value:     wrapped,
+	}, nil)
+	if err != nil {
+		return nil, fmt.Errorf("while unwrapping data key: %w", err)
+	}
+
+	return res.Result, nil
+}
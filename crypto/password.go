@@ -0,0 +1,174 @@
+package crypto
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Argon2Params are the parameters of an Argon2id password hash
+type Argon2Params struct {
+	Memory  uint32 // Memory in KiB
+	Passes  uint32
+	Threads uint8
+	SaltLen int
+	KeyLen  int
+}
+
+// DefaultArgon2Params are the Argon2id parameters recommended by RFC 9106 for memory-constrained environments
+var DefaultArgon2Params = Argon2Params{Memory: 64 * 1024, Passes: 3, Threads: 4, SaltLen: 16, KeyLen: 32}
+
+// DefaultBcryptCost is the cost of bcrypt password hashes unless specified otherwise
+const DefaultBcryptCost = 12
+
+// ErrUnsupportedHash is returned when verifying a password against a hash of an unknown format
+var ErrUnsupportedHash = errors.New("unsupported password hash")
+
+// HashPassword hashes a password with Argon2id and the default parameters, see HashArgon2id
+func HashPassword(password string) (string, error) {
+	return HashArgon2id(password, DefaultArgon2Params)
+}
+
+// HashArgon2id hashes a password with Argon2id and returns it as a PHC string, eg:
+//
+//	$argon2id$v=19$m=65536,t=3,p=4$<base64 salt>$<base64 hash>
+func HashArgon2id(password string, p Argon2Params) (string, error) {
+
+	if p.Memory == 0 || p.Passes == 0 || p.Threads == 0 || p.SaltLen < 8 || p.KeyLen < 16 {
+		return "", fmt.Errorf("invalid Argon2id parameters")
+	}
+
+	salt := make([]byte, p.SaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	key := argon2.IDKey([]byte(password), salt, p.Passes, p.Memory, p.Threads, uint32(p.KeyLen))
+
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, p.Memory, p.Passes, p.Threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// HashBcrypt hashes a password with bcrypt at the given cost, or DefaultBcryptCost if 0
+func HashBcrypt(password string, cost int) (string, error) {
+
+	if cost == 0 {
+		cost = DefaultBcryptCost
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), cost)
+	if err != nil {
+		return "", err
+	}
+
+	return string(hash), nil
+}
+
+// VerifyPassword reports whether a password matches a hash produced by HashArgon2id or HashBcrypt, or a legacy
+// unsalted hex SHA-256, in constant time
+func VerifyPassword(password, hash string) (bool, error) {
+
+	switch {
+	case strings.HasPrefix(hash, "$argon2id$"):
+		p, salt, key, err := parseArgon2id(hash)
+		if err != nil {
+			return false, err
+		}
+		computed := argon2.IDKey([]byte(password), salt, p.Passes, p.Memory, p.Threads, uint32(len(key)))
+		return subtle.ConstantTimeCompare(computed, key) == 1, nil
+
+	case strings.HasPrefix(hash, "$2a$"), strings.HasPrefix(hash, "$2b$"), strings.HasPrefix(hash, "$2y$"):
+		err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+		if err == bcrypt.ErrMismatchedHashAndPassword {
+			return false, nil
+		}
+		return err == nil, err
+
+	case isLegacySHA256(hash):
+		computed := sha256.Sum256([]byte(password))
+		expected, _ := hex.DecodeString(hash)
+		return subtle.ConstantTimeCompare(computed[:], expected) == 1, nil
+	}
+
+	return false, ErrUnsupportedHash
+}
+
+// NeedsRehash reports whether a hash should be replaced by a new one from HashPassword once the password is known,
+// as for legacy SHA-256 hashes or Argon2id hashes weaker than the default parameters
+func NeedsRehash(hash string) bool {
+
+	if strings.HasPrefix(hash, "$argon2id$") {
+		p, _, _, err := parseArgon2id(hash)
+		return err != nil || p.Memory < DefaultArgon2Params.Memory || p.Passes < DefaultArgon2Params.Passes
+	}
+
+	if cost, err := bcrypt.Cost([]byte(hash)); err == nil {
+		return cost < DefaultBcryptCost
+	}
+
+	return true
+}
+
+// HashCredentials hashes the client secrets of a map of client IDs to plaintext secrets with HashPassword, for
+// writing out a credentials file as read by misc.LoadCredentials
+func HashCredentials(creds map[string]string) (map[string]string, error) {
+
+	ret := make(map[string]string, len(creds))
+	for id, secret := range creds {
+		hash, err := HashPassword(secret)
+		if err != nil {
+			return nil, fmt.Errorf("failed to hash the secret of %s: %s", id, err.Error())
+		}
+		ret[id] = hash
+	}
+
+	return ret, nil
+}
+
+func parseArgon2id(hash string) (p Argon2Params, salt, key []byte, err error) {
+
+	// "", "argon2id", "v=19", "m=...,t=...,p=...", salt, key
+	fields := strings.Split(hash, "$")
+	if len(fields) != 6 {
+		return p, nil, nil, fmt.Errorf("%w: malformed Argon2id hash", ErrUnsupportedHash)
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(fields[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return p, nil, nil, fmt.Errorf("%w: unsupported Argon2id version", ErrUnsupportedHash)
+	}
+
+	if _, err := fmt.Sscanf(fields[3], "m=%d,t=%d,p=%d", &p.Memory, &p.Passes, &p.Threads); err != nil {
+		return p, nil, nil, fmt.Errorf("%w: malformed Argon2id parameters", ErrUnsupportedHash)
+	}
+	if p.Memory == 0 || p.Memory > maxArgon2Memory || p.Passes == 0 || p.Passes > maxArgon2Passes || p.Threads == 0 {
+		return p, nil, nil, fmt.Errorf("%w: Argon2id parameters out of bounds", ErrUnsupportedHash)
+	}
+
+	if salt, err = base64.RawStdEncoding.DecodeString(fields[4]); err != nil {
+		return p, nil, nil, fmt.Errorf("%w: malformed Argon2id salt", ErrUnsupportedHash)
+	}
+	if key, err = base64.RawStdEncoding.DecodeString(fields[5]); err != nil || len(key) == 0 {
+		return p, nil, nil, fmt.Errorf("%w: malformed Argon2id hash", ErrUnsupportedHash)
+	}
+
+	p.SaltLen, p.KeyLen = len(salt), len(key)
+
+	return p, salt, key, nil
+}
+
+func isLegacySHA256(hash string) bool {
+	if len(hash) != 2*sha256.Size {
+		return false
+	}
+	_, err := hex.DecodeString(hash)
+	return err == nil
+}
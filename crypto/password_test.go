@@ -0,0 +1,36 @@
+package crypto
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVerifyPassword(t *testing.T) {
+
+	legacy := sha256.Sum256([]byte("s3cret"))
+
+	argon, err := HashArgon2id("s3cret", Argon2Params{Memory: 1024, Passes: 1, Threads: 1, SaltLen: 16, KeyLen: 32})
+	assert.Nil(t, err)
+	bcrypted, err := HashBcrypt("s3cret", 4)
+	assert.Nil(t, err)
+
+	for _, hash := range []string{argon, bcrypted, hex.EncodeToString(legacy[:])} {
+		ok, err := VerifyPassword("s3cret", hash)
+		assert.Nil(t, err)
+		assert.True(t, ok, hash)
+
+		ok, err = VerifyPassword("wrong", hash)
+		assert.Nil(t, err)
+		assert.False(t, ok, hash)
+
+		assert.True(t, NeedsRehash(hash), hash)
+	}
+
+	_, err = VerifyPassword("s3cret", "$argon2id$v=19$m=4294967295,t=1,p=1$c2FsdA$a2V5")
+	assert.ErrorIs(t, err, ErrUnsupportedHash)
+	_, err = VerifyPassword("s3cret", "plaintext")
+	assert.ErrorIs(t, err, ErrUnsupportedHash)
+}
@@ -0,0 +1,168 @@
+package crypto
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+)
+
+// Sealed value format (version 1):
+//
+//	magic "9SK" | version (1) | key ID length (1) | key ID | wrapped key length (2) | wrapped key | payload
+//
+// The payload is an envelope (see EncryptWithOptions) encrypted with the data key.  It does not authenticate the
+// wrapped key, which is protected by the key provider, so that data keys can be re-wrapped without touching it.
+
+var sealedMagic = []byte("9SK")
+
+const sealedVersion = 1
+
+// Sealer implements envelope encryption: each value is encrypted with its own random data key, which is wrapped by
+// a KeyProvider and stored alongside the value with the ID of the key encryption key.  Rotating the key encryption
+// key then only requires re-wrapping the data keys, see Rewrap.
+type Sealer struct {
+	Provider  KeyProvider
+	Algorithm Algorithm // Defaults to AES256GCM
+}
+
+type sealed struct {
+	keyID   string
+	wrapped []byte
+	payload []byte
+}
+
+// Seal encrypts plaintext with a new data key, binding it to the associated data ad, which may be nil
+func (s Sealer) Seal(ctx context.Context, plaintext, ad []byte) ([]byte, error) {
+
+	dataKey, err := GenerateKey()
+	if err != nil {
+		return nil, err
+	}
+
+	payload, err := EncryptWithOptions(plaintext, dataKey, Options{Algorithm: s.Algorithm, KDF: KDF{Kind: KDFNone}, AssociatedData: ad})
+	if err != nil {
+		return nil, err
+	}
+
+	keyID, wrapped, err := s.Provider.WrapKey(ctx, dataKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to wrap data key: %s", err.Error())
+	}
+
+	return (&sealed{keyID: keyID, wrapped: wrapped, payload: payload}).marshal()
+}
+
+// Open decrypts a value produced by Seal with the same associated data
+func (s Sealer) Open(ctx context.Context, value, ad []byte) ([]byte, error) {
+
+	v, err := parseSealed(value)
+	if err != nil {
+		return nil, err
+	}
+
+	dataKey, err := s.Provider.UnwrapKey(ctx, v.keyID, v.wrapped)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap data key: %w", err)
+	}
+
+	// Payloads are always envelopes, legacy ciphertexts are never accepted
+	return DecryptWithOptions(v.payload, dataKey, Options{AssociatedData: ad})
+}
+
+// Rewrap re-wraps the data key of a value with the current key of the same provider, see Rewrap
+func (s Sealer) Rewrap(ctx context.Context, value []byte) ([]byte, error) {
+	return Rewrap(ctx, value, s.Provider, s.Provider)
+}
+
+// Rewrap unwraps the data key of a sealed value with from and wraps it again with to, leaving the encrypted payload
+// untouched.  Use it to rotate key encryption keys, or to move values between providers.
+func Rewrap(ctx context.Context, value []byte, from, to KeyProvider) ([]byte, error) {
+
+	v, err := parseSealed(value)
+	if err != nil {
+		return nil, err
+	}
+
+	dataKey, err := from.UnwrapKey(ctx, v.keyID, v.wrapped)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap data key: %w", err)
+	}
+
+	if v.keyID, v.wrapped, err = to.WrapKey(ctx, dataKey); err != nil {
+		return nil, fmt.Errorf("failed to wrap data key: %s", err.Error())
+	}
+
+	return v.marshal()
+}
+
+// SealedKeyID returns the ID of the key encryption key a sealed value's data key is wrapped with, eg: to find the
+// values still to be re-wrapped after a rotation
+func SealedKeyID(value []byte) (string, error) {
+
+	v, err := parseSealed(value)
+	if err != nil {
+		return "", err
+	}
+
+	return v.keyID, nil
+}
+
+// IsSealed reports whether a value was produced by a Sealer
+func IsSealed(value []byte) bool {
+	return len(value) > len(sealedMagic) && bytes.Equal(value[:len(sealedMagic)], sealedMagic)
+}
+
+func (v *sealed) marshal() ([]byte, error) {
+
+	if len(v.keyID) > 255 {
+		return nil, fmt.Errorf("key ID too long")
+	}
+	if len(v.wrapped) > 0xffff {
+		return nil, fmt.Errorf("wrapped key too long")
+	}
+
+	var b bytes.Buffer
+	b.Write(sealedMagic)
+	b.WriteByte(sealedVersion)
+	b.WriteByte(byte(len(v.keyID)))
+	b.WriteString(v.keyID)
+	binary.Write(&b, binary.BigEndian, uint16(len(v.wrapped)))
+	b.Write(v.wrapped)
+	b.Write(v.payload)
+
+	return b.Bytes(), nil
+}
+
+func parseSealed(value []byte) (*sealed, error) {
+
+	if !IsSealed(value) {
+		return nil, ErrInvalidEnvelope
+	}
+
+	r := bytes.NewReader(value[len(sealedMagic):])
+
+	version, err := r.ReadByte()
+	if err != nil || version != sealedVersion {
+		return nil, fmt.Errorf("%w: unsupported sealed value version", ErrInvalidEnvelope)
+	}
+
+	n, err := r.ReadByte()
+	if err != nil || r.Len() < int(n) {
+		return nil, ErrInvalidEnvelope
+	}
+	keyID := make([]byte, n)
+	r.Read(keyID)
+
+	var size uint16
+	if err := binary.Read(r, binary.BigEndian, &size); err != nil || r.Len() < int(size) {
+		return nil, ErrInvalidEnvelope
+	}
+	wrapped := make([]byte, size)
+	r.Read(wrapped)
+
+	payload := make([]byte, r.Len())
+	r.Read(payload)
+
+	return &sealed{keyID: string(keyID), wrapped: wrapped, payload: payload}, nil
+}
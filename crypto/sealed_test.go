@@ -0,0 +1,95 @@
+package crypto
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSealer(t *testing.T) {
+
+	ctx := context.Background()
+
+	old := bytes.Repeat([]byte("o"), 32)
+	current := bytes.Repeat([]byte("c"), 32)
+
+	keyring := &Keyring{Primary: "2023-01", Keys: map[string][]byte{"2023-01": old}}
+	s := Sealer{Provider: keyring}
+
+	value, err := s.Seal(ctx, []byte("refresh-token"), []byte("conn-1"))
+	assert.Nil(t, err)
+	assert.True(t, IsSealed(value))
+
+	plaintext, err := s.Open(ctx, value, []byte("conn-1"))
+	assert.Nil(t, err)
+	assert.Equal(t, "refresh-token", string(plaintext))
+
+	_, err = s.Open(ctx, value, []byte("conn-2"))
+	assert.ErrorIs(t, err, ErrDecryptionFailed)
+
+	// Rotate
+	keyring.Keys["2023-06"] = current
+	keyring.Primary = "2023-06"
+
+	rewrapped, err := s.Rewrap(ctx, value)
+	assert.Nil(t, err)
+
+	id, err := SealedKeyID(rewrapped)
+	assert.Nil(t, err)
+	assert.Equal(t, "2023-06", id)
+
+	before, _ := parseSealed(value)
+	after, _ := parseSealed(rewrapped)
+	assert.Equal(t, before.payload, after.payload)
+
+	delete(keyring.Keys, "2023-01")
+
+	_, err = s.Open(ctx, value, []byte("conn-1"))
+	assert.ErrorIs(t, err, ErrUnknownKey)
+
+	plaintext, err = s.Open(ctx, rewrapped, []byte("conn-1"))
+	assert.Nil(t, err)
+	assert.Equal(t, "refresh-token", string(plaintext))
+
+	// Payloads are never decrypted as legacy ciphertexts
+	dataKey, _ := GenerateKey()
+	keyID, wrapped, err := keyring.WrapKey(ctx, dataKey)
+	assert.Nil(t, err)
+	legacy, err := (&sealed{keyID: keyID, wrapped: wrapped, payload: encryptLegacy(t, "refresh-token", dataKey)}).marshal()
+	assert.Nil(t, err)
+	_, err = s.Open(ctx, legacy, nil)
+	assert.ErrorIs(t, err, ErrInvalidEnvelope)
+
+	for _, invalid := range [][]byte{nil, []byte("9SK"), []byte("9SK\x01\x05ab"), []byte("9SK\x01\x00\xff\xff")} {
+		_, err := s.Open(ctx, invalid, nil)
+		assert.ErrorIs(t, err, ErrInvalidEnvelope)
+	}
+}
+
+func TestLoadKeyring(t *testing.T) {
+
+	key := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte("k"), 32))
+
+	path := filepath.Join(t.TempDir(), "keyring.json")
+	os.WriteFile(path, []byte(`{"primary": "a", "keys": {"a": "`+key+`", "b": "`+key+`"}}`), 0600)
+
+	k, err := LoadKeyring(path)
+	assert.Nil(t, err)
+	assert.Equal(t, "a", k.Primary)
+	assert.Len(t, k.Keys, 2)
+
+	t.Setenv("TEST_KEYRING", "b="+key+", a="+key)
+	k, err = KeyringFromEnv("TEST_KEYRING")
+	assert.Nil(t, err)
+	assert.Equal(t, "b", k.Primary)
+	assert.Len(t, k.Keys, 2)
+
+	t.Setenv("TEST_KEYRING", "b=c2hvcnQ=")
+	_, err = KeyringFromEnv("TEST_KEYRING")
+	assert.NotNil(t, err)
+}
@@ -2,14 +2,38 @@ package http
 
 import (
 	"bytes"
-	"crypto/sha256"
+	"context"
+	"crypto/subtle"
 	"encoding/base64"
-	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"runtime"
 	"strings"
+	"sync"
+	"time"
+
+	"github.com/9spokes/go/crypto"
+)
+
+var (
+	// unknownClientHash is verified against when the client ID is not found, with the same parameters as the
+	// hashes produced by crypto.HashCredentials so that unknown and known clients take as long
+	unknownClientHash   string
+	unknownClientHashMu sync.Mutex
+
+	// verifySlots caps the number of client secrets verified at once, each argon2id verification with the default
+	// parameters taking 64 MiB
+	verifySlots = make(chan struct{}, runtime.GOMAXPROCS(0))
+
+	// VerifyWait is how long ValidateBasicAuthCreds waits for its turn to verify a client secret
+	VerifyWait = 5 * time.Second
+
+	// ErrBusy is returned when a client secret could not be verified in time because too many were being verified
+	// at once, which should be answered with StatusServiceUnavailable
+	ErrBusy = errors.New("too many client secrets being verified")
 )
 
 const (
@@ -197,9 +221,20 @@ func (request Request) http() (*Response, error) {
 }
 
 // ValidateBasicAuthCreds parses an HTTP Basic authoriation header and validates the credentials contained therein against
-// a the map of credentials supplied as the second argument
+// a the map of credentials supplied as the second argument, whose secrets are hashed with argon2id or bcrypt (see
+// crypto.HashCredentials) or, for older credential files, an unsalted hex SHA-256
 // Returns the client ID (username) that matched on success or empty string if no match.  Returns an error if the parsing failed
+//
+// Verifying an argon2id secret with crypto.DefaultArgon2Params takes 64 MiB and tens of milliseconds, so at most
+// GOMAXPROCS secrets are verified at once, other requests waiting their turn for up to VerifyWait before ErrBusy is
+// returned.  Unknown client IDs are verified against a dummy argon2id hash so that they cannot be told apart by timing.
 func ValidateBasicAuthCreds(header string, creds map[string]string) (string, error) {
+	return ValidateBasicAuthCredsContext(context.Background(), header, creds)
+}
+
+// ValidateBasicAuthCredsContext is ValidateBasicAuthCreds giving up waiting for its turn with ErrBusy once ctx, such
+// as the context of the request, is done
+func ValidateBasicAuthCredsContext(ctx context.Context, header string, creds map[string]string) (string, error) {
 
 	if header == "" {
 		return "", fmt.Errorf("authorization header missing")
@@ -223,15 +258,59 @@ func ValidateBasicAuthCreds(header string, creds map[string]string) (string, err
 		return "", fmt.Errorf("malformed authorization header: %s", fields[1])
 	}
 
-	h := sha256.New()
-	h.Write([]byte(val[1]))
-	hashed := hex.EncodeToString(h.Sum(nil))
+	// Go through the whole map so that the time taken does not depend on the position of the client ID
+	var id, hash string
+	for k, v := range creds {
+		if subtle.ConstantTimeCompare([]byte(strings.ToLower(k)), []byte(strings.ToLower(val[0]))) == 1 {
+			id, hash = k, v
+		}
+	}
+
+	wait := time.NewTimer(VerifyWait)
+	defer wait.Stop()
+
+	select {
+	case verifySlots <- struct{}{}:
+		defer func() { <-verifySlots }()
+	case <-ctx.Done():
+		return "", fmt.Errorf("%w: %s", ErrBusy, ctx.Err().Error())
+	case <-wait.C:
+		return "", ErrBusy
+	}
+
+	if id == "" {
+		unknown, err := unknownClient()
+		if err != nil {
+			return "", fmt.Errorf("unable to verify the secret of an unknown client: %s", err.Error())
+		}
+		crypto.VerifyPassword(val[1], unknown)
+		return "", fmt.Errorf("invalid client_id/client_secret combination")
+	}
+
+	ok, err := crypto.VerifyPassword(val[1], hash)
+	if err != nil {
+		return "", fmt.Errorf("unable to verify the secret of %s: %s", id, err.Error())
+	}
+	if !ok {
+		return "", fmt.Errorf("invalid client_id/client_secret combination")
+	}
+
+	return id, nil
+}
+
+// unknownClient returns the hash unknown client IDs are verified against, hashing it on first use
+func unknownClient() (string, error) {
+
+	unknownClientHashMu.Lock()
+	defer unknownClientHashMu.Unlock()
 
-	for id, secret := range creds {
-		if strings.ToLower(id) == strings.ToLower(val[0]) && secret == hashed {
-			return id, nil
+	if unknownClientHash == "" {
+		hash, err := crypto.HashPassword("unknown client")
+		if err != nil {
+			return "", err
 		}
+		unknownClientHash = hash
 	}
 
-	return "", fmt.Errorf("invalid client_id/client_secret combination")
+	return unknownClientHash, nil
 }
@@ -0,0 +1,80 @@
+package http
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/9spokes/go/crypto"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateBasicAuthCreds(t *testing.T) {
+
+	hash, err := crypto.HashBcrypt("s3cret", 4)
+	assert.Nil(t, err)
+
+	creds := map[string]string{
+		"Portal": hash,
+		"legacy": "2bb80d537b1da3e38bd30361aa855686bde0eacd7162fef6a25fe97bf527a25b", // SHA-256 of "secret"
+	}
+
+	basic := func(id, secret string) string {
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(id+":"+secret))
+	}
+
+	id, err := ValidateBasicAuthCreds(basic("portal", "s3cret"), creds)
+	assert.Nil(t, err)
+	assert.Equal(t, "Portal", id)
+
+	id, err = ValidateBasicAuthCreds(basic("legacy", "secret"), creds)
+	assert.Nil(t, err)
+	assert.Equal(t, "legacy", id)
+
+	_, err = ValidateBasicAuthCreds(basic("portal", "wrong"), creds)
+	assert.NotNil(t, err)
+	_, err = ValidateBasicAuthCreds(basic("unknown", "s3cret"), creds)
+	assert.NotNil(t, err)
+}
+
+func TestValidateBasicAuthCredsTiming(t *testing.T) {
+
+	hash, err := crypto.HashPassword("s3cret")
+	assert.Nil(t, err)
+	creds := map[string]string{"portal": hash}
+
+	basic := base64.StdEncoding.EncodeToString([]byte("unknown:s3cret"))
+	ValidateBasicAuthCreds("Basic "+basic, creds)
+
+	// Unknown clients are verified against a hash with the same parameters as known ones
+	p := crypto.DefaultArgon2Params
+	assert.True(t, strings.HasPrefix(unknownClientHash, fmt.Sprintf("$argon2id$v=19$m=%d,t=%d,p=%d$", p.Memory, p.Passes, p.Threads)))
+}
+
+func TestValidateBasicAuthCredsBusy(t *testing.T) {
+
+	// Every verification slot is taken
+	for i := 0; i < cap(verifySlots); i++ {
+		verifySlots <- struct{}{}
+	}
+	defer func() {
+		for i := 0; i < cap(verifySlots); i++ {
+			<-verifySlots
+		}
+	}()
+
+	basic := "Basic " + base64.StdEncoding.EncodeToString([]byte("portal:s3cret"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err := ValidateBasicAuthCredsContext(ctx, basic, map[string]string{})
+	assert.ErrorIs(t, err, ErrBusy)
+
+	defer func(wait time.Duration) { VerifyWait = wait }(VerifyWait)
+	VerifyWait = 20 * time.Millisecond
+	_, err = ValidateBasicAuthCreds(basic, map[string]string{})
+	assert.ErrorIs(t, err, ErrBusy)
+}
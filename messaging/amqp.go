@@ -1,101 +1,407 @@
 package messaging
 
 import (
+	"errors"
 	"fmt"
 	"strconv"
+	"sync"
+	"time"
 
+	"github.com/9spokes/go/logging/v3"
+	"github.com/9spokes/go/middleware/recoverer"
 	"github.com/streadway/amqp"
 )
 
-// AMQP is an AMQP structure
+const (
+	// DefaultConfirmTimeout is how long SendMessage waits for a publisher confirm unless configured otherwise
+	DefaultConfirmTimeout = 10 * time.Second
+	// DefaultMinBackoff is the initial delay between reconnection attempts unless configured otherwise
+	DefaultMinBackoff = time.Second
+	// DefaultMaxBackoff is the maximum delay between reconnection attempts unless configured otherwise
+	DefaultMaxBackoff = 30 * time.Second
+)
+
+// ErrNotConnected is returned when a message is sent while the transport is not connected to the broker
+var ErrNotConnected = errors.New("not connected to the message broker")
+
+// errClosed is returned when a connection is established after the transport was closed
+var errClosed = errors.New("transport closed")
+
+// AMQP is an AMQP structure.  Once connected, it watches the connection and transparently reconnects with
+// exponential backoff, re-declaring the exchanges and queues it declared and resuming the consumers started with
+// Receive.  The Connection and Channel fields are replaced on every reconnection, and nil while reconnecting.
 type AMQP struct {
 	Connection *amqp.Connection
 	Channel    *amqp.Channel
+
+	Confirm        bool          // Whether SendMessage waits for the broker to acknowledge each message
+	ConfirmTimeout time.Duration // How long SendMessage waits for an acknowledgement, defaults to DefaultConfirmTimeout
+	MinBackoff     time.Duration // Initial delay between reconnection attempts, defaults to DefaultMinBackoff
+	MaxBackoff     time.Duration // Maximum delay between reconnection attempts, defaults to DefaultMaxBackoff
+	DirectReplyTo  bool          // Whether Call receives replies through RabbitMQ direct reply-to rather than a reply queue
+
+	url       string
+	mu        sync.Mutex
+	exchanges []ExchangeOptions
+	queues    []queueDeclaration
+	consumers []*amqpConsumer
+	replies   *rpcReplies
+	seq       uint64
+	confirmMu sync.Mutex // Guards pending, so that confirms are dispatched while a publish holds mu
+	pending   map[uint64]chan bool
+	done      chan struct{}
+	closed    bool
+	wg        sync.WaitGroup
+
+	publish func(key string, message Message, opts PublishOptions) error // Replaces Publish in tests
+}
+
+// queueDeclaration records a queue declared through DeclareQueue so that it can be re-declared on reconnection
+type queueDeclaration struct {
+	name string
+	opts QueueOptions
+}
+
+// amqpConsumer records a consumer started through Receive so that it can be resumed on reconnection
+type amqpConsumer struct {
+	queue string
+	opts  ConsumeOptions
+	out   chan Message
 }
 
 // Connect is an AMQP connection convenience function
 func (_amqp *AMQP) Connect(url string) error {
+
+	_amqp.mu.Lock()
+	_amqp.url = url
+	_amqp.done = make(chan struct{})
+	_amqp.closed = false
+	_amqp.mu.Unlock()
+
+	return _amqp.connect(url)
+}
+
+// Close closes the connection to the broker, stops reconnecting and closes the channels returned by ReceiveMessages
+func (_amqp *AMQP) Close() error {
+
+	_amqp.mu.Lock()
+	if _amqp.closed {
+		_amqp.mu.Unlock()
+		return nil
+	}
+	_amqp.closed = true
+	if _amqp.done != nil {
+		close(_amqp.done)
+	}
+	_amqp.failPending()
+
+	var err error
+	if _amqp.Connection != nil {
+		err = _amqp.Connection.Close()
+	}
+	_amqp.mu.Unlock()
+
+	_amqp.wg.Wait()
+
+	_amqp.mu.Lock()
+	for _, c := range _amqp.consumers {
+		close(c.out)
+	}
+	_amqp.mu.Unlock()
+
+	return err
+}
+
+// connect dials the broker and opens a channel, then restores queues and consumers, swaps in the new connection and
+// starts watching it.  Only the latter steps hold _amqp.mu, so that sends fail fast while the broker is unreachable.
+// The caller must not hold _amqp.mu.
+func (_amqp *AMQP) connect(url string) error {
+
 	conn, err := amqp.Dial(url)
 	if err != nil {
 		return err
 	}
-	_amqp.Connection = conn
 
 	ch, err := conn.Channel()
 	if err != nil {
+		conn.Close()
 		return err
 	}
+
+	var confirms chan amqp.Confirmation
+	if _amqp.Confirm {
+		if err := ch.Confirm(false); err != nil {
+			conn.Close()
+			return fmt.Errorf("failed to enable publisher confirms: %s", err.Error())
+		}
+		confirms = ch.NotifyPublish(make(chan amqp.Confirmation, 128))
+	}
+
+	_amqp.mu.Lock()
+	defer _amqp.mu.Unlock()
+
+	if _amqp.closed {
+		conn.Close()
+		return errClosed
+	}
+
+	for _, e := range _amqp.exchanges {
+		if err := declareExchange(ch, e); err != nil {
+			conn.Close()
+			return fmt.Errorf("failed to re-declare exchange %s: %s", e.Name, err.Error())
+		}
+	}
+
+	for _, q := range _amqp.queues {
+		if err := declareQueue(ch, q.name, q.opts); err != nil {
+			conn.Close()
+			return fmt.Errorf("failed to re-declare queue %s: %s", q.name, err.Error())
+		}
+	}
+
+	for _, c := range _amqp.consumers {
+		if err := _amqp.consume(ch, c); err != nil {
+			conn.Close()
+			return fmt.Errorf("failed to resume consuming from queue %s: %s", c.queue, err.Error())
+		}
+	}
+
+	if confirms != nil {
+		_amqp.seq = 0
+		pending := make(map[uint64]chan bool)
+		_amqp.confirmMu.Lock()
+		_amqp.pending = pending
+		_amqp.confirmMu.Unlock()
+		go _amqp.dispatchConfirms(confirms, pending)
+	}
+
+	_amqp.Connection = conn
 	_amqp.Channel = ch
 
+	go _amqp.watch(conn.NotifyClose(make(chan *amqp.Error, 1)), ch.NotifyClose(make(chan *amqp.Error, 1)), _amqp.done)
+
 	return nil
 }
 
-// SendMessage is an AMQP convenience method to send a message to a given queue name
+// watch waits for the connection or channel to close and reconnects unless it was closed on purpose
+func (_amqp *AMQP) watch(connClosed, chClosed chan *amqp.Error, done chan struct{}) {
+
+	defer recoverer.RecoverGoroutinePanic("AMQP connection watcher", nil, nil)
+
+	var reason *amqp.Error
+	select {
+	case reason = <-connClosed:
+	case reason = <-chClosed:
+	case <-done:
+		return
+	}
+
+	if reason == nil {
+		// Closed by the application
+		return
+	}
+
+	logging.Warningf("AMQP connection lost, reconnecting: %s", reason.Error())
+
+	minBackoff, maxBackoff := _amqp.MinBackoff, _amqp.MaxBackoff
+	if minBackoff == 0 {
+		minBackoff = DefaultMinBackoff
+	}
+	if maxBackoff == 0 {
+		maxBackoff = DefaultMaxBackoff
+	}
+
+	for backoff := minBackoff; ; {
+
+		_amqp.mu.Lock()
+		if _amqp.closed {
+			_amqp.mu.Unlock()
+			return
+		}
+		_amqp.failPending()
+		lost := _amqp.Connection
+		_amqp.Connection, _amqp.Channel = nil, nil
+		url := _amqp.url
+		_amqp.mu.Unlock()
+
+		if lost != nil {
+			lost.Close()
+		}
+
+		err := _amqp.connect(url)
+		if err == nil {
+			logging.Infof("AMQP connection re-established")
+			return
+		}
+		if err == errClosed {
+			return
+		}
+
+		logging.Warningf("Failed to reconnect to AMQP broker, retrying in %s: %s", backoff, err.Error())
+
+		select {
+		case <-time.After(backoff):
+		case <-done:
+			return
+		}
+
+		if backoff *= 2; backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// dispatchConfirms hands broker acknowledgements over to the SendMessage calls waiting for them.  It only takes
+// _amqp.confirmMu, as a publish holds _amqp.mu until the channel accepts the message, which may wait for the
+// confirms to be drained.
+func (_amqp *AMQP) dispatchConfirms(confirms chan amqp.Confirmation, pending map[uint64]chan bool) {
+
+	defer recoverer.RecoverGoroutinePanic("AMQP confirm dispatcher", nil, nil)
+
+	for confirm := range confirms {
+		_amqp.confirmMu.Lock()
+		if ch, ok := pending[confirm.DeliveryTag]; ok {
+			ch <- confirm.Ack
+			delete(pending, confirm.DeliveryTag)
+		}
+		_amqp.confirmMu.Unlock()
+	}
+}
+
+// failPending releases the SendMessage calls still waiting for an acknowledgement on a lost channel
+func (_amqp *AMQP) failPending() {
+
+	_amqp.confirmMu.Lock()
+	defer _amqp.confirmMu.Unlock()
+
+	for tag, ch := range _amqp.pending {
+		close(ch)
+		delete(_amqp.pending, tag)
+	}
+}
+
+// consume starts delivering messages for c from the given channel.  The caller must hold _amqp.mu.
+func (_amqp *AMQP) consume(ch *amqp.Channel, c *amqpConsumer) error {
+
+	deliveries, err := ch.Consume(c.queue, c.opts.Consumer, c.opts.AutoAck, c.opts.Exclusive, c.opts.NoLocal, c.opts.NoWait, c.opts.Args)
+	if err != nil {
+		return err
+	}
+
+	done := _amqp.done
+
+	_amqp.wg.Add(1)
+	go func() {
+		defer _amqp.wg.Done()
+		defer recoverer.RecoverGoroutinePanic("AMQP consumer "+c.queue, nil, nil)
+
+		for message := range deliveries {
+			select {
+			case c.out <- toMessage(message):
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return nil
+}
+
+// SendMessage is an AMQP convenience method to send a message to a given queue name.  The message options are
+// converted with PublishOptionsFromMap.
 func (_amqp *AMQP) SendMessage(queue string, message Message) error {
 
-	var exchange string
-	var mandatory, immediate bool
-	var priority uint8
-	var expiration string
+	opts, err := PublishOptionsFromMap(message.Options)
+	if err != nil {
+		return fmt.Errorf("Failed to send message: %s", err.Error())
+	}
 
-	if message.Options == nil {
-		message.Options = make(map[string]interface{})
+	return _amqp.Publish(queue, message, opts)
+}
+
+// Publish sends a message with the given routing key, which is the queue name when using the default exchange.  The
+// options of the message itself are ignored.  If publisher confirms are enabled, it only returns once the broker
+// has acknowledged the message.
+func (_amqp *AMQP) Publish(key string, message Message, opts PublishOptions) error {
+
+	if err := opts.validate(); err != nil {
+		return fmt.Errorf("Failed to send message: %s", err.Error())
 	}
 
-	if _, ok := message.Options["exchange"]; ok {
-		exchange = message.Options["exchange"].(string)
-		delete(message.Options, "exchange")
-	} else {
-		exchange = ""
+	publishing := amqp.Publishing{
+		ContentType:   opts.ContentType,
+		Body:          message.Body,
+		MessageId:     message.ID,
+		CorrelationId: message.CorrelationID,
+		ReplyTo:       opts.ReplyTo,
+		Headers:       opts.Headers,
+		Priority:      opts.Priority,
 	}
 
-	if _, ok := message.Options["mandatory"]; ok {
-		mandatory = message.Options["mandatory"].(bool)
-		delete(message.Options, "mandatory")
-	} else {
-		mandatory = false
+	if publishing.ContentType == "" {
+		publishing.ContentType = "application/json"
 	}
 
-	if _, ok := message.Options["immediate"]; ok {
-		immediate = message.Options["immediate"].(bool)
-		delete(message.Options, "immediate")
-	} else {
-		immediate = false
+	if opts.TTL > 0 {
+		publishing.Expiration = strconv.FormatInt(opts.TTL.Milliseconds(), 10)
 	}
 
-	if _, ok := message.Options["priority"]; ok {
-		priority = message.Options["priority"].(uint8)
-		delete(message.Options, "priority")
-	} else {
-		priority = 0
+	_amqp.mu.Lock()
+
+	if _amqp.Channel == nil || _amqp.closed {
+		_amqp.mu.Unlock()
+		return ErrNotConnected
 	}
 
-	if _, ok := message.Options["x-message-ttl"]; ok {
-		expiration = strconv.FormatInt(message.Options["x-message-ttl"].(int64), 10)
-		delete(message.Options, "x-message-ttl")
-	} else {
-		expiration = ""
+	var confirm chan bool
+	if _amqp.Confirm {
+		_amqp.seq++
+		confirm = make(chan bool, 1)
+		_amqp.confirmMu.Lock()
+		_amqp.pending[_amqp.seq] = confirm
+		_amqp.confirmMu.Unlock()
 	}
 
 	err := _amqp.Channel.Publish(
-		exchange,  // exchange
-		queue,     // routing key
-		mandatory, // mandatory
-		immediate, // immediate
-		amqp.Publishing{
-			ContentType:   "application/json",
-			Body:          message.Body,
-			CorrelationId: message.CorrelationID,
-			Headers:       message.Options,
-			Priority:      priority,
-			Expiration:    expiration,
-		},
+		opts.Exchange,  // exchange
+		key,            // routing key
+		opts.Mandatory, // mandatory
+		opts.Immediate, // immediate
+		publishing,
 	)
+	if err != nil && confirm != nil {
+		_amqp.confirmMu.Lock()
+		delete(_amqp.pending, _amqp.seq)
+		_amqp.confirmMu.Unlock()
+	}
+
+	_amqp.mu.Unlock()
+
 	if err != nil {
 		return fmt.Errorf("Failed to send message: %s", err.Error())
 	}
 
-	return nil
+	if confirm == nil {
+		return nil
+	}
+
+	timeout := _amqp.ConfirmTimeout
+	if timeout == 0 {
+		timeout = DefaultConfirmTimeout
+	}
+
+	select {
+	case ack, ok := <-confirm:
+		if !ok {
+			return fmt.Errorf("Failed to send message: connection lost before the broker confirmed it")
+		}
+		if !ack {
+			return fmt.Errorf("Failed to send message: rejected by the broker")
+		}
+		return nil
+	case <-time.After(timeout):
+		return fmt.Errorf("Failed to send message: timed out after %s waiting for the broker to confirm it", timeout)
+	}
 }
 
 // DeleteMessage is an AMQP convenience method which does nothing, as AMQP does not support message deletion
@@ -105,122 +411,117 @@ func (_amqp *AMQP) DeleteMessage(id string) error {
 
 }
 
-// CreateQueue creates a new message with the given name and attributes
+// CreateQueue creates a new message with the given name and attributes, which are converted with
+// QueueOptionsFromMap
 func (_amqp *AMQP) CreateQueue(name string, attributes map[string]interface{}) error {
 
-	var durable, del, exclusive, noWait bool
-
-	if _, ok := attributes["durable"]; ok {
-		durable = attributes["durable"].(bool)
-		delete(attributes, "durable")
-	} else {
-		durable = true
+	opts, err := QueueOptionsFromMap(attributes)
+	if err != nil {
+		return fmt.Errorf("failed to declare queue %s: %s", name, err.Error())
 	}
 
-	if _, ok := attributes["delete"]; ok {
-		del = attributes["delete"].(bool)
-		delete(attributes, "delete")
-	} else {
-		del = false
-	}
+	return _amqp.DeclareQueue(name, opts)
+}
 
-	if _, ok := attributes["exclusive"]; ok {
-		exclusive = attributes["exclusive"].(bool)
-		delete(attributes, "exclusive")
-	} else {
-		exclusive = false
-	}
+// DeclareQueue declares a queue and its bindings.  The declaration is repeated on reconnection.
+func (_amqp *AMQP) DeclareQueue(name string, opts QueueOptions) error {
+
+	_amqp.mu.Lock()
+	defer _amqp.mu.Unlock()
 
-	if _, ok := attributes["no-wait"]; ok {
-		noWait = attributes["no-wait"].(bool)
-		delete(attributes, "no-wait")
-	} else {
-		noWait = false
+	if _amqp.Channel == nil || _amqp.closed {
+		return ErrNotConnected
 	}
 
-	_, err := _amqp.Channel.QueueDeclare(
-		name,       // name
-		durable,    // durable
-		del,        // delete when unused
-		exclusive,  // exclusive
-		noWait,     // no-wait
-		attributes, // arguments
-	)
+	if err := declareQueue(_amqp.Channel, name, opts); err != nil {
+		return err
+	}
 
-	return err
+	_amqp.queues = append(_amqp.queues, queueDeclaration{name: name, opts: opts})
 
+	return nil
 }
 
-// ReceiveMessages is an AMQP convenience method to receive messages from a given queue
-func (_amqp *AMQP) ReceiveMessages(queue string, opt map[string]interface{}) (<-chan Message, error) {
+// DeclareExchange declares an exchange.  The declaration is repeated on reconnection.
+func (_amqp *AMQP) DeclareExchange(opts ExchangeOptions) error {
 
-	var consumer string
-	var autoAck, exclusive, noLocal, noWait bool
-
-	if _, ok := opt["consumer"]; ok {
-		consumer = opt["consumer"].(string)
-		delete(opt, "consumer")
-	} else {
-		consumer = ""
+	if err := opts.validate(); err != nil {
+		return err
 	}
 
-	if _, ok := opt["auto-ack"]; ok {
-		autoAck = opt["auto-ack"].(bool)
-		delete(opt, "auto-ack")
-	} else {
-		autoAck = false
+	_amqp.mu.Lock()
+	defer _amqp.mu.Unlock()
+
+	if _amqp.Channel == nil || _amqp.closed {
+		return ErrNotConnected
 	}
 
-	if _, ok := opt["exclusive"]; ok {
-		exclusive = opt["exclusive"].(bool)
-		delete(opt, "exclusive")
-	} else {
-		exclusive = false
+	if err := declareExchange(_amqp.Channel, opts); err != nil {
+		return err
 	}
 
-	if _, ok := opt["no-local"]; ok {
-		noLocal = opt["no-local"].(bool)
-		delete(opt, "no-local")
-	} else {
-		noLocal = true
+	_amqp.exchanges = append(_amqp.exchanges, opts)
+
+	return nil
+}
+
+func declareQueue(ch *amqp.Channel, name string, opts QueueOptions) error {
+
+	_, err := ch.QueueDeclare(
+		name,            // name
+		opts.Durable,    // durable
+		opts.AutoDelete, // delete when unused
+		opts.Exclusive,  // exclusive
+		opts.NoWait,     // no-wait
+		opts.Args,       // arguments
+	)
+	if err != nil {
+		return err
 	}
 
-	if _, ok := opt["no-wait"]; ok {
-		noWait = opt["no-wait"].(bool)
-		delete(opt, "no-wait")
-	} else {
-		noWait = false
+	for _, b := range opts.Bindings {
+		if err := ch.QueueBind(name, b.RoutingKey, b.Exchange, opts.NoWait, b.Args); err != nil {
+			return fmt.Errorf("failed to bind queue %s to exchange %s: %s", name, b.Exchange, err.Error())
+		}
 	}
 
-	output, err := _amqp.Channel.Consume(
-		queue,     // queue
-		consumer,  // consumer
-		autoAck,   // auto-ack
-		exclusive, // exclusive
-		noLocal,   // no-local
-		noWait,    // no-wait
-		opt,       // args
-	)
+	return nil
+}
+
+func declareExchange(ch *amqp.Channel, opts ExchangeOptions) error {
+	return ch.ExchangeDeclare(opts.Name, opts.Kind, opts.Durable, opts.AutoDelete, opts.Internal, opts.NoWait, opts.Args)
+}
+
+// ReceiveMessages is an AMQP convenience method to receive messages from a given queue, with options converted by
+// ConsumeOptionsFromMap
+func (_amqp *AMQP) ReceiveMessages(queue string, opt map[string]interface{}) (<-chan Message, error) {
 
+	opts, err := ConsumeOptionsFromMap(opt)
 	if err != nil {
 		return nil, err
 	}
 
-	ret := make(chan Message)
-	go func() {
-		opt := make(map[string]interface{})
+	return _amqp.Receive(queue, opts)
+}
 
-		for message := range output {
-			opt["timestamp"] = message.Timestamp
-			opt["priority"] = message.Priority
-			opt["messageCount"] = message.MessageCount
-			opt["exchange"] = message.Exchange
-			opt["routingKey"] = message.RoutingKey
-			opt["redelivered"] = message.Redelivered
+// Receive starts consuming messages from a queue and returns the channel they are delivered on.  Only the Consumer,
+// Exclusive, AutoAck, NoLocal, NoWait and Args options apply.  The channel is closed by Close.
+func (_amqp *AMQP) Receive(queue string, opts ConsumeOptions) (<-chan Message, error) {
 
-			ret <- Message{ID: message.MessageId, CorrelationID: message.CorrelationId, Body: message.Body, Options: opt}
-		}
-	}()
+	c := &amqpConsumer{queue: queue, opts: opts, out: make(chan Message)}
+
+	_amqp.mu.Lock()
+	defer _amqp.mu.Unlock()
+
+	if _amqp.Channel == nil || _amqp.closed {
+		return nil, ErrNotConnected
+	}
+
+	if err := _amqp.consume(_amqp.Channel, c); err != nil {
+		return nil, err
+	}
+
+	_amqp.consumers = append(_amqp.consumers, c)
 
-	return ret, nil
+	return c.out, nil
 }
@@ -0,0 +1,41 @@
+package messaging
+
+import (
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDispatchConfirms(t *testing.T) {
+
+	a := &AMQP{pending: make(map[uint64]chan bool)}
+	acked, nacked, lost := make(chan bool, 1), make(chan bool, 1), make(chan bool, 1)
+	a.pending[1], a.pending[2], a.pending[3] = acked, nacked, lost
+
+	confirms := make(chan amqp.Confirmation)
+	go a.dispatchConfirms(confirms, a.pending)
+
+	// A publish blocked on the network holds mu, which must not stop confirms from being dispatched
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for _, c := range []amqp.Confirmation{{DeliveryTag: 1, Ack: true}, {DeliveryTag: 2}} {
+		select {
+		case confirms <- c:
+		case <-time.After(time.Second):
+			t.Fatal("confirm dispatcher is blocked")
+		}
+	}
+
+	assert.True(t, <-acked)
+	assert.False(t, <-nacked)
+
+	a.failPending()
+	_, ok := <-lost
+	assert.False(t, ok)
+	assert.Empty(t, a.pending)
+
+	close(confirms)
+}
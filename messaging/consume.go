@@ -0,0 +1,256 @@
+package messaging
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/9spokes/go/logging/v3"
+	"github.com/9spokes/go/middleware/recoverer"
+	"github.com/streadway/amqp"
+)
+
+// Outcome tells the broker what to do with a message once it has been handled
+type Outcome int
+
+const (
+	// Ack acknowledges the message, removing it from the queue
+	Ack Outcome = iota
+	// Nack negatively acknowledges the message without requeueing it, dead-lettering it if the queue is configured
+	// with a dead-letter exchange
+	Nack
+	// Requeue negatively acknowledges the message and returns it to the queue for redelivery
+	Requeue
+	// Reject rejects the message without requeueing it, dead-lettering it like Nack
+	Reject
+)
+
+func (o Outcome) String() string {
+	switch o {
+	case Ack:
+		return "ack"
+	case Nack:
+		return "nack"
+	case Requeue:
+		return "requeue"
+	case Reject:
+		return "reject"
+	}
+	return fmt.Sprintf("Outcome(%d)", int(o))
+}
+
+// Handler processes a message delivered by Consume and returns what should be done with it
+type Handler func(ctx context.Context, msg Message) Outcome
+
+// ConsumeOptions configures Consume and Receive
+type ConsumeOptions struct {
+	Workers   int                    // Number of messages handled concurrently by Consume, defaults to 1
+	Prefetch  int                    // Number of unacknowledged messages delivered ahead of the workers, defaults to Workers
+	Consumer  string                 // Consumer tag, generated by the broker if empty
+	Exclusive bool                   // Whether this must be the only consumer of the queue
+	AutoAck   bool                   // Whether messages are acknowledged on delivery, only used by Receive
+	NoLocal   bool                   // Whether to skip messages published on the same connection, only used by Receive
+	NoWait    bool                   // Whether to skip waiting for the broker to confirm the consumer, only used by Receive
+	Args      map[string]interface{} // Additional broker-specific arguments
+}
+
+// Consumer is implemented by transports supporting explicit acknowledgement of messages by a pool of workers
+type Consumer interface {
+	Consume(ctx context.Context, queue string, handler Handler, opts ConsumeOptions) error
+}
+
+// Consume delivers messages from queue to handler on a pool of workers until ctx is cancelled, at which point it
+// stops receiving, waits for the messages being handled to complete and returns.  Messages prefetched but not yet
+// handled are returned to the queue.  Consumption resumes automatically after a reconnection, retrying with
+// exponential backoff while the connection is down.  An error is returned if the transport is closed or if the broker
+// refuses the consumer, eg: because the queue does not exist or is used by an exclusive consumer.
+//
+// A handler that panics is treated as returning Requeue the first time a message is delivered and Reject when it
+// is redelivered, so that a message that cannot be processed does not loop forever.
+func (_amqp *AMQP) Consume(ctx context.Context, queue string, handler Handler, opts ConsumeOptions) error {
+
+	if opts.Workers <= 0 {
+		opts.Workers = 1
+	}
+	if opts.Prefetch <= 0 {
+		opts.Prefetch = opts.Workers
+	}
+
+	minBackoff, maxBackoff := _amqp.MinBackoff, _amqp.MaxBackoff
+	if minBackoff == 0 {
+		minBackoff = DefaultMinBackoff
+	}
+	if maxBackoff == 0 {
+		maxBackoff = DefaultMaxBackoff
+	}
+
+	for backoff := minBackoff; ; {
+		ch, chClosed, deliveries, err := _amqp.openConsumer(queue, opts)
+		if err != nil {
+			if err == errClosed || refused(err) {
+				logging.Errorf("[%s] Failed to start consuming: %s", queue, err.Error())
+				return fmt.Errorf("failed to consume from queue %s: %s", queue, err.Error())
+			}
+			if err != ErrNotConnected {
+				logging.Warningf("[%s] Failed to start consuming, retrying in %s: %s", queue, backoff, err.Error())
+			}
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(backoff):
+			}
+			if backoff *= 2; backoff > maxBackoff {
+				backoff = maxBackoff
+			}
+			continue
+		}
+		backoff = minBackoff
+
+		logging.Debugf("[%s] Consuming with %d workers", queue, opts.Workers)
+
+		var wg sync.WaitGroup
+		for i := 0; i < opts.Workers; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for {
+					select {
+					case <-ctx.Done():
+						return
+					case d, ok := <-deliveries:
+						if !ok {
+							return
+						}
+						if ctx.Err() != nil {
+							// Left unacknowledged, returned to the queue when the channel closes
+							return
+						}
+						settle(ctx, queue, d, handler)
+					}
+				}
+			}()
+		}
+
+		wg.Wait()
+		ch.Close()
+
+		if ctx.Err() != nil {
+			logging.Debugf("[%s] Stopped consuming", queue)
+			return nil
+		}
+
+		// The broker closes the channel if the queue is deleted while consuming from it
+		select {
+		case reason, ok := <-chClosed:
+			if ok && refused(reason) {
+				logging.Errorf("[%s] Consumer cancelled by the broker: %s", queue, reason.Error())
+				return fmt.Errorf("failed to consume from queue %s: %s", queue, reason.Error())
+			}
+		default:
+		}
+
+		logging.Warningf("[%s] Delivery channel closed, resuming consumption", queue)
+	}
+}
+
+// openConsumer opens a dedicated channel so that the prefetch limit only applies to this consumer.  The reason the
+// channel is closed for is sent on the returned channel.
+func (_amqp *AMQP) openConsumer(queue string, opts ConsumeOptions) (*amqp.Channel, chan *amqp.Error, <-chan amqp.Delivery, error) {
+
+	_amqp.mu.Lock()
+	conn := _amqp.Connection
+	stopped := _amqp.closed
+	_amqp.mu.Unlock()
+
+	if stopped {
+		return nil, nil, nil, errClosed
+	}
+	if conn == nil || conn.IsClosed() {
+		return nil, nil, nil, ErrNotConnected
+	}
+
+	ch, err := conn.Channel()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	closed := ch.NotifyClose(make(chan *amqp.Error, 1))
+
+	if err := ch.Qos(opts.Prefetch, 0, false); err != nil {
+		ch.Close()
+		return nil, nil, nil, fmt.Errorf("failed to set prefetch count: %s", err.Error())
+	}
+
+	deliveries, err := ch.Consume(queue, opts.Consumer, false, opts.Exclusive, false, false, opts.Args)
+	if err != nil {
+		ch.Close()
+		return nil, nil, nil, err
+	}
+
+	return ch, closed, deliveries, nil
+}
+
+// refused reports whether the broker refused to open a consumer for a reason that retrying will not fix
+func refused(err error) bool {
+
+	e, ok := err.(*amqp.Error)
+	if !ok {
+		return false
+	}
+
+	switch e.Code {
+	case amqp.AccessRefused, amqp.NotFound, amqp.ResourceLocked, amqp.PreconditionFailed:
+		return true
+	}
+	return false
+}
+
+// settle runs the handler on a delivery and reports its outcome to the broker
+func settle(ctx context.Context, queue string, d amqp.Delivery, handler Handler) {
+
+	outcome := Reject
+	if !d.Redelivered {
+		outcome = Requeue
+	}
+
+	func() {
+		defer recoverer.RecoverGoroutinePanic("handler for queue "+queue, nil, nil)
+		outcome = handler(ctx, toMessage(d))
+	}()
+
+	var err error
+	switch outcome {
+	case Ack:
+		err = d.Ack(false)
+	case Nack:
+		err = d.Nack(false, false)
+	case Requeue:
+		err = d.Nack(false, true)
+	default:
+		err = d.Reject(false)
+	}
+
+	if err != nil {
+		logging.Errorf("[%s] Failed to %s message %s: %s", queue, outcome, d.MessageId, err.Error())
+	}
+}
+
+// toMessage converts an AMQP delivery into a Message with its own copy of the headers and delivery metadata
+func toMessage(d amqp.Delivery) Message {
+
+	opt := make(map[string]interface{}, len(d.Headers)+7)
+	for k, v := range d.Headers {
+		opt[k] = v
+	}
+
+	opt["timestamp"] = d.Timestamp
+	opt["priority"] = d.Priority
+	opt["messageCount"] = d.MessageCount
+	opt["exchange"] = d.Exchange
+	opt["routingKey"] = d.RoutingKey
+	opt["redelivered"] = d.Redelivered
+	opt["replyTo"] = d.ReplyTo
+
+	return Message{ID: d.MessageId, CorrelationID: d.CorrelationId, Body: d.Body, Options: opt}
+}
@@ -0,0 +1,97 @@
+package messaging
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+)
+
+// acknowledger records how a delivery was settled
+type acknowledger struct {
+	settled string
+}
+
+func (a *acknowledger) Ack(tag uint64, multiple bool) error {
+	a.settled = "ack"
+	return nil
+}
+
+func (a *acknowledger) Nack(tag uint64, multiple bool, requeue bool) error {
+	if requeue {
+		a.settled = "requeue"
+	} else {
+		a.settled = "nack"
+	}
+	return nil
+}
+
+func (a *acknowledger) Reject(tag uint64, requeue bool) error {
+	a.settled = "reject"
+	return nil
+}
+
+func TestSettle(t *testing.T) {
+
+	tests := []struct {
+		Name        string
+		Handler     Handler
+		Redelivered bool
+		Expected    string
+	}{
+		{Name: "ack", Handler: func(context.Context, Message) Outcome { return Ack }, Expected: "ack"},
+		{Name: "nack", Handler: func(context.Context, Message) Outcome { return Nack }, Expected: "nack"},
+		{Name: "requeue", Handler: func(context.Context, Message) Outcome { return Requeue }, Expected: "requeue"},
+		{Name: "reject", Handler: func(context.Context, Message) Outcome { return Reject }, Expected: "reject"},
+		{Name: "panic on first delivery", Handler: func(context.Context, Message) Outcome { panic("boom") }, Expected: "requeue"},
+		{Name: "panic on redelivery", Handler: func(context.Context, Message) Outcome { panic("boom") }, Redelivered: true, Expected: "reject"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			ack := &acknowledger{}
+			settle(context.Background(), "test", amqp.Delivery{Acknowledger: ack, Redelivered: test.Redelivered}, test.Handler)
+			assert.Equal(t, test.Expected, ack.settled)
+		})
+	}
+}
+
+func TestConsumeErrors(t *testing.T) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	// Consuming from a closed transport fails rather than retrying forever
+	err := (&AMQP{closed: true}).Consume(ctx, "etl", func(context.Context, Message) Outcome { return Ack }, ConsumeOptions{})
+	assert.NotNil(t, err)
+	assert.Nil(t, ctx.Err())
+
+	assert.True(t, refused(&amqp.Error{Code: amqp.NotFound, Reason: "NOT_FOUND - no queue 'etl'"}))
+	assert.True(t, refused(&amqp.Error{Code: amqp.ResourceLocked}))
+	assert.False(t, refused(&amqp.Error{Code: amqp.ChannelError}))
+	assert.False(t, refused(ErrNotConnected))
+}
+
+func TestToMessage(t *testing.T) {
+
+	d := amqp.Delivery{
+		MessageId:     "1",
+		CorrelationId: "corr",
+		Body:          []byte("{}"),
+		Headers:       amqp.Table{"x-retry-count": int32(2)},
+		RoutingKey:    "etl",
+		Redelivered:   true,
+	}
+
+	first, second := toMessage(d), toMessage(d)
+	first.Options["mutated"] = true
+
+	assert.Equal(t, "1", second.ID)
+	assert.Equal(t, "corr", second.CorrelationID)
+	assert.Equal(t, int32(2), second.Options["x-retry-count"])
+	assert.Equal(t, "etl", second.Options["routingKey"])
+	assert.Equal(t, true, second.Options["redelivered"])
+	assert.NotContains(t, second.Options, "mutated")
+}
@@ -0,0 +1,374 @@
+package messaging
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/9spokes/go/logging/v3"
+	"github.com/9spokes/go/middleware/recoverer"
+	"github.com/9spokes/go/misc"
+	"github.com/9spokes/go/types"
+	redis "github.com/go-redis/redis/v8"
+)
+
+const (
+	// DefaultDedupTTL is how long processed message keys are remembered unless configured otherwise
+	DefaultDedupTTL = 24 * time.Hour
+	// DefaultDedupLockTTL is how long a message key stays locked unless configured otherwise, the lock being renewed
+	// while its message is handled so that it is released soon after a consumer crashes
+	DefaultDedupLockTTL = 30 * time.Second
+	// DefaultDedupInFlightDelay is how long a message being handled by another consumer is held before being
+	// requeued unless configured otherwise
+	DefaultDedupInFlightDelay = 2 * time.Second
+	// DefaultDedupPrefix is prepended to message keys in the store unless configured otherwise
+	DefaultDedupPrefix = "dedup:"
+)
+
+// ClaimState is the state of a message key when claiming it
+type ClaimState int
+
+const (
+	// Claimed means the key was free and is now locked by the caller
+	Claimed ClaimState = iota
+	// InFlight means the key is locked by another consumer handling the same message
+	InFlight
+	// Processed means a message with the same key was already handled successfully
+	Processed
+)
+
+// DedupStore records the message keys being handled and handled successfully
+type DedupStore interface {
+	// Claim locks key for ttl with the given token unless it is already locked or processed
+	Claim(ctx context.Context, key, token string, ttl time.Duration) (ClaimState, error)
+	// Complete marks a key locked with token as processed for ttl
+	Complete(ctx context.Context, key, token string, ttl time.Duration) error
+	// Release unlocks a key locked with token, so that the message can be handled again
+	Release(ctx context.Context, key, token string) error
+	// Extend renews the lock on a key locked with token for ttl, failing if the lock was lost
+	Extend(ctx context.Context, key, token string, ttl time.Duration) error
+}
+
+// Dedup skips the messages which were already handled successfully, so that handlers need not be idempotent
+// towards redeliveries.  Messages are identified by the key returned by Key, which defaults to their ID.
+type Dedup struct {
+	Store         DedupStore
+	Key           func(Message) (string, error) // Defaults to MessageIDKey
+	Prefix        string                        // Defaults to DefaultDedupPrefix
+	TTL           time.Duration                 // Defaults to DefaultDedupTTL
+	LockTTL       time.Duration                 // Defaults to DefaultDedupLockTTL, renewed every third of it while handling
+	InFlightDelay time.Duration                 // Defaults to DefaultDedupInFlightDelay, negative to requeue at once
+}
+
+// MessageIDKey identifies a message by its ID
+func MessageIDKey(msg Message) (string, error) {
+	if msg.ID == "" {
+		return "", fmt.Errorf("message has no ID")
+	}
+	return msg.ID, nil
+}
+
+// ETLMessageKey identifies a types.ETLMessage by its connection, datasource and index, so that the same extraction
+// requested twice is only run once
+func ETLMessageKey(msg Message) (string, error) {
+
+	var etl types.ETLMessage
+	if err := json.Unmarshal(msg.Body, &etl); err != nil {
+		return "", fmt.Errorf("failed to parse ETL message: %s", err.Error())
+	}
+
+	if etl.Connection == "" || etl.Datasource == "" {
+		return "", fmt.Errorf("ETL message has no connection or datasource")
+	}
+
+	return etl.Connection + ":" + etl.Datasource + ":" + etl.Index, nil
+}
+
+// Wrap returns a handler which skips the messages already handled successfully by acknowledging them, and requeues
+// those being handled by another consumer after InFlightDelay, so that the broker does not redeliver them in a tight
+// loop.  A message key is only marked as processed when h returns Ack, and unlocked otherwise so that the message
+// can be retried.  Messages whose key cannot be determined are handled without deduplication, and messages whose
+// key cannot be claimed because of a store failure are requeued.
+func (d Dedup) Wrap(h Handler) Handler {
+
+	keyFn := d.Key
+	if keyFn == nil {
+		keyFn = MessageIDKey
+	}
+
+	prefix, ttl, lockTTL, delay := d.Prefix, d.TTL, d.LockTTL, d.InFlightDelay
+	if prefix == "" {
+		prefix = DefaultDedupPrefix
+	}
+	if ttl == 0 {
+		ttl = DefaultDedupTTL
+	}
+	if lockTTL == 0 {
+		lockTTL = DefaultDedupLockTTL
+	}
+	if delay == 0 {
+		delay = DefaultDedupInFlightDelay
+	}
+
+	return func(ctx context.Context, msg Message) (outcome Outcome) {
+
+		key, err := keyFn(msg)
+		if err != nil {
+			logging.Warningf("[%s] Handling message without deduplication: %s", msg.ID, err.Error())
+			return h(ctx, msg)
+		}
+		key = prefix + key
+		token := misc.GenUUIDv4()
+
+		state, err := d.Store.Claim(ctx, key, token, lockTTL)
+		if err != nil {
+			logging.Errorf("[%s] Failed to claim message key %s, requeueing it: %s", msg.ID, key, err.Error())
+			return Requeue
+		}
+
+		switch state {
+		case Processed:
+			logging.Infof("[%s] Skipping duplicate message %s", msg.ID, key)
+			return Ack
+		case InFlight:
+			logging.Warningf("[%s] Message %s is being handled by another consumer, requeueing it", msg.ID, key)
+			if delay > 0 {
+				t := time.NewTimer(delay)
+				defer t.Stop()
+				select {
+				case <-t.C:
+				case <-ctx.Done():
+				}
+			}
+			return Requeue
+		}
+
+		renewCtx, stopRenewing := context.WithCancel(context.Background())
+		go d.renew(renewCtx, msg.ID, key, token, lockTTL)
+
+		completed := false
+		defer func() {
+			stopRenewing()
+			if completed {
+				return
+			}
+			// Also runs when h panics, the panic carrying on to the caller
+			if err := d.Store.Release(context.Background(), key, token); err != nil {
+				logging.Errorf("[%s] Failed to release message key %s: %s", msg.ID, key, err.Error())
+			}
+		}()
+
+		outcome = h(ctx, msg)
+
+		if outcome == Ack {
+			if err := d.Store.Complete(context.Background(), key, token, ttl); err != nil {
+				logging.Errorf("[%s] Failed to mark message key %s as processed: %s", msg.ID, key, err.Error())
+			} else {
+				completed = true
+			}
+		}
+
+		return outcome
+	}
+}
+
+// renew extends the lock on key every third of its TTL until ctx is cancelled
+func (d Dedup) renew(ctx context.Context, id, key, token string, ttl time.Duration) {
+
+	defer recoverer.RecoverGoroutinePanic("dedup lock renewal "+key, nil, nil)
+
+	ticker := time.NewTicker(ttl / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := d.Store.Extend(ctx, key, token, ttl); err != nil {
+				if ctx.Err() == nil {
+					logging.Errorf("[%s] Failed to renew the lock on message key %s: %s", id, key, err.Error())
+				}
+				return
+			}
+		}
+	}
+}
+
+// dedupProcessed is the value of a processed key, while locked keys hold the token of their owner
+const dedupProcessed = "processed"
+
+// RedisDedupStore is a DedupStore on Redis
+type RedisDedupStore struct {
+	Client *redis.Client
+}
+
+// releaseScript deletes a key only if it still holds the token of the caller
+var releaseScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+// extendScript renews the expiry of a key only if it still holds the token of the caller
+var extendScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+return 0
+`)
+
+// completeScript marks a key as processed only if it still holds the token of the caller, or has expired
+var completeScript = redis.NewScript(`
+local v = redis.call("GET", KEYS[1])
+if v == false or v == ARGV[1] then
+	return redis.call("SET", KEYS[1], ARGV[2], "PX", ARGV[3])
+end
+return false
+`)
+
+// Claim implements DedupStore
+func (s RedisDedupStore) Claim(ctx context.Context, key, token string, ttl time.Duration) (ClaimState, error) {
+
+	ok, err := s.Client.SetNX(ctx, key, token, ttl).Result()
+	if err != nil {
+		return 0, err
+	}
+	if ok {
+		return Claimed, nil
+	}
+
+	v, err := s.Client.Get(ctx, key).Result()
+	if err == redis.Nil {
+		// Expired in between, try again
+		return s.Claim(ctx, key, token, ttl)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	if v == dedupProcessed {
+		return Processed, nil
+	}
+
+	return InFlight, nil
+}
+
+// Complete implements DedupStore
+func (s RedisDedupStore) Complete(ctx context.Context, key, token string, ttl time.Duration) error {
+
+	err := completeScript.Run(ctx, s.Client, []string{key}, token, dedupProcessed, ttl.Milliseconds()).Err()
+	if err == redis.Nil {
+		return fmt.Errorf("lock on %s was lost to another consumer", key)
+	}
+
+	return err
+}
+
+// Release implements DedupStore
+func (s RedisDedupStore) Release(ctx context.Context, key, token string) error {
+	return releaseScript.Run(ctx, s.Client, []string{key}, token).Err()
+}
+
+// Extend implements DedupStore
+func (s RedisDedupStore) Extend(ctx context.Context, key, token string, ttl time.Duration) error {
+
+	n, err := extendScript.Run(ctx, s.Client, []string{key}, token, ttl.Milliseconds()).Int()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return fmt.Errorf("lock on %s was lost", key)
+	}
+
+	return nil
+}
+
+// MemoryDedupStore is an in-process DedupStore meant for unit tests and single-instance consumers
+type MemoryDedupStore struct {
+	mu      sync.Mutex
+	entries map[string]memoryDedupEntry
+}
+
+type memoryDedupEntry struct {
+	value   string
+	expires time.Time
+}
+
+func (s *MemoryDedupStore) get(key string) (string, bool) {
+	e, ok := s.entries[key]
+	if !ok || time.Now().After(e.expires) {
+		return "", false
+	}
+	return e.value, true
+}
+
+func (s *MemoryDedupStore) set(key, value string, ttl time.Duration) {
+	if s.entries == nil {
+		s.entries = make(map[string]memoryDedupEntry)
+	}
+	s.entries[key] = memoryDedupEntry{value: value, expires: time.Now().Add(ttl)}
+}
+
+// Claim implements DedupStore
+func (s *MemoryDedupStore) Claim(ctx context.Context, key, token string, ttl time.Duration) (ClaimState, error) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	v, ok := s.get(key)
+	if !ok {
+		s.set(key, token, ttl)
+		return Claimed, nil
+	}
+
+	if v == dedupProcessed {
+		return Processed, nil
+	}
+
+	return InFlight, nil
+}
+
+// Complete implements DedupStore
+func (s *MemoryDedupStore) Complete(ctx context.Context, key, token string, ttl time.Duration) error {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if v, ok := s.get(key); ok && v != token {
+		return fmt.Errorf("lock on %s was lost to another consumer", key)
+	}
+	s.set(key, dedupProcessed, ttl)
+
+	return nil
+}
+
+// Release implements DedupStore
+func (s *MemoryDedupStore) Release(ctx context.Context, key, token string) error {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if v, ok := s.get(key); ok && v == token {
+		delete(s.entries, key)
+	}
+
+	return nil
+}
+
+// Extend implements DedupStore
+func (s *MemoryDedupStore) Extend(ctx context.Context, key, token string, ttl time.Duration) error {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if v, ok := s.get(key); !ok || v != token {
+		return fmt.Errorf("lock on %s was lost", key)
+	}
+	s.set(key, token, ttl)
+
+	return nil
+}
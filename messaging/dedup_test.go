@@ -0,0 +1,81 @@
+package messaging
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDedup(t *testing.T) {
+
+	store := &MemoryDedupStore{}
+	calls := 0
+	outcome := Requeue
+
+	h := Dedup{Store: store, Key: ETLMessageKey, InFlightDelay: -1}.Wrap(func(ctx context.Context, msg Message) Outcome {
+		calls++
+		return outcome
+	})
+
+	extract := Message{ID: "1", Body: []byte(`{"connection":"abc","datasource":"invoices","index":"2023-01"}`)}
+	again := Message{ID: "2", Body: extract.Body}
+
+	// A failed attempt leaves the key free for the retry
+	assert.Equal(t, Requeue, h(context.Background(), extract))
+	outcome = Ack
+	assert.Equal(t, Ack, h(context.Background(), extract))
+	assert.Equal(t, 2, calls)
+
+	// The same extraction requested again is skipped
+	assert.Equal(t, Ack, h(context.Background(), again))
+	assert.Equal(t, 2, calls)
+
+	// A message being handled elsewhere is requeued
+	state, err := store.Claim(context.Background(), DefaultDedupPrefix+"abc:invoices:2023-02", "other", DefaultDedupLockTTL)
+	assert.Nil(t, err)
+	assert.Equal(t, Claimed, state)
+	assert.Equal(t, Requeue, h(context.Background(), Message{Body: []byte(`{"connection":"abc","datasource":"invoices","index":"2023-02"}`)}))
+	assert.Equal(t, 2, calls)
+
+	// Messages without a key are handled anyway
+	assert.Equal(t, Ack, h(context.Background(), Message{Body: []byte("not json")}))
+	assert.Equal(t, 3, calls)
+}
+
+func TestDedupReleasesOnPanic(t *testing.T) {
+
+	store := &MemoryDedupStore{}
+	h := Dedup{Store: store}.Wrap(func(ctx context.Context, msg Message) Outcome {
+		panic("boom")
+	})
+
+	assert.Panics(t, func() { h(context.Background(), Message{ID: "1"}) })
+
+	state, _ := store.Claim(context.Background(), DefaultDedupPrefix+"1", "next", DefaultDedupLockTTL)
+	assert.Equal(t, Claimed, state)
+}
+
+func TestDedupInFlight(t *testing.T) {
+
+	store := &MemoryDedupStore{}
+	release := make(chan struct{})
+	h := Dedup{Store: store, LockTTL: 30 * time.Millisecond, InFlightDelay: 50 * time.Millisecond}.Wrap(func(ctx context.Context, msg Message) Outcome {
+		<-release
+		return Ack
+	})
+
+	done := make(chan Outcome)
+	go func() { done <- h(context.Background(), Message{ID: "1"}) }()
+	time.Sleep(100 * time.Millisecond)
+
+	// The lock is renewed past its TTL while the first consumer is busy, and the duplicate is held before requeueing
+	start := time.Now()
+	assert.Equal(t, Requeue, h(context.Background(), Message{ID: "1"}))
+	assert.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+
+	close(release)
+	assert.Equal(t, Ack, <-done)
+	assert.Equal(t, Ack, h(context.Background(), Message{ID: "1"}))
+}
@@ -0,0 +1,880 @@
+package messaging
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/9spokes/go/logging/v3"
+	"github.com/streadway/amqp"
+)
+
+// Memory is an in-process Transport meant for unit tests.  It mirrors the AMQP broker semantics relied upon by this
+// package: direct, fanout, topic and headers exchanges, per-message and per-queue TTL, priority queues, dead-letter
+// exchanges, redelivery flags and explicit acknowledgements through Consume.  Time-based expiry runs against a
+// clock that can be moved forward with Advance.
+//
+// The zero value is ready to use.  Every message published is recorded for tests to assert on, see Published.
+type Memory struct {
+	mu        sync.Mutex
+	offset    time.Duration
+	exchanges map[string]*memoryExchange
+	queues    map[string]*memoryQueue
+	published []Published
+	notify    chan struct{}
+	done      chan struct{}
+	closed    bool
+	tag       uint64
+	timer     *time.Timer // Fires at the next message expiry
+}
+
+// Published records a message published to a Memory transport
+type Published struct {
+	Exchange   string
+	RoutingKey string
+	Message    Message
+	Options    PublishOptions
+	Queues     []string // Queues the message was routed to
+}
+
+type memoryExchange struct {
+	opts     ExchangeOptions
+	bindings []memoryBinding
+}
+
+type memoryBinding struct {
+	queue string
+	Binding
+}
+
+type memoryQueue struct {
+	name      string
+	opts      QueueOptions
+	ready     []*memoryMessage
+	unacked   map[uint64]*memoryMessage
+	consumers int
+	exclusive bool
+	notify    chan struct{}
+}
+
+type memoryMessage struct {
+	Message
+	headers     map[string]interface{}
+	exchange    string
+	key         string
+	replyTo     string
+	priority    uint8
+	rank        uint8
+	timestamp   time.Time
+	expires     time.Time
+	redelivered bool
+}
+
+// NewMemory returns a new in-memory transport
+func NewMemory() *Memory {
+	return &Memory{}
+}
+
+// init lazily allocates the state of the transport so that its zero value is usable
+func (m *Memory) init() {
+	if m.queues == nil {
+		m.queues = make(map[string]*memoryQueue)
+		m.exchanges = make(map[string]*memoryExchange)
+		m.notify = make(chan struct{})
+		m.done = make(chan struct{})
+	}
+}
+
+func (m *Memory) now() time.Time {
+	return time.Now().Add(m.offset)
+}
+
+// Connect reopens the transport after Close, the URL is ignored
+func (m *Memory) Connect(url string) error {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.init()
+	if m.closed {
+		m.closed = false
+		m.done = make(chan struct{})
+	}
+
+	return nil
+}
+
+// Close stops the consumers, closes the channels returned by Receive and returns the unacknowledged messages to
+// their queues
+func (m *Memory) Close() error {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.init()
+	if m.closed {
+		return nil
+	}
+
+	m.closed = true
+	close(m.done)
+
+	for _, q := range m.queues {
+		for tag := range q.unacked {
+			m.requeue(q, tag)
+		}
+	}
+
+	return nil
+}
+
+// Advance moves the transport clock forward, expiring the messages whose time to live has elapsed
+func (m *Memory) Advance(d time.Duration) {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.init()
+	m.offset += d
+	m.expire()
+	m.schedule()
+}
+
+// SendMessage publishes a message to a queue, with options converted by PublishOptionsFromMap
+func (m *Memory) SendMessage(queue string, message Message) error {
+
+	opts, err := PublishOptionsFromMap(message.Options)
+	if err != nil {
+		return fmt.Errorf("Failed to send message: %s", err.Error())
+	}
+
+	return m.Publish(queue, message, opts)
+}
+
+// Publish routes a message through an exchange, the default exchange routing by queue name.  Unlike a broker, a
+// mandatory message which cannot be routed to any queue is reported as an error.
+func (m *Memory) Publish(key string, message Message, opts PublishOptions) error {
+
+	if err := opts.validate(); err != nil {
+		return fmt.Errorf("Failed to send message: %s", err.Error())
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.init()
+	if m.closed {
+		return ErrNotConnected
+	}
+	m.expire()
+
+	if opts.Exchange != "" {
+		if _, ok := m.exchanges[opts.Exchange]; !ok {
+			return fmt.Errorf("Failed to send message: exchange %s does not exist", opts.Exchange)
+		}
+	}
+
+	headers := make(map[string]interface{}, len(opts.Headers))
+	for k, v := range opts.Headers {
+		headers[k] = v
+	}
+
+	now := m.now()
+	queues := m.route(opts.Exchange, key, headers)
+
+	recorded := make(map[string]interface{}, len(headers))
+	for k, v := range headers {
+		recorded[k] = v
+	}
+
+	record := Published{
+		Exchange:   opts.Exchange,
+		RoutingKey: key,
+		Message:    Message{ID: message.ID, CorrelationID: message.CorrelationID, Body: message.Body, Options: recorded},
+		Options:    opts,
+		Queues:     queues,
+	}
+	m.published = append(m.published, record)
+	close(m.notify)
+	m.notify = make(chan struct{})
+
+	if len(queues) == 0 {
+		logging.Debugf("[%s] Message %s published to exchange '%s' was not routed to any queue", key, message.ID, opts.Exchange)
+		if opts.Mandatory {
+			return fmt.Errorf("Failed to send message: no queue bound to exchange '%s' with routing key %s", opts.Exchange, key)
+		}
+		return nil
+	}
+
+	for _, name := range queues {
+		msg := &memoryMessage{
+			Message:   Message{ID: message.ID, CorrelationID: message.CorrelationID, Body: message.Body},
+			headers:   headers,
+			exchange:  opts.Exchange,
+			key:       key,
+			replyTo:   opts.ReplyTo,
+			priority:  opts.Priority,
+			timestamp: now,
+		}
+		if opts.TTL > 0 {
+			msg.expires = now.Add(opts.TTL)
+		}
+		m.enqueue(m.queues[name], msg)
+	}
+
+	return nil
+}
+
+// DeleteMessage does nothing, as with AMQP messages are removed by acknowledging them
+func (m *Memory) DeleteMessage(id string) error {
+	return nil
+}
+
+// CreateQueue declares a queue with attributes converted by QueueOptionsFromMap
+func (m *Memory) CreateQueue(name string, attributes map[string]interface{}) error {
+
+	opts, err := QueueOptionsFromMap(attributes)
+	if err != nil {
+		return fmt.Errorf("failed to declare queue %s: %s", name, err.Error())
+	}
+
+	return m.DeclareQueue(name, opts)
+}
+
+// DeclareQueue declares a queue and its bindings.  Re-declaring an existing queue with different options fails.
+func (m *Memory) DeclareQueue(name string, opts QueueOptions) error {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.init()
+	if m.closed {
+		return ErrNotConnected
+	}
+
+	for _, b := range opts.Bindings {
+		if _, ok := m.exchanges[b.Exchange]; !ok {
+			return fmt.Errorf("failed to bind queue %s: exchange %s does not exist", name, b.Exchange)
+		}
+	}
+
+	q, ok := m.queues[name]
+	if !ok {
+		q = &memoryQueue{name: name, opts: opts, unacked: make(map[uint64]*memoryMessage), notify: make(chan struct{})}
+		m.queues[name] = q
+	} else if q.opts.Durable != opts.Durable || q.opts.AutoDelete != opts.AutoDelete ||
+		q.opts.Exclusive != opts.Exclusive || fmt.Sprint(q.opts.Args) != fmt.Sprint(opts.Args) {
+		return fmt.Errorf("queue %s already exists with different options", name)
+	}
+
+	for _, b := range opts.Bindings {
+		e := m.exchanges[b.Exchange]
+		bound := false
+		for _, existing := range e.bindings {
+			if existing.queue == name && existing.RoutingKey == b.RoutingKey && fmt.Sprint(existing.Args) == fmt.Sprint(b.Args) {
+				bound = true
+			}
+		}
+		if !bound {
+			e.bindings = append(e.bindings, memoryBinding{queue: name, Binding: b})
+		}
+	}
+
+	return nil
+}
+
+// DeclareExchange declares an exchange.  Re-declaring an existing exchange with a different kind fails.
+func (m *Memory) DeclareExchange(opts ExchangeOptions) error {
+
+	if err := opts.validate(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.init()
+	if m.closed {
+		return ErrNotConnected
+	}
+
+	if e, ok := m.exchanges[opts.Name]; ok {
+		if e.opts.Kind != opts.Kind {
+			return fmt.Errorf("exchange %s already exists with kind %s", opts.Name, e.opts.Kind)
+		}
+		return nil
+	}
+
+	m.exchanges[opts.Name] = &memoryExchange{opts: opts}
+
+	return nil
+}
+
+// ReceiveMessages receives messages from a queue, with options converted by ConsumeOptionsFromMap
+func (m *Memory) ReceiveMessages(queue string, opt map[string]interface{}) (<-chan Message, error) {
+
+	opts, err := ConsumeOptionsFromMap(opt)
+	if err != nil {
+		return nil, err
+	}
+
+	return m.Receive(queue, opts)
+}
+
+// Receive delivers messages from a queue on the returned channel until Close is called.  Unless AutoAck is set,
+// the messages stay unacknowledged until Close returns them to the queue, as with a broker.
+func (m *Memory) Receive(queue string, opts ConsumeOptions) (<-chan Message, error) {
+
+	m.mu.Lock()
+	q, done, err := m.subscribe(queue, opts.Exclusive)
+	m.mu.Unlock()
+
+	if err != nil {
+		return nil, err
+	}
+
+	out := make(chan Message)
+
+	go func() {
+		defer close(out)
+		defer m.unsubscribe(q)
+
+		for {
+			d, ok := m.next(context.Background(), q, done)
+			if !ok {
+				return
+			}
+
+			if opts.AutoAck {
+				m.settle(q, d.DeliveryTag, Ack)
+			}
+
+			select {
+			case out <- toMessage(d):
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return out, nil
+}
+
+// Consume delivers messages from queue to handler on a pool of workers until ctx is cancelled or the transport is
+// closed, with the same outcome semantics as AMQP.Consume
+func (m *Memory) Consume(ctx context.Context, queue string, handler Handler, opts ConsumeOptions) error {
+
+	if opts.Workers <= 0 {
+		opts.Workers = 1
+	}
+
+	m.mu.Lock()
+	q, done, err := m.subscribe(queue, opts.Exclusive)
+	m.mu.Unlock()
+
+	if err != nil {
+		return err
+	}
+	defer m.unsubscribe(q)
+
+	var wg sync.WaitGroup
+	for i := 0; i < opts.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				d, ok := m.next(ctx, q, done)
+				if !ok {
+					return
+				}
+				settle(ctx, queue, d, handler)
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	return nil
+}
+
+// Published returns the messages published so far, in order
+func (m *Memory) Published() []Published {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return append([]Published(nil), m.published...)
+}
+
+// PublishedTo returns the messages published so far with the given routing key, which is the queue name for
+// messages sent with SendMessage
+func (m *Memory) PublishedTo(key string) []Message {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var ret []Message
+	for _, p := range m.published {
+		if p.RoutingKey == key {
+			ret = append(ret, p.Message)
+		}
+	}
+
+	return ret
+}
+
+// WaitForPublished waits until at least n messages have been published with the given routing key and returns
+// them, or fails once timeout has elapsed.  It is meant for code publishing from a goroutine.
+func (m *Memory) WaitForPublished(key string, n int, timeout time.Duration) ([]Message, error) {
+
+	deadline := time.After(timeout)
+
+	for {
+		m.mu.Lock()
+		m.init()
+		notify := m.notify
+		m.mu.Unlock()
+
+		if ret := m.PublishedTo(key); len(ret) >= n {
+			return ret, nil
+		}
+
+		select {
+		case <-notify:
+		case <-deadline:
+			return nil, fmt.Errorf("timed out after %s waiting for %d messages published to %s, got %d", timeout, n, key, len(m.PublishedTo(key)))
+		}
+	}
+}
+
+// Reset forgets the messages published so far, leaving the queues untouched
+func (m *Memory) Reset() {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.published = nil
+}
+
+// Queued returns the messages waiting in a queue in delivery order, excluding those delivered but not yet
+// acknowledged
+func (m *Memory) Queued(queue string) []Message {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.init()
+	m.expire()
+
+	q, ok := m.queues[queue]
+	if !ok {
+		return nil
+	}
+
+	ret := make([]Message, 0, len(q.ready))
+	for i, msg := range q.ready {
+		ret = append(ret, toMessage(m.delivery(q, msg, 0, len(q.ready)-i-1)))
+	}
+
+	return ret
+}
+
+// Unacked returns the number of messages of a queue delivered but not yet acknowledged
+func (m *Memory) Unacked(queue string) int {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if q, ok := m.queues[queue]; ok {
+		return len(q.unacked)
+	}
+
+	return 0
+}
+
+// subscribe registers a consumer on a queue, it must be called with the lock held
+func (m *Memory) subscribe(queue string, exclusive bool) (*memoryQueue, chan struct{}, error) {
+
+	m.init()
+	if m.closed {
+		return nil, nil, ErrNotConnected
+	}
+
+	q, ok := m.queues[queue]
+	if !ok {
+		return nil, nil, fmt.Errorf("queue %s does not exist", queue)
+	}
+
+	if q.exclusive || (exclusive && q.consumers > 0) {
+		return nil, nil, fmt.Errorf("queue %s is in exclusive use", queue)
+	}
+
+	q.consumers++
+	q.exclusive = exclusive
+
+	return q, m.done, nil
+}
+
+func (m *Memory) unsubscribe(q *memoryQueue) {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	q.consumers--
+	q.exclusive = false
+}
+
+// next waits for the next message of a queue and marks it as unacknowledged.  It returns false once ctx is
+// cancelled or the transport is closed.
+func (m *Memory) next(ctx context.Context, q *memoryQueue, done chan struct{}) (amqp.Delivery, bool) {
+
+	for {
+		m.mu.Lock()
+
+		if ctx.Err() != nil || m.closed || m.done != done {
+			m.mu.Unlock()
+			return amqp.Delivery{}, false
+		}
+
+		m.expire()
+
+		if len(q.ready) > 0 {
+			msg := q.ready[0]
+			q.ready = q.ready[1:]
+			m.tag++
+			q.unacked[m.tag] = msg
+			d := m.delivery(q, msg, m.tag, len(q.ready))
+			m.mu.Unlock()
+			return d, true
+		}
+
+		notify := q.notify
+		m.mu.Unlock()
+
+		select {
+		case <-notify:
+		case <-done:
+		case <-ctx.Done():
+		}
+	}
+}
+
+// delivery converts a queued message into the delivery a broker would make of it
+func (m *Memory) delivery(q *memoryQueue, msg *memoryMessage, tag uint64, count int) amqp.Delivery {
+
+	headers := make(amqp.Table, len(msg.headers))
+	for k, v := range msg.headers {
+		headers[k] = v
+	}
+
+	return amqp.Delivery{
+		Acknowledger:  &memoryAcknowledger{m: m, q: q},
+		Headers:       headers,
+		ContentType:   "application/json",
+		Priority:      msg.priority,
+		CorrelationId: msg.CorrelationID,
+		MessageId:     msg.ID,
+		ReplyTo:       msg.replyTo,
+		Timestamp:     msg.timestamp,
+		MessageCount:  uint32(count),
+		DeliveryTag:   tag,
+		Redelivered:   msg.redelivered,
+		Exchange:      msg.exchange,
+		RoutingKey:    msg.key,
+		Body:          msg.Body,
+	}
+}
+
+// memoryAcknowledger settles the deliveries of a queue of a Memory transport
+type memoryAcknowledger struct {
+	m *Memory
+	q *memoryQueue
+}
+
+func (a *memoryAcknowledger) Ack(tag uint64, multiple bool) error {
+	return a.m.settle(a.q, tag, Ack)
+}
+
+func (a *memoryAcknowledger) Nack(tag uint64, multiple bool, requeue bool) error {
+	if requeue {
+		return a.m.settle(a.q, tag, Requeue)
+	}
+	return a.m.settle(a.q, tag, Nack)
+}
+
+func (a *memoryAcknowledger) Reject(tag uint64, requeue bool) error {
+	if requeue {
+		return a.m.settle(a.q, tag, Requeue)
+	}
+	return a.m.settle(a.q, tag, Reject)
+}
+
+// settle applies the outcome of an unacknowledged message
+func (m *Memory) settle(q *memoryQueue, tag uint64, outcome Outcome) error {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	msg, ok := q.unacked[tag]
+	if !ok {
+		return fmt.Errorf("unknown delivery tag %d", tag)
+	}
+
+	switch outcome {
+	case Ack:
+		delete(q.unacked, tag)
+	case Requeue:
+		m.requeue(q, tag)
+	default:
+		delete(q.unacked, tag)
+		m.deadLetter(q, msg)
+	}
+
+	return nil
+}
+
+// requeue returns an unacknowledged message to the front of its queue, flagged as redelivered
+func (m *Memory) requeue(q *memoryQueue, tag uint64) {
+
+	msg := q.unacked[tag]
+	delete(q.unacked, tag)
+	msg.redelivered = true
+
+	i := 0
+	for i < len(q.ready) && q.ready[i].rank > msg.rank {
+		i++
+	}
+	q.ready = append(q.ready[:i], append([]*memoryMessage{msg}, q.ready[i:]...)...)
+	m.signal(q)
+
+	if !msg.expires.IsZero() {
+		m.schedule()
+	}
+}
+
+// enqueue appends a message to a queue, after the messages of the same or a higher priority, applying the queue
+// TTL and priority limit
+func (m *Memory) enqueue(q *memoryQueue, msg *memoryMessage) {
+
+	if ttl, ok := intArg(q.opts.Args, "x-message-ttl"); ok {
+		expires := msg.timestamp.Add(time.Duration(ttl) * time.Millisecond)
+		if msg.expires.IsZero() || expires.Before(msg.expires) {
+			msg.expires = expires
+		}
+	}
+
+	msg.rank = 0
+	if max, ok := intArg(q.opts.Args, "x-max-priority"); ok {
+		msg.rank = msg.priority
+		if int64(msg.rank) > max {
+			msg.rank = uint8(max)
+		}
+	}
+
+	i := len(q.ready)
+	for i > 0 && q.ready[i-1].rank < msg.rank {
+		i--
+	}
+	q.ready = append(q.ready[:i], append([]*memoryMessage{msg}, q.ready[i:]...)...)
+	m.signal(q)
+
+	if !msg.expires.IsZero() {
+		m.schedule()
+	}
+}
+
+// schedule arms the timer expiring messages for the earliest expiry of the waiting messages.  The delay is measured
+// on the transport clock and the timer is re-armed by Advance, so that moving the clock forward brings expiries
+// forward.  The caller must hold m.mu.
+func (m *Memory) schedule() {
+
+	var next time.Time
+	for _, q := range m.queues {
+		for _, msg := range q.ready {
+			if !msg.expires.IsZero() && (next.IsZero() || msg.expires.Before(next)) {
+				next = msg.expires
+			}
+		}
+	}
+
+	if m.timer != nil {
+		m.timer.Stop()
+		m.timer = nil
+	}
+	if next.IsZero() {
+		return
+	}
+
+	m.timer = time.AfterFunc(next.Sub(m.now()), func() {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		m.expire()
+		m.schedule()
+	})
+}
+
+func (m *Memory) signal(q *memoryQueue) {
+	close(q.notify)
+	q.notify = make(chan struct{})
+}
+
+// expire dead-letters the waiting messages whose time to live has elapsed
+func (m *Memory) expire() {
+
+	now := m.now()
+
+	for _, q := range m.queues {
+		var expired []*memoryMessage
+		ready := q.ready[:0]
+		for _, msg := range q.ready {
+			if !msg.expires.IsZero() && !msg.expires.After(now) {
+				expired = append(expired, msg)
+			} else {
+				ready = append(ready, msg)
+			}
+		}
+		q.ready = ready
+
+		for _, msg := range expired {
+			m.deadLetter(q, msg)
+		}
+	}
+}
+
+// deadLetter republishes a message rejected or expired from a queue to the dead-letter exchange of the queue, if it
+// has one.  Like a broker, it drops the per-message expiry and any message that would be dead-lettered back into
+// the same queue.
+func (m *Memory) deadLetter(q *memoryQueue, msg *memoryMessage) {
+
+	exchange, ok := q.opts.Args["x-dead-letter-exchange"].(string)
+	if !ok {
+		logging.Debugf("[%s] Dropping message %s", q.name, msg.ID)
+		return
+	}
+
+	key := msg.key
+	if k, ok := q.opts.Args["x-dead-letter-routing-key"].(string); ok {
+		key = k
+	}
+
+	for _, name := range m.route(exchange, key, msg.headers) {
+		if name == q.name {
+			continue
+		}
+		m.enqueue(m.queues[name], &memoryMessage{
+			Message:   msg.Message,
+			headers:   msg.headers,
+			exchange:  exchange,
+			key:       key,
+			replyTo:   msg.replyTo,
+			priority:  msg.priority,
+			timestamp: m.now(),
+		})
+	}
+}
+
+// route returns the names of the queues a message published to an exchange is routed to
+func (m *Memory) route(exchange, key string, headers map[string]interface{}) []string {
+
+	if exchange == "" {
+		if _, ok := m.queues[key]; ok {
+			return []string{key}
+		}
+		return nil
+	}
+
+	e, ok := m.exchanges[exchange]
+	if !ok {
+		return nil
+	}
+
+	var ret []string
+	seen := make(map[string]bool)
+	for _, b := range e.bindings {
+		if seen[b.queue] || !b.matches(e.opts.Kind, key, headers) {
+			continue
+		}
+		seen[b.queue] = true
+		ret = append(ret, b.queue)
+	}
+
+	return ret
+}
+
+func (b memoryBinding) matches(kind, key string, headers map[string]interface{}) bool {
+
+	switch kind {
+	case ExchangeFanout:
+		return true
+	case ExchangeDirect:
+		return b.RoutingKey == key
+	case ExchangeTopic:
+		return topicMatches(strings.Split(b.RoutingKey, "."), strings.Split(key, "."))
+	case ExchangeHeaders:
+		matchAny := b.Args["x-match"] == "any"
+		for k, v := range b.Args {
+			if strings.HasPrefix(k, "x-") {
+				continue
+			}
+			h, ok := headers[k]
+			matched := ok && fmt.Sprint(h) == fmt.Sprint(v)
+			if matched && matchAny {
+				return true
+			}
+			if !matched && !matchAny {
+				return false
+			}
+		}
+		return !matchAny
+	}
+
+	return false
+}
+
+// topicMatches matches the words of a routing key against those of a topic binding pattern, where "*" stands for
+// exactly one word and "#" for zero or more words
+func topicMatches(pattern, words []string) bool {
+
+	if len(pattern) == 0 {
+		return len(words) == 0
+	}
+
+	switch pattern[0] {
+	case "#":
+		for i := 0; i <= len(words); i++ {
+			if topicMatches(pattern[1:], words[i:]) {
+				return true
+			}
+		}
+		return false
+	case "*":
+		return len(words) > 0 && topicMatches(pattern[1:], words[1:])
+	}
+
+	return len(words) > 0 && pattern[0] == words[0] && topicMatches(pattern[1:], words[1:])
+}
+
+// intArg reads an integer queue argument
+func intArg(args map[string]interface{}, key string) (int64, bool) {
+	switch v := args[key].(type) {
+	case int:
+		return int64(v), true
+	case int8:
+		return int64(v), true
+	case int16:
+		return int64(v), true
+	case int32:
+		return int64(v), true
+	case int64:
+		return v, true
+	case uint8:
+		return int64(v), true
+	case uint16:
+		return int64(v), true
+	case uint32:
+		return int64(v), true
+	}
+	return 0, false
+}
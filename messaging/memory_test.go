@@ -0,0 +1,161 @@
+package messaging
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryRouting(t *testing.T) {
+
+	m := NewMemory()
+
+	assert.Nil(t, m.DeclareExchange(ExchangeOptions{Name: "events", Kind: ExchangeTopic}))
+	assert.Nil(t, m.DeclareQueue("all", QueueOptions{Bindings: []Binding{{Exchange: "events", RoutingKey: "etl.#"}}}))
+	assert.Nil(t, m.DeclareQueue("xero", QueueOptions{Bindings: []Binding{{Exchange: "events", RoutingKey: "etl.*.xero"}}}))
+
+	assert.Nil(t, m.Publish("etl.done.xero", Message{ID: "1"}, PublishOptions{Exchange: "events"}))
+	assert.Nil(t, m.Publish("etl.done.myob", Message{ID: "2"}, PublishOptions{Exchange: "events"}))
+	assert.NotNil(t, m.Publish("billing", Message{ID: "3"}, PublishOptions{Exchange: "events", Mandatory: true}))
+	assert.NotNil(t, m.Publish("etl", Message{ID: "4"}, PublishOptions{Exchange: "missing"}))
+
+	assert.Len(t, m.Queued("all"), 2)
+	if assert.Len(t, m.Queued("xero"), 1) {
+		assert.Equal(t, "1", m.Queued("xero")[0].ID)
+	}
+
+	published := m.Published()
+	if assert.Len(t, published, 3) {
+		assert.Equal(t, []string{"all", "xero"}, published[0].Queues)
+		assert.Empty(t, published[2].Queues)
+	}
+	assert.Len(t, m.PublishedTo("etl.done.myob"), 1)
+
+	m.Reset()
+	assert.Empty(t, m.Published())
+	assert.Len(t, m.Queued("all"), 2)
+}
+
+func TestMemoryPriorityAndTTL(t *testing.T) {
+
+	m := NewMemory()
+
+	assert.Nil(t, m.DeclareExchange(ExchangeOptions{Name: "etl.dlx", Kind: ExchangeFanout}))
+	assert.Nil(t, m.DeclareQueue("etl.dlq", QueueOptions{Bindings: []Binding{{Exchange: "etl.dlx"}}}))
+	assert.Nil(t, m.DeclareQueue("etl", QueueOptions{Args: map[string]interface{}{
+		"x-max-priority":         5,
+		"x-dead-letter-exchange": "etl.dlx",
+	}}))
+
+	assert.Nil(t, m.Publish("etl", Message{ID: "low"}, PublishOptions{Priority: 1}))
+	assert.Nil(t, m.Publish("etl", Message{ID: "high"}, PublishOptions{Priority: 9}))
+	assert.Nil(t, m.Publish("etl", Message{ID: "expiring"}, PublishOptions{Priority: 1, TTL: time.Hour}))
+	assert.Nil(t, m.Publish("etl", Message{ID: "mid"}, PublishOptions{Priority: 3}))
+
+	ids := func(queue string) []string {
+		var ret []string
+		for _, msg := range m.Queued(queue) {
+			ret = append(ret, msg.ID)
+		}
+		return ret
+	}
+
+	assert.Equal(t, []string{"high", "mid", "low", "expiring"}, ids("etl"))
+
+	m.Advance(time.Hour)
+
+	assert.Equal(t, []string{"high", "mid", "low"}, ids("etl"))
+	assert.Equal(t, []string{"expiring"}, ids("etl.dlq"))
+}
+
+func TestMemoryExpiryFollowsClock(t *testing.T) {
+
+	m := NewMemory()
+
+	assert.Nil(t, m.DeclareExchange(ExchangeOptions{Name: "etl.dlx", Kind: ExchangeFanout}))
+	assert.Nil(t, m.DeclareQueue("etl.dlq", QueueOptions{Bindings: []Binding{{Exchange: "etl.dlx"}}}))
+	assert.Nil(t, m.DeclareQueue("etl", QueueOptions{Args: map[string]interface{}{"x-dead-letter-exchange": "etl.dlx"}}))
+
+	dead, err := m.ReceiveMessages("etl.dlq", nil)
+	assert.Nil(t, err)
+
+	assert.Nil(t, m.Publish("etl", Message{ID: "delayed"}, PublishOptions{TTL: time.Hour}))
+
+	// The message expires once the clock reaches its expiry, not an hour of wall time after it was published
+	m.Advance(time.Hour - 50*time.Millisecond)
+	assert.Len(t, m.Queued("etl"), 1)
+
+	select {
+	case msg := <-dead:
+		assert.Equal(t, "delayed", msg.ID)
+	case <-time.After(time.Second):
+		t.Fatal("message did not expire")
+	}
+
+	assert.Nil(t, m.Close())
+}
+
+func TestMemoryConsume(t *testing.T) {
+
+	m := NewMemory()
+	assert.Nil(t, m.CreateQueue("etl", map[string]interface{}{}))
+	assert.Nil(t, m.SendMessage("etl", Message{ID: "1", Options: map[string]interface{}{"x-tenant": "acme"}}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	var mu sync.Mutex
+	var seen []Message
+	handler := func(ctx context.Context, msg Message) Outcome {
+		mu.Lock()
+		defer mu.Unlock()
+		seen = append(seen, msg)
+		if len(seen) == 1 {
+			return Requeue
+		}
+		cancel()
+		return Ack
+	}
+
+	assert.Nil(t, m.Consume(ctx, "etl", handler, ConsumeOptions{}))
+
+	if assert.Len(t, seen, 2) {
+		assert.Equal(t, false, seen[0].Options["redelivered"])
+		assert.Equal(t, true, seen[1].Options["redelivered"])
+		assert.Equal(t, "acme", seen[1].Options["x-tenant"])
+	}
+	assert.Empty(t, m.Queued("etl"))
+	assert.Equal(t, 0, m.Unacked("etl"))
+
+	assert.NotNil(t, m.Consume(context.Background(), "missing", handler, ConsumeOptions{}))
+}
+
+func TestMemoryReceive(t *testing.T) {
+
+	m := NewMemory()
+	assert.Nil(t, m.CreateQueue("etl", nil))
+
+	messages, err := m.ReceiveMessages("etl", nil)
+	assert.Nil(t, err)
+
+	go m.SendMessage("etl", Message{ID: "1"})
+
+	published, err := m.WaitForPublished("etl", 1, time.Second)
+	assert.Nil(t, err)
+	assert.Len(t, published, 1)
+
+	msg := <-messages
+	assert.Equal(t, "1", msg.ID)
+	assert.Equal(t, 1, m.Unacked("etl"))
+
+	assert.Nil(t, m.Close())
+	_, ok := <-messages
+	assert.False(t, ok)
+	assert.Len(t, m.Queued("etl"), 1)
+	assert.Equal(t, ErrNotConnected, m.SendMessage("etl", Message{ID: "2"}))
+
+	_, err = m.WaitForPublished("etl", 2, 10*time.Millisecond)
+	assert.NotNil(t, err)
+}
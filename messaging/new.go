@@ -28,6 +28,14 @@ func New(transport string) (Transport, error) {
 		return &AMQP{}, nil
 	}
 
+	if transport == "redis" {
+		return &Redis{}, nil
+	}
+
+	if transport == "memory" {
+		return NewMemory(), nil
+	}
+
 	// Commented out to reduce package sizes
 	// if transport == "sqs" {
 	// 	return &SQS{}, nil
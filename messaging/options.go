@@ -0,0 +1,225 @@
+package messaging
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// PublishOptions configures how a message is published
+type PublishOptions struct {
+	Exchange    string                 // Exchange to publish to, the default exchange routes by queue name
+	Mandatory   bool                   // Whether the broker must be able to route the message to a queue
+	Immediate   bool                   // Whether the message must be delivered to a consumer immediately
+	Priority    uint8                  // Message priority, honoured by queues declared with a maximum priority
+	TTL         time.Duration          // Expiry of the message, zero for none
+	ContentType string                 // Defaults to "application/json"
+	ReplyTo     string                 // Queue the reply to a request is expected on, see Call
+	Headers     map[string]interface{} // Additional message headers
+}
+
+// QueueOptions configures the declaration of a queue
+type QueueOptions struct {
+	Durable    bool                   // Whether the queue survives broker restarts
+	AutoDelete bool                   // Whether the queue is deleted once its last consumer goes away
+	Exclusive  bool                   // Whether the queue is only accessible to this connection
+	NoWait     bool                   // Whether to skip waiting for the broker to confirm the declaration
+	Args       map[string]interface{} // Additional arguments, eg: "x-max-priority"
+	Bindings   []Binding              // Exchanges the queue is bound to once declared
+}
+
+// ExchangeOptions configures the declaration of an exchange
+type ExchangeOptions struct {
+	Name       string
+	Kind       string // One of "direct", "fanout", "topic" or "headers"
+	Durable    bool
+	AutoDelete bool
+	Internal   bool
+	NoWait     bool
+	Args       map[string]interface{}
+}
+
+// Binding routes messages published to an exchange with a matching routing key to a queue
+type Binding struct {
+	Exchange   string
+	RoutingKey string
+	Args       map[string]interface{}
+}
+
+// Exchange kinds
+const (
+	ExchangeDirect  = "direct"
+	ExchangeFanout  = "fanout"
+	ExchangeTopic   = "topic"
+	ExchangeHeaders = "headers"
+)
+
+func (o PublishOptions) validate() error {
+	if o.TTL < 0 {
+		return fmt.Errorf("invalid message TTL %s", o.TTL)
+	}
+	return nil
+}
+
+func (o ExchangeOptions) validate() error {
+	if o.Name == "" {
+		return fmt.Errorf("exchange name is required")
+	}
+	switch o.Kind {
+	case ExchangeDirect, ExchangeFanout, ExchangeTopic, ExchangeHeaders:
+		return nil
+	}
+	return fmt.Errorf("invalid exchange kind '%s'", o.Kind)
+}
+
+// optionParser extracts typed values out of a legacy option map, leaving the unrecognised keys behind
+type optionParser struct {
+	rest map[string]interface{}
+	err  error
+}
+
+func newOptionParser(opt map[string]interface{}) *optionParser {
+	rest := make(map[string]interface{}, len(opt))
+	for k, v := range opt {
+		rest[k] = v
+	}
+	return &optionParser{rest: rest}
+}
+
+func (p *optionParser) fail(key string, v interface{}, expected string) {
+	if p.err == nil {
+		p.err = fmt.Errorf("invalid value %v (%T) for option '%s', expected %s", v, v, key, expected)
+	}
+}
+
+func (p *optionParser) bool(key string, def bool) bool {
+	v, ok := p.rest[key]
+	if !ok {
+		return def
+	}
+	delete(p.rest, key)
+	b, ok := v.(bool)
+	if !ok {
+		p.fail(key, v, "a boolean")
+	}
+	return b
+}
+
+func (p *optionParser) string(key string) string {
+	v, ok := p.rest[key]
+	if !ok {
+		return ""
+	}
+	delete(p.rest, key)
+	s, ok := v.(string)
+	if !ok {
+		p.fail(key, v, "a string")
+	}
+	return s
+}
+
+func (p *optionParser) int(key string, min, max int64) int64 {
+	v, ok := p.rest[key]
+	if !ok {
+		return 0
+	}
+	delete(p.rest, key)
+
+	var n int64
+	switch i := v.(type) {
+	case int:
+		n = int64(i)
+	case int8:
+		n = int64(i)
+	case int16:
+		n = int64(i)
+	case int32:
+		n = int64(i)
+	case int64:
+		n = i
+	case uint:
+		n = int64(i)
+	case uint8:
+		n = int64(i)
+	case uint16:
+		n = int64(i)
+	case uint32:
+		n = int64(i)
+	case uint64:
+		n = int64(i)
+	default:
+		p.fail(key, v, "an integer")
+		return 0
+	}
+
+	if n < min || n > max {
+		p.fail(key, v, fmt.Sprintf("an integer between %d and %d", min, max))
+		return 0
+	}
+
+	return n
+}
+
+// PublishOptionsFromMap converts the legacy options of a Message into PublishOptions.  The "exchange", "mandatory",
+// "immediate", "priority" and "x-message-ttl" (in milliseconds) keys are recognised, any other key is sent as a
+// message header.
+func PublishOptionsFromMap(opt map[string]interface{}) (PublishOptions, error) {
+
+	p := newOptionParser(opt)
+
+	ret := PublishOptions{
+		Exchange:  p.string("exchange"),
+		Mandatory: p.bool("mandatory", false),
+		Immediate: p.bool("immediate", false),
+		Priority:  uint8(p.int("priority", 0, 255)),
+		TTL:       time.Duration(p.int("x-message-ttl", 0, math.MaxInt64/int64(time.Millisecond))) * time.Millisecond,
+	}
+
+	if len(p.rest) > 0 {
+		ret.Headers = p.rest
+	}
+
+	return ret, p.err
+}
+
+// QueueOptionsFromMap converts legacy queue attributes into QueueOptions.  The "durable" (defaulting to true),
+// "delete", "exclusive" and "no-wait" keys are recognised, any other key is passed as a queue argument.
+func QueueOptionsFromMap(attributes map[string]interface{}) (QueueOptions, error) {
+
+	p := newOptionParser(attributes)
+
+	ret := QueueOptions{
+		Durable:    p.bool("durable", true),
+		AutoDelete: p.bool("delete", false),
+		Exclusive:  p.bool("exclusive", false),
+		NoWait:     p.bool("no-wait", false),
+	}
+
+	if len(p.rest) > 0 {
+		ret.Args = p.rest
+	}
+
+	return ret, p.err
+}
+
+// ConsumeOptionsFromMap converts legacy consumer options into ConsumeOptions.  The "consumer", "auto-ack",
+// "exclusive", "no-local" (defaulting to true) and "no-wait" keys are recognised, any other key is passed as a
+// consumer argument.
+func ConsumeOptionsFromMap(opt map[string]interface{}) (ConsumeOptions, error) {
+
+	p := newOptionParser(opt)
+
+	ret := ConsumeOptions{
+		Consumer:  p.string("consumer"),
+		AutoAck:   p.bool("auto-ack", false),
+		Exclusive: p.bool("exclusive", false),
+		NoLocal:   p.bool("no-local", true),
+		NoWait:    p.bool("no-wait", false),
+	}
+
+	if len(p.rest) > 0 {
+		ret.Args = p.rest
+	}
+
+	return ret, p.err
+}
@@ -0,0 +1,68 @@
+package messaging
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPublishOptionsFromMap(t *testing.T) {
+
+	legacy := map[string]interface{}{
+		"exchange":      "events",
+		"mandatory":     true,
+		"priority":      5,
+		"x-message-ttl": int64(1500),
+		"x-tenant":      "acme",
+	}
+
+	opts, err := PublishOptionsFromMap(legacy)
+
+	assert.Nil(t, err)
+	assert.Equal(t, PublishOptions{
+		Exchange:  "events",
+		Mandatory: true,
+		Priority:  5,
+		TTL:       1500 * time.Millisecond,
+		Headers:   map[string]interface{}{"x-tenant": "acme"},
+	}, opts)
+	assert.Len(t, legacy, 5, "the caller's map must not be modified")
+
+	tests := []struct {
+		name string
+		opt  map[string]interface{}
+	}{
+		{name: "wrong type", opt: map[string]interface{}{"mandatory": "yes"}},
+		{name: "priority out of range", opt: map[string]interface{}{"priority": 256}},
+		{name: "negative TTL", opt: map[string]interface{}{"x-message-ttl": -1}},
+		{name: "non-integer TTL", opt: map[string]interface{}{"x-message-ttl": 1.5}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := PublishOptionsFromMap(test.opt)
+			assert.NotNil(t, err)
+		})
+	}
+}
+
+func TestQueueAndConsumeOptionsFromMap(t *testing.T) {
+
+	queue, err := QueueOptionsFromMap(map[string]interface{}{"delete": true, "x-max-priority": 10})
+	assert.Nil(t, err)
+	assert.Equal(t, QueueOptions{Durable: true, AutoDelete: true, Args: map[string]interface{}{"x-max-priority": 10}}, queue)
+
+	consume, err := ConsumeOptionsFromMap(nil)
+	assert.Nil(t, err)
+	assert.Equal(t, ConsumeOptions{NoLocal: true}, consume)
+
+	_, err = ConsumeOptionsFromMap(map[string]interface{}{"consumer": 42})
+	assert.NotNil(t, err)
+}
+
+func TestExchangeOptionsValidate(t *testing.T) {
+	assert.Nil(t, ExchangeOptions{Name: "events", Kind: ExchangeTopic}.validate())
+	assert.NotNil(t, ExchangeOptions{Name: "events", Kind: "broadcast"}.validate())
+	assert.NotNil(t, ExchangeOptions{Kind: ExchangeFanout}.validate())
+}
@@ -0,0 +1,212 @@
+// Package outbox implements the transactional outbox pattern on MongoDB: outgoing messages are written to an outbox
+// collection along with the business changes they relate to, and a Relay publishes them afterwards, so that a
+// crash between the write and the publication cannot lose a message.
+package outbox
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/9spokes/go/db"
+	"github.com/9spokes/go/messaging"
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+	"github.com/globalsign/mgo/txn"
+)
+
+const (
+	// DefaultCollection is the name of the outbox collection unless configured otherwise
+	DefaultCollection = "outbox"
+	// DefaultTxnCollection is the name of the collection holding the transactions run by Write unless configured
+	// otherwise
+	DefaultTxnCollection = "outbox.txns"
+)
+
+// Entry statuses
+const (
+	StatusPending = "pending" // Waiting to be published
+	StatusSent    = "sent"    // Published
+	StatusFailed  = "failed"  // Gave up after too many failed attempts
+)
+
+// Outbox is an outbox collection of a MongoDB database
+type Outbox struct {
+	DB            db.MongoDB
+	Database      string // Defaults to the database of the connection URL
+	Collection    string // Defaults to DefaultCollection
+	TxnCollection string // Defaults to DefaultTxnCollection
+}
+
+// Entry is an outgoing message stored in the outbox
+type Entry struct {
+	ID            bson.ObjectId          `bson:"_id" json:"id"`
+	Queue         string                 `bson:"queue" json:"queue"`
+	MessageID     string                 `bson:"message_id,omitempty" json:"message_id,omitempty"`
+	CorrelationID string                 `bson:"correlation_id,omitempty" json:"correlation_id,omitempty"`
+	Body          []byte                 `bson:"body" json:"body"`
+	Options       map[string]interface{} `bson:"options,omitempty" json:"options,omitempty"`
+	Status        string                 `bson:"status" json:"status"`
+	Attempts      int                    `bson:"attempts" json:"attempts"`
+	Error         string                 `bson:"error,omitempty" json:"error,omitempty"`
+	Created       time.Time              `bson:"created" json:"created"`
+	Next          time.Time              `bson:"next" json:"next"` // When the entry is due for its next publication attempt
+	Sent          time.Time              `bson:"sent,omitempty" json:"sent,omitempty"`
+}
+
+// Outgoing is a message to publish to a queue
+type Outgoing struct {
+	Queue   string
+	Message messaging.Message
+}
+
+// NewEntry returns a pending outbox entry for a message.  The message options must be serialisable to BSON.
+func NewEntry(queue string, msg messaging.Message) *Entry {
+
+	now := time.Now().UTC()
+
+	return &Entry{
+		ID:            bson.NewObjectId(),
+		Queue:         queue,
+		MessageID:     msg.ID,
+		CorrelationID: msg.CorrelationID,
+		Body:          msg.Body,
+		Options:       msg.Options,
+		Status:        StatusPending,
+		Created:       now,
+		Next:          now,
+	}
+}
+
+// Message returns the message of the entry
+func (e *Entry) Message() messaging.Message {
+	return messaging.Message{ID: e.MessageID, CorrelationID: e.CorrelationID, Body: e.Body, Options: e.Options}
+}
+
+func (o *Outbox) collection() string {
+	if o.Collection == "" {
+		return DefaultCollection
+	}
+	return o.Collection
+}
+
+func (o *Outbox) txnCollection() string {
+	if o.TxnCollection == "" {
+		return DefaultTxnCollection
+	}
+	return o.TxnCollection
+}
+
+// session returns a copy of the MongoDB session along with the outbox collection, the session must be closed by the
+// caller
+func (o *Outbox) session() (*mgo.Session, *mgo.Collection) {
+	s := o.DB.Session.Copy()
+	return s, s.DB(o.Database).C(o.collection())
+}
+
+// Op returns the transaction operation inserting a message into the outbox, to be run by a txn.Runner along with
+// the operations of the business change.  The runner must use the same transaction collection as Write.
+func (o *Outbox) Op(queue string, msg messaging.Message) txn.Op {
+
+	e := NewEntry(queue, msg)
+
+	return txn.Op{C: o.collection(), Id: e.ID, Assert: txn.DocMissing, Insert: e}
+}
+
+// Write runs the given operations and inserts the outgoing messages into the outbox within a single mgo/txn
+// transaction, so that either all of them or none are applied.  As required by mgo/txn, the documents changed by
+// ops must only ever be modified through transactions on the same transaction collection.
+func (o *Outbox) Write(ops []txn.Op, outgoing ...Outgoing) error {
+
+	s, c := o.session()
+	defer s.Close()
+
+	all := append([]txn.Op(nil), ops...)
+	for _, out := range outgoing {
+		all = append(all, o.Op(out.Queue, out.Message))
+	}
+
+	runner := txn.NewRunner(c.Database.C(o.txnCollection()))
+	if err := runner.Run(all, "", nil); err != nil {
+		return fmt.Errorf("failed to write to the outbox: %s", err.Error())
+	}
+
+	return nil
+}
+
+// Add inserts messages into the outbox outside of a transaction, for changes that are only made of messages
+func (o *Outbox) Add(outgoing ...Outgoing) error {
+
+	s, c := o.session()
+	defer s.Close()
+
+	docs := make([]interface{}, 0, len(outgoing))
+	for _, out := range outgoing {
+		docs = append(docs, NewEntry(out.Queue, out.Message))
+	}
+
+	if err := c.Insert(docs...); err != nil {
+		return fmt.Errorf("failed to write to the outbox: %s", err.Error())
+	}
+
+	return nil
+}
+
+// EnsureIndexes creates the indexes the relay relies on
+func (o *Outbox) EnsureIndexes() error {
+
+	s, c := o.session()
+	defer s.Close()
+
+	for _, key := range [][]string{{"status", "next"}, {"status", "sent"}} {
+		if err := c.EnsureIndexKey(key...); err != nil {
+			return fmt.Errorf("failed to create outbox index on %v: %s", key, err.Error())
+		}
+	}
+
+	return nil
+}
+
+// Get returns an outbox entry by ID
+func (o *Outbox) Get(id bson.ObjectId) (*Entry, error) {
+
+	s, c := o.session()
+	defer s.Close()
+
+	var e Entry
+	if err := c.FindId(id).One(&e); err != nil {
+		return nil, fmt.Errorf("failed to get outbox entry %s: %s", id.Hex(), err.Error())
+	}
+
+	return &e, nil
+}
+
+// Retry resets failed entries to pending so that the relay publishes them again, returning how many were reset
+func (o *Outbox) Retry() (int, error) {
+
+	s, c := o.session()
+	defer s.Close()
+
+	info, err := c.UpdateAll(
+		bson.M{"status": StatusFailed},
+		bson.M{"$set": bson.M{"status": StatusPending, "attempts": 0, "next": time.Now().UTC()}},
+	)
+	if err != nil {
+		return 0, fmt.Errorf("failed to retry outbox entries: %s", err.Error())
+	}
+
+	return info.Updated, nil
+}
+
+// Cleanup removes the entries sent before the given time, returning how many were removed
+func (o *Outbox) Cleanup(before time.Time) (int, error) {
+
+	s, c := o.session()
+	defer s.Close()
+
+	info, err := c.RemoveAll(bson.M{"status": StatusSent, "sent": bson.M{"$lt": before}})
+	if err != nil {
+		return 0, fmt.Errorf("failed to clean up outbox entries: %s", err.Error())
+	}
+
+	return info.Removed, nil
+}
@@ -0,0 +1,38 @@
+package outbox
+
+import (
+	"testing"
+	"time"
+
+	"github.com/9spokes/go/messaging"
+	"github.com/globalsign/mgo/txn"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEntry(t *testing.T) {
+
+	msg := messaging.Message{ID: "1", CorrelationID: "corr", Body: []byte("{}"), Options: map[string]interface{}{"x-tenant": "acme"}}
+
+	e := NewEntry("etl", msg)
+
+	assert.True(t, e.ID.Valid())
+	assert.Equal(t, StatusPending, e.Status)
+	assert.Equal(t, e.Created, e.Next)
+	assert.Equal(t, msg, e.Message())
+
+	op := (&Outbox{Collection: "events"}).Op("etl", msg)
+	assert.Equal(t, "events", op.C)
+	assert.Equal(t, txn.DocMissing, op.Assert)
+	assert.Equal(t, op.Id, op.Insert.(*Entry).ID)
+}
+
+func TestBackoff(t *testing.T) {
+
+	r := &Relay{MinBackoff: time.Second, MaxBackoff: 10 * time.Second}
+
+	assert.Equal(t, time.Second, r.backoff(1))
+	assert.Equal(t, 2*time.Second, r.backoff(2))
+	assert.Equal(t, 8*time.Second, r.backoff(4))
+	assert.Equal(t, 10*time.Second, r.backoff(5))
+	assert.Equal(t, 10*time.Second, r.backoff(100))
+}
@@ -0,0 +1,261 @@
+package outbox
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/9spokes/go/logging/v3"
+	"github.com/9spokes/go/messaging"
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+	"github.com/globalsign/mgo/txn"
+)
+
+const (
+	// DefaultInterval is how often the relay polls the outbox unless configured otherwise
+	DefaultInterval = time.Second
+	// DefaultBatchSize is the maximum number of entries relayed per poll unless configured otherwise
+	DefaultBatchSize = 100
+	// DefaultMaxAttempts is the number of publication attempts after which an entry is marked as failed unless
+	// configured otherwise
+	DefaultMaxAttempts = 10
+	// DefaultMinBackoff is the delay before the first retry of an entry unless configured otherwise
+	DefaultMinBackoff = time.Second
+	// DefaultMaxBackoff is the maximum delay between retries of an entry unless configured otherwise
+	DefaultMaxBackoff = 10 * time.Minute
+	// DefaultRetention is how long sent entries are kept unless configured otherwise
+	DefaultRetention = 7 * 24 * time.Hour
+	// DefaultLease is how long an entry claimed by a relay is hidden from the others unless configured otherwise
+	DefaultLease = time.Minute
+)
+
+// Relay publishes the pending entries of an outbox through a transport.  Several relays may run against the same
+// outbox, each entry being claimed by a single one at a time.  Since an entry may be published again if a relay
+// crashes after publishing it but before marking it sent, consumers must tolerate duplicates.
+type Relay struct {
+	Outbox      *Outbox
+	Transport   messaging.Transport
+	Interval    time.Duration // Defaults to DefaultInterval
+	BatchSize   int           // Defaults to DefaultBatchSize
+	MaxAttempts int           // Defaults to DefaultMaxAttempts
+	MinBackoff  time.Duration // Defaults to DefaultMinBackoff
+	MaxBackoff  time.Duration // Defaults to DefaultMaxBackoff
+	Retention   time.Duration // Defaults to DefaultRetention, negative to keep sent entries forever
+	Lease       time.Duration // Defaults to DefaultLease
+
+	open func() (entryStore, func()) // Replaces the outbox collection in tests
+	now  func() time.Time
+}
+
+// entryStore is the outbox collection as seen by RelayOnce
+type entryStore interface {
+	// claim atomically picks the oldest entry due at now and pushes its next attempt back by lease, returning
+	// mgo.ErrNotFound if there is none
+	claim(now time.Time, lease time.Duration) (*Entry, error)
+	// sent marks an entry as published
+	sent(e *Entry, now time.Time) error
+	// failed records a failed publication attempt, leaving the entry with the given status until next
+	failed(e *Entry, attempts int, status string, reason error, next time.Time) error
+}
+
+// mongoStore is an entryStore on the outbox collection
+type mongoStore struct {
+	c *mgo.Collection
+}
+
+func (r *Relay) setDefaults() {
+	if r.Interval == 0 {
+		r.Interval = DefaultInterval
+	}
+	if r.BatchSize == 0 {
+		r.BatchSize = DefaultBatchSize
+	}
+	if r.MaxAttempts == 0 {
+		r.MaxAttempts = DefaultMaxAttempts
+	}
+	if r.MinBackoff == 0 {
+		r.MinBackoff = DefaultMinBackoff
+	}
+	if r.MaxBackoff == 0 {
+		r.MaxBackoff = DefaultMaxBackoff
+	}
+	if r.Retention == 0 {
+		r.Retention = DefaultRetention
+	}
+	if r.Lease == 0 {
+		r.Lease = DefaultLease
+	}
+}
+
+// Run relays the outbox until ctx is cancelled.  It also resumes the transactions interrupted by a crash and
+// removes the sent entries older than the retention period.
+func (r *Relay) Run(ctx context.Context) error {
+
+	r.setDefaults()
+
+	ticker := time.NewTicker(r.Interval)
+	defer ticker.Stop()
+
+	var cleaned time.Time
+
+	for {
+		if err := r.resume(); err != nil {
+			logging.Warningf("[%s] %s", r.Outbox.collection(), err.Error())
+		}
+
+		for {
+			n, err := r.RelayOnce(ctx)
+			if err != nil {
+				logging.Errorf("[%s] %s", r.Outbox.collection(), err.Error())
+			}
+			// Keep going while there is a backlog
+			if err != nil || n < r.BatchSize || ctx.Err() != nil {
+				break
+			}
+		}
+
+		if r.Retention > 0 && time.Since(cleaned) > time.Hour {
+			cleaned = time.Now()
+			if n, err := r.Outbox.Cleanup(time.Now().UTC().Add(-r.Retention)); err != nil {
+				logging.Warningf("[%s] %s", r.Outbox.collection(), err.Error())
+			} else if n > 0 {
+				logging.Debugf("[%s] Removed %d sent entries", r.Outbox.collection(), n)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// resume completes the outbox transactions interrupted before being fully applied
+func (r *Relay) resume() error {
+
+	s, c := r.Outbox.session()
+	defer s.Close()
+
+	if err := txn.NewRunner(c.Database.C(r.Outbox.txnCollection())).ResumeAll(); err != nil {
+		return fmt.Errorf("failed to resume outbox transactions: %s", err.Error())
+	}
+
+	return nil
+}
+
+// RelayOnce publishes up to BatchSize due entries and returns how many were claimed
+func (r *Relay) RelayOnce(ctx context.Context) (int, error) {
+
+	r.setDefaults()
+
+	store, done := r.store()
+	defer done()
+
+	n := 0
+	for ; n < r.BatchSize && ctx.Err() == nil; n++ {
+
+		// Claimed entries are skipped by other relays until the lease runs out
+		e, err := store.claim(r.time(), r.Lease)
+		if err == mgo.ErrNotFound {
+			return n, nil
+		}
+		if err != nil {
+			return n, fmt.Errorf("failed to claim outbox entry: %s", err.Error())
+		}
+
+		if err := r.publish(store, e); err != nil {
+			return n, err
+		}
+	}
+
+	return n, nil
+}
+
+// store returns the outbox collection along with a function releasing it
+func (r *Relay) store() (entryStore, func()) {
+
+	if r.open != nil {
+		return r.open()
+	}
+
+	s, c := r.Outbox.session()
+	return mongoStore{c}, s.Close
+}
+
+func (r *Relay) time() time.Time {
+	if r.now != nil {
+		return r.now().UTC()
+	}
+	return time.Now().UTC()
+}
+
+// publish sends an entry and records the outcome
+func (r *Relay) publish(store entryStore, e *Entry) error {
+
+	now := r.time()
+
+	var err error
+	if sendErr := r.Transport.SendMessage(e.Queue, e.Message()); sendErr != nil {
+		attempts := e.Attempts + 1
+		status := StatusPending
+		if attempts >= r.MaxAttempts {
+			status = StatusFailed
+			logging.Errorf("[%s] Giving up on message %s after %d attempts: %s", e.Queue, e.ID.Hex(), attempts, sendErr.Error())
+		} else {
+			logging.Warningf("[%s] Failed to publish message %s (attempt #%d): %s", e.Queue, e.ID.Hex(), attempts, sendErr.Error())
+		}
+		err = store.failed(e, attempts, status, sendErr, now.Add(r.backoff(attempts)))
+	} else {
+		logging.Debugf("[%s] Published message %s", e.Queue, e.ID.Hex())
+		err = store.sent(e, now)
+	}
+
+	if err != nil {
+		return fmt.Errorf("failed to update outbox entry %s: %s", e.ID.Hex(), err.Error())
+	}
+
+	return nil
+}
+
+func (m mongoStore) claim(now time.Time, lease time.Duration) (*Entry, error) {
+
+	var e Entry
+	_, err := m.c.Find(bson.M{"status": StatusPending, "next": bson.M{"$lte": now}}).
+		Sort("created").
+		Apply(mgo.Change{Update: bson.M{"$set": bson.M{"next": now.Add(lease)}}, ReturnNew: true}, &e)
+	if err != nil {
+		return nil, err
+	}
+
+	return &e, nil
+}
+
+func (m mongoStore) sent(e *Entry, now time.Time) error {
+	return m.c.UpdateId(e.ID, bson.M{"$set": bson.M{"status": StatusSent, "attempts": e.Attempts + 1, "sent": now}, "$unset": bson.M{"error": ""}})
+}
+
+func (m mongoStore) failed(e *Entry, attempts int, status string, reason error, next time.Time) error {
+	return m.c.UpdateId(e.ID, bson.M{"$set": bson.M{
+		"status":   status,
+		"attempts": attempts,
+		"error":    reason.Error(),
+		"next":     next,
+	}})
+}
+
+// backoff returns the delay before the next attempt after the given number of failed attempts, doubling from
+// MinBackoff up to MaxBackoff
+func (r *Relay) backoff(attempts int) time.Duration {
+
+	d := r.MinBackoff
+	for i := 1; i < attempts && d < r.MaxBackoff; i++ {
+		d *= 2
+	}
+	if d > r.MaxBackoff {
+		d = r.MaxBackoff
+	}
+
+	return d
+}
@@ -0,0 +1,201 @@
+package outbox
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/9spokes/go/messaging"
+	"github.com/globalsign/mgo"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeStore is an in-memory entryStore
+type fakeStore struct {
+	mu      sync.Mutex
+	entries []*Entry
+	err     error // Returned by updates when set
+}
+
+func (f *fakeStore) claim(now time.Time, lease time.Duration) (*Entry, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	sort.SliceStable(f.entries, func(i, j int) bool { return f.entries[i].Created.Before(f.entries[j].Created) })
+	for _, e := range f.entries {
+		if e.Status == StatusPending && !e.Next.After(now) {
+			e.Next = now.Add(lease)
+			claimed := *e
+			return &claimed, nil
+		}
+	}
+	return nil, mgo.ErrNotFound
+}
+
+func (f *fakeStore) sent(e *Entry, now time.Time) error {
+	return f.update(e, func(stored *Entry) {
+		stored.Status, stored.Attempts, stored.Sent, stored.Error = StatusSent, e.Attempts+1, now, ""
+	})
+}
+
+func (f *fakeStore) failed(e *Entry, attempts int, status string, reason error, next time.Time) error {
+	return f.update(e, func(stored *Entry) {
+		stored.Status, stored.Attempts, stored.Error, stored.Next = status, attempts, reason.Error(), next
+	})
+}
+
+func (f *fakeStore) update(e *Entry, fn func(stored *Entry)) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.err != nil {
+		return f.err
+	}
+	for _, stored := range f.entries {
+		if stored.ID == e.ID {
+			fn(stored)
+			return nil
+		}
+	}
+	return mgo.ErrNotFound
+}
+
+// fakeTransport records the messages sent, failing for the queues listed in fail
+type fakeTransport struct {
+	messaging.Transport
+	sent []string
+	fail map[string]bool
+}
+
+func (f *fakeTransport) SendMessage(queue string, msg messaging.Message) error {
+	if f.fail[queue] {
+		return errors.New("broker unavailable")
+	}
+	f.sent = append(f.sent, msg.ID)
+	return nil
+}
+
+func newTestRelay(store *fakeStore, transport messaging.Transport, now *time.Time) *Relay {
+	return &Relay{
+		Transport:   transport,
+		MaxAttempts: 3,
+		MinBackoff:  time.Second,
+		MaxBackoff:  time.Minute,
+		Lease:       time.Minute,
+		open:        func() (entryStore, func()) { return store, func() {} },
+		now:         func() time.Time { return *now },
+	}
+}
+
+func TestRelayOnce(t *testing.T) {
+
+	ctx := context.Background()
+	now := time.Now().UTC()
+
+	entry := func(id, queue string, age time.Duration) *Entry {
+		e := NewEntry(queue, messaging.Message{ID: id, Body: []byte("{}")})
+		e.Created, e.Next = now.Add(-age), now.Add(-age)
+		return e
+	}
+
+	t.Run("publishes due entries oldest first", func(t *testing.T) {
+		future := entry("later", "etl", 0)
+		future.Next = now.Add(time.Hour)
+		store := &fakeStore{entries: []*Entry{entry("2", "etl", time.Second), future, entry("1", "etl", time.Minute)}}
+		transport := &fakeTransport{}
+
+		n, err := newTestRelay(store, transport, &now).RelayOnce(ctx)
+		assert.NoError(t, err)
+		assert.Equal(t, 2, n)
+		assert.Equal(t, []string{"1", "2"}, transport.sent)
+
+		for _, e := range store.entries {
+			if e.MessageID == "later" {
+				assert.Equal(t, StatusPending, e.Status)
+				continue
+			}
+			assert.Equal(t, StatusSent, e.Status)
+			assert.Equal(t, 1, e.Attempts)
+			assert.Equal(t, now, e.Sent)
+		}
+	})
+
+	t.Run("stops at the batch size", func(t *testing.T) {
+		store := &fakeStore{entries: []*Entry{entry("1", "etl", 3*time.Second), entry("2", "etl", 2*time.Second), entry("3", "etl", time.Second)}}
+		transport := &fakeTransport{}
+
+		relay := newTestRelay(store, transport, &now)
+		relay.BatchSize = 2
+		n, err := relay.RelayOnce(ctx)
+		assert.NoError(t, err)
+		assert.Equal(t, 2, n)
+		assert.Equal(t, []string{"1", "2"}, transport.sent)
+	})
+
+	t.Run("retries failed entries with backoff then marks them failed", func(t *testing.T) {
+		store := &fakeStore{entries: []*Entry{entry("1", "down", time.Second)}}
+		transport := &fakeTransport{fail: map[string]bool{"down": true}}
+		relay := newTestRelay(store, transport, &now)
+		e := store.entries[0]
+
+		n, err := relay.RelayOnce(ctx)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, n)
+		assert.Equal(t, StatusPending, e.Status)
+		assert.Equal(t, 1, e.Attempts)
+		assert.Equal(t, "broker unavailable", e.Error)
+		assert.Equal(t, now.Add(time.Second), e.Next)
+
+		// Not due again until the backoff has elapsed
+		n, _ = relay.RelayOnce(ctx)
+		assert.Zero(t, n)
+
+		later := now.Add(time.Second)
+		relay.now = func() time.Time { return later }
+		relay.RelayOnce(ctx)
+		assert.Equal(t, StatusPending, e.Status)
+		assert.Equal(t, 2, e.Attempts)
+		assert.Equal(t, later.Add(2*time.Second), e.Next)
+
+		later = later.Add(2 * time.Second)
+		relay.RelayOnce(ctx)
+		assert.Equal(t, StatusFailed, e.Status)
+		assert.Equal(t, 3, e.Attempts)
+
+		later = later.Add(time.Hour)
+		n, _ = relay.RelayOnce(ctx)
+		assert.Zero(t, n)
+		assert.Empty(t, transport.sent)
+
+		// Recovers once the broker is back
+		transport.fail = nil
+		e.Status, e.Attempts = StatusPending, 0
+		relay.RelayOnce(ctx)
+		assert.Equal(t, StatusSent, e.Status)
+		assert.Empty(t, e.Error)
+	})
+
+	t.Run("claimed entries are leased", func(t *testing.T) {
+		store := &fakeStore{entries: []*Entry{entry("1", "etl", time.Second)}, err: errors.New("connection reset")}
+		transport := &fakeTransport{}
+		relay := newTestRelay(store, transport, &now)
+
+		// The entry was published but could not be marked sent, so it is published again once the lease is over
+		_, err := relay.RelayOnce(ctx)
+		assert.EqualError(t, err, "failed to update outbox entry "+store.entries[0].ID.Hex()+": connection reset")
+		assert.Equal(t, now.Add(time.Minute), store.entries[0].Next)
+
+		n, _ := relay.RelayOnce(ctx)
+		assert.Zero(t, n)
+
+		store.err = nil
+		later := now.Add(time.Minute)
+		relay.now = func() time.Time { return later }
+		relay.RelayOnce(ctx)
+		assert.Equal(t, []string{"1", "1"}, transport.sent)
+		assert.Equal(t, StatusSent, store.entries[0].Status)
+	})
+}
@@ -0,0 +1,680 @@
+package messaging
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/9spokes/go/logging/v3"
+	"github.com/9spokes/go/middleware/recoverer"
+	redis "github.com/go-redis/redis/v8"
+)
+
+const (
+	// DefaultGroup is the consumer group used by the Redis transport unless configured otherwise
+	DefaultGroup = "messaging"
+	// DefaultClaimIdle is how long a message stays pending with a consumer before it is reclaimed by another one
+	// unless configured otherwise
+	DefaultClaimIdle = time.Minute
+	// DefaultBlock is how long the Redis transport blocks waiting for new messages unless configured otherwise
+	DefaultBlock = 5 * time.Second
+	// DefaultMaxReceived is how many messages received through ReceiveMessages the Redis transport keeps track of
+	// until they are deleted unless configured otherwise
+	DefaultMaxReceived = 10000
+)
+
+// Stream entry fields holding the parts of a Message
+const (
+	streamFieldID            = "id"
+	streamFieldCorrelationID = "correlation_id"
+	streamFieldBody          = "body"
+	streamFieldContentType   = "content_type"
+	streamFieldReplyTo       = "reply_to"
+	streamFieldHeaders       = "headers"
+	streamFieldRedelivered   = "redelivered"
+)
+
+// Redis is a Transport on Redis Streams, requiring Redis 6.2 or later.  Each queue is a stream read through a
+// consumer group, so that every message is handled by a single consumer of the group.  Messages left pending by a
+// consumer that crashed are reclaimed by the others once they have been idle for ClaimIdle.
+//
+// Received messages carry their stream entry ID in the "streamID" option, and are acknowledged and deleted from the
+// stream by DeleteMessage with their ID, or according to the outcome of the handler with Consume.
+type Redis struct {
+	Client     *redis.Client // Created by Connect unless set beforehand, in which case Close leaves it open
+	Group      string        // Consumer group, defaults to DefaultGroup
+	Consumer   string        // Consumer name within the group, defaults to the host name and process ID
+	MaxLen     int64         // Approximate maximum length the streams are trimmed to, zero for none
+	ClaimIdle  time.Duration // Idle time after which pending messages are reclaimed, defaults to DefaultClaimIdle
+	Block      time.Duration // How long to wait for new messages, defaults to DefaultBlock
+	DeadLetter bool          // Whether messages nacked or rejected by a handler are moved to a "<queue>.dlq" stream
+
+	// Maximum number of messages received through ReceiveMessages kept track of until deleted, defaults to
+	// DefaultMaxReceived.  The oldest ones are forgotten beyond it, staying pending until reclaimed after ClaimIdle.
+	MaxReceived int
+
+	mu        sync.Mutex
+	ownClient bool
+	received  map[string]*list.Element
+	order     *list.List
+	done      chan struct{}
+	closed    bool
+	wg        sync.WaitGroup
+}
+
+// streamEntry locates a received message so that DeleteMessage can acknowledge it
+type streamEntry struct {
+	stream, id string
+}
+
+// receivedMessage lists the stream entries a message was received from, more than one if it was sent several times
+type receivedMessage struct {
+	id      string
+	entries []streamEntry
+}
+
+// Connect connects to the Redis server at the given URL, unless a client was provided
+func (r *Redis) Connect(url string) error {
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.Client == nil {
+		opts, err := redis.ParseURL(url)
+		if err != nil {
+			return fmt.Errorf("failed to parse Redis URL: %s", err.Error())
+		}
+		r.Client = redis.NewClient(opts)
+		r.ownClient = true
+	}
+
+	if err := r.Client.Ping(context.Background()).Err(); err != nil {
+		return fmt.Errorf("failed to connect to Redis: %s", err.Error())
+	}
+
+	r.received = make(map[string]*list.Element)
+	r.order = list.New()
+	r.done = make(chan struct{})
+	r.closed = false
+
+	return nil
+}
+
+// Close stops the consumers, closes the channels returned by ReceiveMessages and closes the Redis client if it was
+// created by Connect.  Messages received but not yet deleted stay pending and are reclaimed by other consumers.
+func (r *Redis) Close() error {
+
+	r.mu.Lock()
+	if r.closed || r.done == nil {
+		r.mu.Unlock()
+		return nil
+	}
+	r.closed = true
+	close(r.done)
+	r.mu.Unlock()
+
+	r.wg.Wait()
+
+	if !r.ownClient {
+		return nil
+	}
+	return r.Client.Close()
+}
+
+func (r *Redis) group() string {
+	if r.Group == "" {
+		return DefaultGroup
+	}
+	return r.Group
+}
+
+func (r *Redis) consumer(name string) string {
+	if name != "" {
+		return name
+	}
+	if r.Consumer != "" {
+		return r.Consumer
+	}
+	host, _ := os.Hostname()
+	return fmt.Sprintf("%s-%d", host, os.Getpid())
+}
+
+func (r *Redis) claimIdle() time.Duration {
+	if r.ClaimIdle == 0 {
+		return DefaultClaimIdle
+	}
+	return r.ClaimIdle
+}
+
+func (r *Redis) block() time.Duration {
+	if r.Block == 0 {
+		return DefaultBlock
+	}
+	return r.Block
+}
+
+// SendMessage appends a message to the stream of a queue.  Only the headers, content type and reply queue of the
+// options converted by PublishOptionsFromMap apply, Redis Streams having no notion of exchange, priority or expiry.
+func (r *Redis) SendMessage(queue string, message Message) error {
+
+	opts, err := PublishOptionsFromMap(message.Options)
+	if err != nil {
+		return fmt.Errorf("Failed to send message: %s", err.Error())
+	}
+
+	return r.Publish(queue, message, opts)
+}
+
+// Publish appends a message to the stream of a queue, trimming the stream to MaxLen
+func (r *Redis) Publish(queue string, message Message, opts PublishOptions) error {
+
+	if opts.Exchange != "" {
+		return fmt.Errorf("Failed to send message: exchanges are not supported by Redis Streams")
+	}
+
+	values, err := encodeStreamEntry(message, opts)
+	if err != nil {
+		return fmt.Errorf("Failed to send message: %s", err.Error())
+	}
+
+	if err := r.Client.XAdd(context.Background(), r.xaddArgs(queue, values)).Err(); err != nil {
+		return fmt.Errorf("Failed to send message: %s", err.Error())
+	}
+
+	return nil
+}
+
+func (r *Redis) xaddArgs(stream string, values map[string]interface{}) *redis.XAddArgs {
+	return &redis.XAddArgs{Stream: stream, MaxLen: r.MaxLen, Approx: r.MaxLen > 0, Values: values}
+}
+
+// DeleteMessage acknowledges a message received through ReceiveMessages and deletes it from its stream.  The id is
+// the ID of the message, which is its stream entry ID if it was sent without one.  Every copy of the message received
+// by this consumer is deleted.
+func (r *Redis) DeleteMessage(id string) error {
+
+	r.mu.Lock()
+	el, ok := r.received[id]
+	if ok {
+		delete(r.received, id)
+		r.order.Remove(el)
+	}
+	r.mu.Unlock()
+
+	if !ok {
+		return fmt.Errorf("message %s was not received by this consumer", id)
+	}
+
+	var ret error
+	for _, entry := range el.Value.(*receivedMessage).entries {
+		if err := r.remove(context.Background(), entry); err != nil && ret == nil {
+			ret = err
+		}
+	}
+
+	return ret
+}
+
+// track records a received message until it is deleted, forgetting the oldest ones beyond MaxReceived.  The caller
+// must hold r.mu.
+func (r *Redis) track(msg Message, entry streamEntry) {
+
+	if el, ok := r.received[msg.ID]; ok {
+		received := el.Value.(*receivedMessage)
+		found := false
+		for _, e := range received.entries {
+			found = found || e == entry
+		}
+		if !found {
+			received.entries = append(received.entries, entry)
+		}
+		r.order.MoveToBack(el)
+		return
+	}
+
+	r.received[msg.ID] = r.order.PushBack(&receivedMessage{id: msg.ID, entries: []streamEntry{entry}})
+
+	max := r.MaxReceived
+	if max <= 0 {
+		max = DefaultMaxReceived
+	}
+	for r.order.Len() > max {
+		oldest := r.order.Remove(r.order.Front()).(*receivedMessage)
+		delete(r.received, oldest.id)
+		logging.Warningf("[%s] Forgetting message %s received but never deleted", oldest.entries[0].stream, oldest.id)
+	}
+}
+
+// remove acknowledges a stream entry and deletes it
+func (r *Redis) remove(ctx context.Context, entry streamEntry) error {
+
+	_, err := r.Client.TxPipelined(ctx, func(p redis.Pipeliner) error {
+		p.XAck(ctx, entry.stream, r.group(), entry.id)
+		p.XDel(ctx, entry.stream, entry.id)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete message %s from %s: %s", entry.id, entry.stream, err.Error())
+	}
+
+	return nil
+}
+
+// CreateQueue creates the stream of a queue along with the consumer group reading it, if they do not exist yet.
+// The attributes are ignored.
+func (r *Redis) CreateQueue(name string, attributes map[string]interface{}) error {
+
+	err := r.Client.XGroupCreateMkStream(context.Background(), name, r.group(), "0").Err()
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return fmt.Errorf("failed to create consumer group %s on %s: %s", r.group(), name, err.Error())
+	}
+
+	return nil
+}
+
+// ReceiveMessages reads messages from the stream of a queue, with options converted by ConsumeOptionsFromMap of
+// which only Consumer and AutoAck apply.  Unless AutoAck is set, messages stay pending until deleted with
+// DeleteMessage.
+func (r *Redis) ReceiveMessages(queue string, opt map[string]interface{}) (<-chan Message, error) {
+
+	opts, err := ConsumeOptionsFromMap(opt)
+	if err != nil {
+		return nil, err
+	}
+
+	done, err := r.start(queue)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make(chan Message)
+	consumer := r.consumer(opts.Consumer)
+
+	go func() {
+		defer r.wg.Done()
+		defer close(out)
+		defer recoverer.RecoverGoroutinePanic("Redis consumer of "+queue, nil, nil)
+
+		r.read(context.Background(), done, queue, consumer, 1, func(msg Message, entry streamEntry) {
+			if opts.AutoAck {
+				if err := r.remove(context.Background(), entry); err != nil {
+					logging.Errorf("[%s] %s", queue, err.Error())
+				}
+			} else {
+				r.mu.Lock()
+				r.track(msg, entry)
+				r.mu.Unlock()
+			}
+
+			select {
+			case out <- msg:
+			case <-done:
+			}
+		})
+	}()
+
+	return out, nil
+}
+
+// Consume delivers messages from the stream of a queue to handler on a pool of workers until ctx is cancelled or
+// the transport is closed.  Acknowledged messages are deleted from the stream, requeued messages are appended back
+// to it flagged as redelivered, and nacked or rejected ones are dropped or moved to the dead-letter stream.  A
+// handler panic is treated as with AMQP.Consume.
+func (r *Redis) Consume(ctx context.Context, queue string, handler Handler, opts ConsumeOptions) error {
+
+	if opts.Workers <= 0 {
+		opts.Workers = 1
+	}
+	if opts.Prefetch <= 0 {
+		opts.Prefetch = opts.Workers
+	}
+
+	done, err := r.start(queue)
+	if err != nil {
+		return err
+	}
+	defer r.wg.Done()
+
+	type delivery struct {
+		msg   Message
+		entry streamEntry
+	}
+
+	deliveries := make(chan delivery)
+
+	var wg sync.WaitGroup
+	for i := 0; i < opts.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for d := range deliveries {
+				r.settle(ctx, queue, d.msg, d.entry, handler)
+			}
+		}()
+	}
+
+	r.read(ctx, done, queue, r.consumer(opts.Consumer), int64(opts.Prefetch), func(msg Message, entry streamEntry) {
+		select {
+		case deliveries <- delivery{msg, entry}:
+		case <-ctx.Done():
+			// Left pending, reclaimed once idle
+		case <-done:
+		}
+	})
+
+	close(deliveries)
+	wg.Wait()
+
+	return nil
+}
+
+// start registers a consumer, returning the channel closed by Close
+func (r *Redis) start(queue string) (chan struct{}, error) {
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.Client == nil || r.closed || r.done == nil {
+		return nil, ErrNotConnected
+	}
+
+	r.wg.Add(1)
+
+	return r.done, nil
+}
+
+// read reclaims the messages idle for too long then reads new ones, passing them to deliver until ctx is cancelled
+// or done is closed
+func (r *Redis) read(ctx context.Context, done chan struct{}, queue, consumer string, count int64, deliver func(Message, streamEntry)) {
+
+	stopped := func() bool {
+		select {
+		case <-ctx.Done():
+			return true
+		case <-done:
+			return true
+		default:
+			return false
+		}
+	}
+
+	var lastClaim time.Time
+
+	for !stopped() {
+
+		if time.Since(lastClaim) >= r.claimIdle()/2 {
+			lastClaim = time.Now()
+			start := "0-0"
+			for !stopped() {
+				next, entries, err := r.autoClaim(ctx, queue, consumer, start, count)
+				if err != nil {
+					logging.Warningf("[%s] Failed to reclaim idle messages: %s", queue, err.Error())
+					break
+				}
+				for _, e := range entries {
+					logging.Debugf("[%s] Reclaimed idle message %s", queue, e.ID)
+					msg, entry := decodeStreamEntry(queue, e, true)
+					deliver(msg, entry)
+				}
+				if next == "0-0" || next == "" {
+					break
+				}
+				start = next
+			}
+		}
+
+		block := r.block()
+		if remaining := r.claimIdle()/2 - time.Since(lastClaim); remaining < block {
+			block = remaining
+		}
+		if block < time.Millisecond {
+			block = time.Millisecond
+		}
+
+		streams, err := r.Client.XReadGroup(ctx, &redis.XReadGroupArgs{
+			Group:    r.group(),
+			Consumer: consumer,
+			Streams:  []string{queue, ">"},
+			Count:    count,
+			Block:    block,
+		}).Result()
+		if err == redis.Nil {
+			continue
+		}
+		if err != nil {
+			if stopped() {
+				return
+			}
+			logging.Warningf("[%s] Failed to read messages, retrying in %s: %s", queue, DefaultMinBackoff, err.Error())
+			select {
+			case <-ctx.Done():
+			case <-done:
+			case <-time.After(DefaultMinBackoff):
+			}
+			continue
+		}
+
+		for _, s := range streams {
+			for _, e := range s.Messages {
+				msg, entry := decodeStreamEntry(queue, e, false)
+				deliver(msg, entry)
+			}
+		}
+	}
+}
+
+// autoClaim claims up to count messages of a stream idle for longer than ClaimIdle, starting from the given entry
+// ID, and returns the ID to continue from.  The reply is parsed here as the XAutoClaim command of the client only
+// accepts the two element reply of Redis 6.2, while later versions add the IDs of the entries deleted meanwhile.
+func (r *Redis) autoClaim(ctx context.Context, queue, consumer, start string, count int64) (string, []redis.XMessage, error) {
+
+	reply, err := r.Client.Do(ctx, "XAUTOCLAIM", queue, r.group(), consumer, r.claimIdle().Milliseconds(), start, "COUNT", count).Result()
+	if err != nil {
+		return "", nil, err
+	}
+
+	next, entries, deleted, err := parseAutoClaim(reply)
+	if err != nil {
+		return "", nil, err
+	}
+
+	// Redis 6.2 returns the entries deleted while pending without their fields, and leaves them pending
+	if len(deleted) > 0 {
+		if err := r.Client.XAck(ctx, queue, r.group(), deleted...).Err(); err != nil {
+			logging.Warningf("[%s] Failed to acknowledge deleted messages: %s", queue, err.Error())
+		}
+	}
+
+	return next, entries, nil
+}
+
+// parseAutoClaim parses an XAUTOCLAIM reply into the ID to continue from, the claimed entries and the IDs of the
+// claimed entries that no longer exist
+func parseAutoClaim(reply interface{}) (string, []redis.XMessage, []string, error) {
+
+	parts, ok := reply.([]interface{})
+	if !ok || len(parts) < 2 || len(parts) > 3 {
+		return "", nil, nil, fmt.Errorf("unexpected XAUTOCLAIM reply: %v", reply)
+	}
+
+	next, ok := parts[0].(string)
+	if !ok {
+		return "", nil, nil, fmt.Errorf("unexpected XAUTOCLAIM cursor: %v", parts[0])
+	}
+
+	claimed, ok := parts[1].([]interface{})
+	if !ok {
+		return "", nil, nil, fmt.Errorf("unexpected XAUTOCLAIM entries: %v", parts[1])
+	}
+
+	var entries []redis.XMessage
+	var deleted []string
+	for _, c := range claimed {
+		entry, ok := c.([]interface{})
+		if !ok || len(entry) != 2 {
+			return "", nil, nil, fmt.Errorf("unexpected XAUTOCLAIM entry: %v", c)
+		}
+		id, ok := entry[0].(string)
+		if !ok {
+			return "", nil, nil, fmt.Errorf("unexpected XAUTOCLAIM entry ID: %v", entry[0])
+		}
+		if entry[1] == nil {
+			deleted = append(deleted, id)
+			continue
+		}
+		fields, ok := entry[1].([]interface{})
+		if !ok || len(fields)%2 != 0 {
+			return "", nil, nil, fmt.Errorf("unexpected fields of XAUTOCLAIM entry %s: %v", id, entry[1])
+		}
+		values := make(map[string]interface{}, len(fields)/2)
+		for i := 0; i < len(fields); i += 2 {
+			key, _ := fields[i].(string)
+			values[key] = fields[i+1]
+		}
+		entries = append(entries, redis.XMessage{ID: id, Values: values})
+	}
+
+	return next, entries, deleted, nil
+}
+
+// settle runs the handler on a message and applies its outcome to the stream
+func (r *Redis) settle(ctx context.Context, queue string, msg Message, entry streamEntry, handler Handler) {
+
+	outcome := Reject
+	if msg.Options["redelivered"] != true {
+		outcome = Requeue
+	}
+
+	func() {
+		defer recoverer.RecoverGoroutinePanic("handler for queue "+queue, nil, nil)
+		outcome = handler(ctx, msg)
+	}()
+
+	bg := context.Background()
+
+	_, err := r.Client.TxPipelined(bg, func(p redis.Pipeliner) error {
+		switch outcome {
+		case Ack:
+		case Requeue:
+			values, err := requeuedStreamEntry(msg)
+			if err != nil {
+				return err
+			}
+			p.XAdd(bg, r.xaddArgs(queue, values))
+		default:
+			if r.DeadLetter {
+				values, err := requeuedStreamEntry(msg)
+				if err != nil {
+					return err
+				}
+				delete(values, streamFieldRedelivered)
+				p.XAdd(bg, r.xaddArgs(RetryPolicy{Queue: queue}.DeadLetterQueue(), values))
+			}
+		}
+		p.XAck(bg, entry.stream, r.group(), entry.id)
+		p.XDel(bg, entry.stream, entry.id)
+		return nil
+	})
+	if err != nil {
+		logging.Errorf("[%s] Failed to %s message %s: %s", queue, outcome, msg.ID, err.Error())
+	}
+}
+
+// encodeStreamEntry maps a message to the fields of a stream entry
+func encodeStreamEntry(message Message, opts PublishOptions) (map[string]interface{}, error) {
+
+	values := map[string]interface{}{
+		streamFieldID:   message.ID,
+		streamFieldBody: message.Body,
+	}
+
+	if message.CorrelationID != "" {
+		values[streamFieldCorrelationID] = message.CorrelationID
+	}
+
+	if opts.ContentType != "" {
+		values[streamFieldContentType] = opts.ContentType
+	}
+
+	if opts.ReplyTo != "" {
+		values[streamFieldReplyTo] = opts.ReplyTo
+	}
+
+	if len(opts.Headers) > 0 {
+		headers, err := json.Marshal(opts.Headers)
+		if err != nil {
+			return nil, fmt.Errorf("failed to serialise headers: %s", err.Error())
+		}
+		values[streamFieldHeaders] = string(headers)
+	}
+
+	return values, nil
+}
+
+// requeuedStreamEntry maps a received message back to the fields of a stream entry flagged as redelivered
+func requeuedStreamEntry(msg Message) (map[string]interface{}, error) {
+
+	headers := messageHeaders(msg)
+	delete(headers, "streamID")
+	delete(headers, "stream")
+
+	contentType, _ := headers["contentType"].(string)
+	delete(headers, "contentType")
+
+	replyTo, _ := msg.Options["replyTo"].(string)
+
+	values, err := encodeStreamEntry(msg, PublishOptions{ContentType: contentType, ReplyTo: replyTo, Headers: headers})
+	if err != nil {
+		return nil, err
+	}
+	values[streamFieldRedelivered] = "1"
+
+	return values, nil
+}
+
+// decodeStreamEntry maps a stream entry back to a message.  The stream entry ID stands in for a missing message ID.
+func decodeStreamEntry(stream string, e redis.XMessage, claimed bool) (Message, streamEntry) {
+
+	str := func(key string) string {
+		s, _ := e.Values[key].(string)
+		return s
+	}
+
+	opt := make(map[string]interface{})
+	if headers := str(streamFieldHeaders); headers != "" {
+		if err := json.Unmarshal([]byte(headers), &opt); err != nil {
+			logging.Warningf("[%s] Ignoring malformed headers of message %s: %s", stream, e.ID, err.Error())
+		}
+	}
+
+	if ct := str(streamFieldContentType); ct != "" {
+		opt["contentType"] = ct
+	}
+
+	opt["stream"] = stream
+	opt["streamID"] = e.ID
+	opt["redelivered"] = claimed || str(streamFieldRedelivered) == "1"
+	opt["replyTo"] = str(streamFieldReplyTo)
+
+	if ms, err := strconv.ParseInt(strings.SplitN(e.ID, "-", 2)[0], 10, 64); err == nil {
+		opt["timestamp"] = time.UnixMilli(ms)
+	}
+
+	msg := Message{
+		ID:            str(streamFieldID),
+		CorrelationID: str(streamFieldCorrelationID),
+		Body:          []byte(str(streamFieldBody)),
+		Options:       opt,
+	}
+	if msg.ID == "" {
+		msg.ID = e.ID
+	}
+
+	return msg, streamEntry{stream: stream, id: e.ID}
+}
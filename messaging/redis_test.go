@@ -0,0 +1,193 @@
+package messaging
+
+import (
+	"bufio"
+	"container/list"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	redis "github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStreamEntry(t *testing.T) {
+
+	values, err := encodeStreamEntry(
+		Message{ID: "msg-1", CorrelationID: "corr-1", Body: []byte(`{"connection":"abc"}`)},
+		PublishOptions{ContentType: "application/json", Headers: map[string]interface{}{"x-tenant": "acme", RetryCountHeader: 2}},
+	)
+	assert.Nil(t, err)
+
+	// Redis returns every field value as a string
+	entry := redis.XMessage{ID: "1700000000000-0", Values: map[string]interface{}{}}
+	for k, v := range values {
+		switch s := v.(type) {
+		case []byte:
+			entry.Values[k] = string(s)
+		default:
+			entry.Values[k] = s
+		}
+	}
+
+	msg, located := decodeStreamEntry("etl", entry, false)
+
+	assert.Equal(t, streamEntry{stream: "etl", id: "1700000000000-0"}, located)
+	assert.Equal(t, "msg-1", msg.ID)
+	assert.Equal(t, "corr-1", msg.CorrelationID)
+	assert.Equal(t, `{"connection":"abc"}`, string(msg.Body))
+	assert.Equal(t, "acme", msg.Options["x-tenant"])
+	assert.Equal(t, 2, RetryCount(msg))
+	assert.Equal(t, "application/json", msg.Options["contentType"])
+	assert.Equal(t, "1700000000000-0", msg.Options["streamID"])
+	assert.Equal(t, false, msg.Options["redelivered"])
+	assert.Equal(t, time.UnixMilli(1700000000000), msg.Options["timestamp"])
+
+	requeued, err := requeuedStreamEntry(msg)
+	assert.Nil(t, err)
+	assert.Equal(t, "1", requeued[streamFieldRedelivered])
+	assert.Equal(t, `{"x-retry-count":2,"x-tenant":"acme"}`, requeued[streamFieldHeaders])
+	assert.Equal(t, "application/json", requeued[streamFieldContentType])
+
+	anonymous, _ := decodeStreamEntry("etl", redis.XMessage{ID: "1-0", Values: map[string]interface{}{"body": "{}"}}, true)
+	assert.Equal(t, "1-0", anonymous.ID)
+	assert.Equal(t, true, anonymous.Options["redelivered"])
+}
+
+func TestReceivedEntries(t *testing.T) {
+
+	r := &Redis{MaxReceived: 2, received: make(map[string]*list.Element), order: list.New()}
+
+	for _, id := range []string{"a", "b", "a", "c"} {
+		r.track(Message{ID: id}, streamEntry{stream: "etl", id: id + "-0"})
+	}
+	// A message sent twice is received from two entries
+	r.track(Message{ID: "c"}, streamEntry{stream: "etl", id: "c-1"})
+
+	// The least recently received message is forgotten first
+	assert.Len(t, r.received, 2)
+	assert.Contains(t, r.received, "a")
+	assert.Contains(t, r.received, "c")
+	assert.Len(t, r.received["c"].Value.(*receivedMessage).entries, 2)
+	assert.NotNil(t, r.DeleteMessage("b"))
+}
+
+// fakeRedis returns a client connected to a server answering each command with the reply returned by handle, in
+// the Redis protocol
+func fakeRedis(t *testing.T, handle func(args []string) string) *redis.Client {
+
+	return redis.NewClient(&redis.Options{
+		Dialer: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			client, server := net.Pipe()
+			go func() {
+				defer server.Close()
+				rd := bufio.NewReader(server)
+				for {
+					var n int
+					if _, err := fmt.Fscanf(rd, "*%d\r\n", &n); err != nil {
+						return
+					}
+					args := make([]string, n)
+					for i := range args {
+						var size int
+						if _, err := fmt.Fscanf(rd, "$%d\r\n", &size); err != nil {
+							return
+						}
+						buf := make([]byte, size+2)
+						if _, err := io.ReadFull(rd, buf); err != nil {
+							return
+						}
+						args[i] = string(buf[:size])
+					}
+					if _, err := server.Write([]byte(handle(args))); err != nil {
+						return
+					}
+				}
+			}()
+			return client, nil
+		},
+	})
+}
+
+func TestReclaim(t *testing.T) {
+
+	entry := "*2\r\n$3\r\n1-0\r\n*4\r\n$2\r\nid\r\n$5\r\nmsg-1\r\n$4\r\nbody\r\n$2\r\n{}\r\n"
+
+	tests := []struct {
+		Name  string
+		Reply string
+		Acked []string
+	}{
+		{
+			Name:  "Redis 6.2",
+			Reply: "*2\r\n$3\r\n0-0\r\n*2\r\n" + entry + "*2\r\n$3\r\n2-0\r\n*-1\r\n",
+			Acked: []string{"xack", "etl", "messaging", "2-0"},
+		},
+		{
+			Name:  "Redis 7",
+			Reply: "*3\r\n$3\r\n0-0\r\n*1\r\n" + entry + "*1\r\n$3\r\n2-0\r\n",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+
+			var mu sync.Mutex
+			var claims, acked []string
+			client := fakeRedis(t, func(args []string) string {
+				mu.Lock()
+				defer mu.Unlock()
+				switch strings.ToUpper(args[0]) {
+				case "XAUTOCLAIM":
+					claims = args
+					return test.Reply
+				case "XACK":
+					acked = args
+					return ":1\r\n"
+				}
+				// No new messages
+				return "*-1\r\n"
+			})
+			defer client.Close()
+
+			r := &Redis{Client: client, Consumer: "worker-2", ClaimIdle: time.Minute, Block: time.Millisecond}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			var received []Message
+			r.read(ctx, make(chan struct{}), "etl", "worker-2", 10, func(msg Message, entry streamEntry) {
+				received = append(received, msg)
+				assert.Equal(t, streamEntry{stream: "etl", id: "1-0"}, entry)
+				cancel()
+			})
+
+			mu.Lock()
+			defer mu.Unlock()
+			assert.Equal(t, []string{"XAUTOCLAIM", "etl", "messaging", "worker-2", "60000", "0-0", "COUNT", "10"}, claims)
+			assert.Equal(t, test.Acked, acked)
+			if assert.Len(t, received, 1) {
+				assert.Equal(t, "msg-1", received[0].ID)
+				assert.Equal(t, "{}", string(received[0].Body))
+				assert.Equal(t, true, received[0].Options["redelivered"])
+			}
+		})
+	}
+}
+
+func TestClose(t *testing.T) {
+
+	client := fakeRedis(t, func(args []string) string { return "+PONG\r\n" })
+
+	// A client provided by the caller is left open
+	r := &Redis{Client: client}
+	assert.Nil(t, r.Connect(""))
+	assert.Nil(t, r.Close())
+	assert.Nil(t, client.Ping(context.Background()).Err())
+	client.Close()
+}
@@ -0,0 +1,313 @@
+package messaging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"sync"
+
+	"github.com/9spokes/go/logging/v3"
+)
+
+const (
+	// TypeHeader carries the registered type of a message payload
+	TypeHeader = "x-message-type"
+	// SchemaVersionHeader carries the schema version of a message payload
+	SchemaVersionHeader = "x-schema-version"
+)
+
+// ErrUnknownMessageType is returned when decoding a message whose type is not registered
+var ErrUnknownMessageType = errors.New("unknown message type")
+
+// Upcaster converts a payload of a schema version into the next version
+type Upcaster func(payload map[string]interface{}) (map[string]interface{}, error)
+
+// Registry maps message types to the Go types and JSON Schemas their payloads must conform to, along with the
+// upcasters converting payloads produced against older schema versions into the current one.  Messages encoded
+// through a registry are tagged with the TypeHeader and SchemaVersionHeader headers.
+type Registry struct {
+	// Reject payloads with fields unknown to the registered Go type.  Off by default, so that producers can add
+	// fields before consumers know about them.
+	Strict bool
+
+	mu     sync.RWMutex
+	types  map[string]*messageType
+	byType map[reflect.Type]*messageType
+}
+
+type messageType struct {
+	name     string
+	version  int
+	schema   *Schema
+	versions map[int]*olderVersion
+}
+
+type olderVersion struct {
+	schema   *Schema
+	upcaster Upcaster
+}
+
+// NewRegistry returns an empty registry
+func NewRegistry() *Registry {
+	return &Registry{types: make(map[string]*messageType), byType: make(map[reflect.Type]*messageType)}
+}
+
+// Register registers the current schema version of a message type, whose payloads decode into values of the type
+// of prototype, eg: Register("etl.extract", 2, types.ETLMessage{}, nil).  Payloads are validated against schema if
+// it is not nil, and decoded strictly if the registry is Strict.  A Go type can only be registered once, further
+// types are added with RegisterTarget.
+func (r *Registry) Register(name string, version int, prototype interface{}, schema *Schema) error {
+
+	if name == "" || version < 1 {
+		return fmt.Errorf("invalid message type %s version %d", name, version)
+	}
+
+	t := elemType(prototype)
+	if t == nil {
+		return fmt.Errorf("invalid prototype for message type %s", name)
+	}
+
+	if schema != nil {
+		if err := schema.compile(); err != nil {
+			return fmt.Errorf("invalid schema for message type %s: %s", name, err.Error())
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.types[name]; ok {
+		return fmt.Errorf("message type %s is already registered", name)
+	}
+	if existing, ok := r.byType[t]; ok {
+		return fmt.Errorf("%s is already registered as message type %s", t, existing.name)
+	}
+
+	mt := &messageType{name: name, version: version, schema: schema, versions: make(map[int]*olderVersion)}
+	r.types[name] = mt
+	r.byType[t] = mt
+
+	return nil
+}
+
+// RegisterTarget registers another Go type for the payloads of a registered message type, such as the copy of its
+// struct kept by a service, eg: RegisterTarget("etl.extract", indexer.ETLMessage{}).  Values of the type then
+// decode and encode like those of the type given to Register.  A Go type can only be registered once.
+func (r *Registry) RegisterTarget(name string, prototype interface{}) error {
+
+	t := elemType(prototype)
+	if t == nil {
+		return fmt.Errorf("invalid prototype for message type %s", name)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	mt, ok := r.types[name]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrUnknownMessageType, name)
+	}
+	if existing, ok := r.byType[t]; ok {
+		return fmt.Errorf("%s is already registered as message type %s", t, existing.name)
+	}
+
+	r.byType[t] = mt
+
+	return nil
+}
+
+// RegisterUpcaster registers an older schema version of a message type along with the upcaster converting its
+// payloads into the next version.  Payloads of the older version are validated against schema, if not nil, before
+// being upcast.
+func (r *Registry) RegisterUpcaster(name string, from int, schema *Schema, upcaster Upcaster) error {
+
+	if schema != nil {
+		if err := schema.compile(); err != nil {
+			return fmt.Errorf("invalid schema for message type %s version %d: %s", name, from, err.Error())
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	mt, ok := r.types[name]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrUnknownMessageType, name)
+	}
+	if from < 1 || from >= mt.version {
+		return fmt.Errorf("cannot upcast message type %s from version %d, the current version is %d", name, from, mt.version)
+	}
+
+	mt.versions[from] = &olderVersion{schema: schema, upcaster: upcaster}
+
+	return nil
+}
+
+// Encode validates a value against its registered message type and returns the message carrying it, tagged with
+// its type and current schema version
+func (r *Registry) Encode(v interface{}) (Message, error) {
+
+	mt, err := r.lookupType(v)
+	if err != nil {
+		return Message{}, err
+	}
+
+	body, err := json.Marshal(v)
+	if err != nil {
+		return Message{}, fmt.Errorf("failed to serialise %s message: %s", mt.name, err.Error())
+	}
+
+	if err := mt.schema.Validate(body); err != nil {
+		return Message{}, fmt.Errorf("invalid %s message: %s", mt.name, err.Error())
+	}
+
+	return Message{
+		Body: body,
+		Options: map[string]interface{}{
+			TypeHeader:          mt.name,
+			SchemaVersionHeader: strconv.Itoa(mt.version),
+		},
+	}, nil
+}
+
+// Decode validates the payload of a message, upcasts it to the current schema version and decodes it into v, which
+// must be a pointer to the registered Go type.  Messages without type header are assumed to be of the type of v, and
+// messages without schema version header to be of version 1, as sent by producers predating the registry.
+func (r *Registry) Decode(msg Message, v interface{}) error {
+
+	mt, err := r.lookupType(v)
+	if err != nil {
+		return err
+	}
+
+	if name, ok := msg.Options[TypeHeader].(string); ok && name != mt.name {
+		return fmt.Errorf("cannot decode %s message into %s", name, elemType(v))
+	}
+
+	version := 1
+	if raw, ok := msg.Options[SchemaVersionHeader]; ok {
+		if version, err = parseVersion(raw); err != nil {
+			return fmt.Errorf("invalid %s message: %s", mt.name, err.Error())
+		}
+	}
+
+	body, err := r.upcast(mt, version, msg.Body)
+	if err != nil {
+		return err
+	}
+
+	if err := mt.schema.Validate(body); err != nil {
+		return fmt.Errorf("invalid %s message: %s", mt.name, err.Error())
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(body))
+	if r.Strict {
+		dec.DisallowUnknownFields()
+	}
+	if err := dec.Decode(v); err != nil {
+		return fmt.Errorf("invalid %s message: %s", mt.name, err.Error())
+	}
+
+	return nil
+}
+
+// upcast converts a payload of the given version into the current one
+func (r *Registry) upcast(mt *messageType, version int, body []byte) ([]byte, error) {
+
+	if version > mt.version {
+		return nil, fmt.Errorf("unsupported %s message version %d, the current version is %d", mt.name, version, mt.version)
+	}
+
+	if version == mt.version {
+		return body, nil
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var payload map[string]interface{}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil, fmt.Errorf("invalid %s message version %d: %s", mt.name, version, err.Error())
+	}
+
+	for ; version < mt.version; version++ {
+		older, ok := mt.versions[version]
+		if !ok {
+			return nil, fmt.Errorf("no upcaster for %s message version %d", mt.name, version)
+		}
+
+		b, err := json.Marshal(payload)
+		if err != nil {
+			return nil, err
+		}
+		if err := older.schema.Validate(b); err != nil {
+			return nil, fmt.Errorf("invalid %s message version %d: %s", mt.name, version, err.Error())
+		}
+
+		if payload, err = older.upcaster(payload); err != nil {
+			return nil, fmt.Errorf("failed to upcast %s message from version %d: %s", mt.name, version, err.Error())
+		}
+	}
+
+	return json.Marshal(payload)
+}
+
+func (r *Registry) lookupType(v interface{}) (*messageType, error) {
+
+	t := elemType(v)
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	mt, ok := r.byType[t]
+	if !ok {
+		return nil, fmt.Errorf("%w: no message type registered for %v", ErrUnknownMessageType, t)
+	}
+
+	return mt, nil
+}
+
+// elemType returns the type of v, dereferencing pointers
+func elemType(v interface{}) reflect.Type {
+	t := reflect.TypeOf(v)
+	for t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t
+}
+
+// parseVersion reads a schema version header, which may have been converted to a number by the transport
+func parseVersion(v interface{}) (int, error) {
+	switch n := v.(type) {
+	case string:
+		return strconv.Atoi(n)
+	case int:
+		return n, nil
+	case int32:
+		return int(n), nil
+	case int64:
+		return int(n), nil
+	case float64:
+		return int(n), nil
+	}
+	return 0, fmt.Errorf("invalid schema version %v", v)
+}
+
+// Decoded returns a handler decoding messages with the registry into values of type T before passing them to h.
+// Messages that fail to decode are rejected, as redelivering them would not help.
+func Decoded[T any](r *Registry, h func(ctx context.Context, v T, msg Message) Outcome) Handler {
+	return func(ctx context.Context, msg Message) Outcome {
+
+		var v T
+		if err := r.Decode(msg, &v); err != nil {
+			logging.Errorf("[%s] Rejecting message: %s", msg.ID, err.Error())
+			return Reject
+		}
+
+		return h(ctx, v, msg)
+	}
+}
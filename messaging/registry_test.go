@@ -0,0 +1,117 @@
+package messaging
+
+import (
+	"context"
+	"testing"
+
+	"github.com/9spokes/go/services/indexer"
+	"github.com/9spokes/go/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegistry(t *testing.T) {
+
+	schema, err := ParseSchema([]byte(`{
+		"type": "object",
+		"required": ["connection", "datasource"],
+		"properties": {
+			"connection": {"type": "string", "minLength": 1},
+			"datasource": {"type": "string"},
+			"cycle": {"enum": ["daily", "monthly"]}
+		}
+	}`))
+	assert.Nil(t, err)
+
+	r := NewRegistry()
+	assert.Nil(t, r.Register("etl.extract", 2, types.ETLMessage{}, schema))
+	assert.NotNil(t, r.Register("etl.other", 1, &types.ETLMessage{}, nil))
+
+	// Version 1 named the datasource "source"
+	assert.Nil(t, r.RegisterUpcaster("etl.extract", 1, nil, func(p map[string]interface{}) (map[string]interface{}, error) {
+		p["datasource"] = p["source"]
+		delete(p, "source")
+		return p, nil
+	}))
+
+	msg, err := r.Encode(types.ETLMessage{Connection: "abc", Datasource: "invoices", Cycle: "daily"})
+	assert.Nil(t, err)
+	assert.Equal(t, "etl.extract", msg.Options[TypeHeader])
+	assert.Equal(t, "2", msg.Options[SchemaVersionHeader])
+
+	_, err = r.Encode(types.ETLMessage{Connection: "abc", Datasource: "invoices", Cycle: "yearly"})
+	assert.NotNil(t, err)
+
+	_, err = r.Encode(struct{}{})
+	assert.ErrorIs(t, err, ErrUnknownMessageType)
+
+	var decoded types.ETLMessage
+	assert.Nil(t, r.Decode(msg, &decoded))
+	assert.Equal(t, "invoices", decoded.Datasource)
+
+	tests := []struct {
+		name    string
+		msg     Message
+		want    string
+		invalid bool
+	}{
+		{name: "legacy message without headers", msg: Message{Body: []byte(`{"connection":"abc","source":"bills"}`)}, want: "bills"},
+		{name: "version as number", msg: Message{Body: []byte(`{"connection":"abc","datasource":"bills"}`), Options: map[string]interface{}{SchemaVersionHeader: int32(2)}}, want: "bills"},
+		{name: "newer version", msg: Message{Body: msg.Body, Options: map[string]interface{}{SchemaVersionHeader: "3"}}, invalid: true},
+		{name: "other type", msg: Message{Body: msg.Body, Options: map[string]interface{}{TypeHeader: "etl.index"}}, invalid: true},
+		{name: "schema violation", msg: Message{Body: []byte(`{"connection":""}`), Options: msg.Options}, invalid: true},
+		{name: "unknown field", msg: Message{Body: []byte(`{"connection":"abc","datasource":"bills","added":"ok"}`), Options: msg.Options}, want: "bills"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var v types.ETLMessage
+			err := r.Decode(test.msg, &v)
+			if test.invalid {
+				assert.NotNil(t, err)
+				return
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, test.want, v.Datasource)
+		})
+	}
+
+	r.Strict = true
+	assert.NotNil(t, r.Decode(Message{Body: []byte(`{"connection":"abc","datasource":"bills","added":"ok"}`), Options: msg.Options}, &decoded))
+	r.Strict = false
+
+	h := Decoded(r, func(ctx context.Context, v types.ETLMessage, msg Message) Outcome { return Ack })
+	assert.Equal(t, Ack, h(context.Background(), msg))
+	assert.Equal(t, Reject, h(context.Background(), Message{Body: []byte("{")}))
+
+	// The indexer keeps its own copy of the message struct
+	assert.ErrorIs(t, r.RegisterTarget("etl.index", indexer.ETLMessage{}), ErrUnknownMessageType)
+	assert.Nil(t, r.RegisterTarget("etl.extract", &indexer.ETLMessage{}))
+	assert.NotNil(t, r.RegisterTarget("etl.extract", indexer.ETLMessage{}))
+
+	var indexed indexer.ETLMessage
+	assert.Nil(t, r.Decode(Message{Body: []byte(`{"connection":"abc","source":"bills"}`)}, &indexed))
+	assert.Equal(t, "bills", indexed.Datasource)
+	assert.Nil(t, r.Decode(msg, &indexed))
+	assert.Equal(t, "invoices", indexed.Datasource)
+	assert.NotNil(t, r.Decode(Message{Body: msg.Body, Options: map[string]interface{}{TypeHeader: "etl.index"}}, &indexed))
+
+	encoded, err := r.Encode(indexer.ETLMessage{Connection: "abc", Datasource: "bills", Cycle: "daily"})
+	assert.Nil(t, err)
+	assert.Equal(t, "etl.extract", encoded.Options[TypeHeader])
+}
+
+func TestParseSchema(t *testing.T) {
+
+	_, err := ParseSchema([]byte(`{"$schema": "http://json-schema.org/draft-07/schema#", "title": "ETL", "type": "object"}`))
+	assert.Nil(t, err)
+
+	for _, schema := range []string{
+		`{"$ref": "#/definitions/etl"}`,
+		`{"type": "object", "properties": {"id": {"type": "string", "format": "uuid"}}}`,
+		`{"oneOf": [{"type": "string"}, {"type": "integer"}]}`,
+		`{"type": "array", "items": {"allOf": []}}`,
+	} {
+		_, err := ParseSchema([]byte(schema))
+		assert.NotNil(t, err, schema)
+	}
+}
@@ -0,0 +1,222 @@
+package messaging
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/9spokes/go/logging/v3"
+	"github.com/streadway/amqp"
+)
+
+// RetryCountHeader is the message header counting the number of times a message has been retried
+const RetryCountHeader = "x-retry-count"
+
+// deliveryKeys are the Message options populated from delivery metadata rather than from message headers
+var deliveryKeys = []string{"timestamp", "priority", "messageCount", "exchange", "routingKey", "redelivered", "replyTo"}
+
+// RetryPolicy describes how failed messages of a queue are retried.  Each retry waits in a delay queue whose
+// messages expire back into the work queue, and messages failing their last attempt are parked in a dead-letter
+// queue from which they can be replayed.
+type RetryPolicy struct {
+	Queue       string          // Name of the work queue
+	Delays      []time.Duration // Delay before each retry, the last one reused for further ones, none to retry at once
+	MaxAttempts int             // Total number of attempts including the first, defaults to len(Delays)+1
+}
+
+// DeadLetterExchange returns the name of the exchange dead-lettering messages of the work queue
+func (p RetryPolicy) DeadLetterExchange() string {
+	return p.Queue + ".dlx"
+}
+
+// DeadLetterQueue returns the name of the queue where messages are parked after their last attempt
+func (p RetryPolicy) DeadLetterQueue() string {
+	return p.Queue + ".dlq"
+}
+
+// DelayQueue returns the name of the queue holding messages waiting for the given retry, counting from 1, or the
+// work queue itself if the policy has no delays
+func (p RetryPolicy) DelayQueue(retry int) string {
+	if len(p.Delays) == 0 {
+		return p.Queue
+	}
+	return fmt.Sprintf("%s.retry.%s", p.Queue, p.delay(retry))
+}
+
+func (p RetryPolicy) delay(retry int) time.Duration {
+	if len(p.Delays) == 0 {
+		return 0
+	}
+	if retry > len(p.Delays) {
+		retry = len(p.Delays)
+	}
+	if retry < 1 {
+		retry = 1
+	}
+	return p.Delays[retry-1]
+}
+
+func (p RetryPolicy) maxAttempts() int {
+	if p.MaxAttempts > 0 {
+		return p.MaxAttempts
+	}
+	return len(p.Delays) + 1
+}
+
+// RetryCount returns the number of times a message has already been retried
+func RetryCount(msg Message) int {
+	switch v := msg.Options[RetryCountHeader].(type) {
+	case int:
+		return v
+	case int16:
+		return int(v)
+	case int32:
+		return int(v)
+	case int64:
+		return int(v)
+	case uint8:
+		return int(v)
+	case float64:
+		// Headers serialised as JSON, such as those of the Redis transport
+		return int(v)
+	case json.Number:
+		n, _ := v.Int64()
+		return int(n)
+	}
+	return 0
+}
+
+// Wrap returns a handler applying the retry policy to the outcome of h.  When h returns Requeue, the message is
+// acknowledged and a copy with an incremented retry count is published to the delay queue of the next attempt, or
+// straight back to the work queue if the policy has no delays, or, after the last attempt, rejected into the
+// dead-letter queue.  If the copy cannot be published the message is requeued immediately so that it is not lost.
+func (p RetryPolicy) Wrap(t Transport, h Handler) Handler {
+	return func(ctx context.Context, msg Message) Outcome {
+
+		outcome := h(ctx, msg)
+		if outcome != Requeue {
+			return outcome
+		}
+
+		retry := RetryCount(msg) + 1
+		if retry >= p.maxAttempts() {
+			logging.Warningf("[%s] Message %s failed after %d attempts, parking it in %s", p.Queue, msg.ID, retry, p.DeadLetterQueue())
+			return Reject
+		}
+
+		headers := messageHeaders(msg)
+		headers[RetryCountHeader] = int32(retry)
+
+		logging.Debugf("[%s] Retrying message %s in %s (retry #%d)", p.Queue, msg.ID, p.delay(retry), retry)
+		if err := t.SendMessage(p.DelayQueue(retry), Message{ID: msg.ID, CorrelationID: msg.CorrelationID, Body: msg.Body, Options: headers}); err != nil {
+			logging.Errorf("[%s] Failed to schedule retry of message %s, requeueing it: %s", p.Queue, msg.ID, err.Error())
+			return Requeue
+		}
+
+		return Ack
+	}
+}
+
+// messageHeaders returns a copy of the headers of a received message, excluding its delivery metadata
+func messageHeaders(msg Message) map[string]interface{} {
+
+	headers := make(map[string]interface{}, len(msg.Options))
+	for k, v := range msg.Options {
+		headers[k] = v
+	}
+	for _, k := range deliveryKeys {
+		delete(headers, k)
+	}
+
+	return headers
+}
+
+// DeclareRetryTopology declares the work queue of the policy with its dead-letter exchange and queue, along with a
+// delay queue per distinct retry delay.  The work queue must not already exist with different arguments.
+func (_amqp *AMQP) DeclareRetryTopology(p RetryPolicy) error {
+
+	dlx := ExchangeOptions{Name: p.DeadLetterExchange(), Kind: ExchangeFanout, Durable: true}
+	if err := _amqp.DeclareExchange(dlx); err != nil {
+		return fmt.Errorf("failed to declare dead-letter exchange %s: %s", p.DeadLetterExchange(), err.Error())
+	}
+
+	dlq := QueueOptions{Durable: true, Bindings: []Binding{{Exchange: p.DeadLetterExchange()}}}
+	if err := _amqp.DeclareQueue(p.DeadLetterQueue(), dlq); err != nil {
+		return fmt.Errorf("failed to declare dead-letter queue %s: %s", p.DeadLetterQueue(), err.Error())
+	}
+
+	work := QueueOptions{Durable: true, Args: amqp.Table{"x-dead-letter-exchange": p.DeadLetterExchange()}}
+	if err := _amqp.DeclareQueue(p.Queue, work); err != nil {
+		return fmt.Errorf("failed to declare queue %s: %s", p.Queue, err.Error())
+	}
+
+	declared := make(map[string]bool)
+	for retry := 1; retry <= len(p.Delays); retry++ {
+		name := p.DelayQueue(retry)
+		if declared[name] {
+			continue
+		}
+		declared[name] = true
+
+		err := _amqp.DeclareQueue(name, QueueOptions{Durable: true, Args: amqp.Table{
+			"x-message-ttl":             p.delay(retry).Milliseconds(),
+			"x-dead-letter-exchange":    "",
+			"x-dead-letter-routing-key": p.Queue,
+		}})
+		if err != nil {
+			return fmt.Errorf("failed to declare delay queue %s: %s", name, err.Error())
+		}
+	}
+
+	return nil
+}
+
+// ReplayDeadLetters moves up to limit messages (or all of them if limit is zero) from the dead-letter queue of the
+// policy back to its work queue, resetting their retry count.  It returns the number of messages replayed.
+func (_amqp *AMQP) ReplayDeadLetters(p RetryPolicy, limit int) (int, error) {
+
+	_amqp.mu.Lock()
+	conn := _amqp.Connection
+	_amqp.mu.Unlock()
+
+	if conn == nil || conn.IsClosed() {
+		return 0, ErrNotConnected
+	}
+
+	ch, err := conn.Channel()
+	if err != nil {
+		return 0, err
+	}
+	defer ch.Close()
+
+	replayed := 0
+	for limit == 0 || replayed < limit {
+
+		d, ok, err := ch.Get(p.DeadLetterQueue(), false)
+		if err != nil {
+			return replayed, fmt.Errorf("failed to read from dead-letter queue: %s", err.Error())
+		}
+		if !ok {
+			break
+		}
+
+		headers := messageHeaders(toMessage(d))
+		delete(headers, RetryCountHeader)
+		delete(headers, "x-death")
+
+		if err := _amqp.SendMessage(p.Queue, Message{ID: d.MessageId, CorrelationID: d.CorrelationId, Body: d.Body, Options: headers}); err != nil {
+			d.Nack(false, true)
+			return replayed, fmt.Errorf("failed to replay message %s: %s", d.MessageId, err.Error())
+		}
+
+		if err := d.Ack(false); err != nil {
+			return replayed, fmt.Errorf("failed to remove replayed message %s from dead-letter queue: %s", d.MessageId, err.Error())
+		}
+
+		replayed++
+	}
+
+	logging.Infof("[%s] Replayed %d dead-lettered messages", p.Queue, replayed)
+	return replayed, nil
+}
@@ -0,0 +1,97 @@
+package messaging
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// recorder is a Transport recording the messages sent through it
+type recorder struct {
+	sent map[string][]Message
+	err  error
+}
+
+func (r *recorder) Connect(string) error { return nil }
+func (r *recorder) SendMessage(queue string, msg Message) error {
+	if r.err != nil {
+		return r.err
+	}
+	if r.sent == nil {
+		r.sent = make(map[string][]Message)
+	}
+	r.sent[queue] = append(r.sent[queue], msg)
+	return nil
+}
+func (r *recorder) DeleteMessage(string) error                       { return nil }
+func (r *recorder) CreateQueue(string, map[string]interface{}) error { return nil }
+func (r *recorder) ReceiveMessages(string, map[string]interface{}) (<-chan Message, error) {
+	return nil, nil
+}
+
+func TestRetryPolicy(t *testing.T) {
+
+	policy := RetryPolicy{Queue: "etl", Delays: []time.Duration{time.Second, time.Minute}, MaxAttempts: 4}
+
+	assert.Equal(t, "etl.dlx", policy.DeadLetterExchange())
+	assert.Equal(t, "etl.dlq", policy.DeadLetterQueue())
+	assert.Equal(t, "etl.retry.1s", policy.DelayQueue(1))
+	assert.Equal(t, "etl.retry.1m0s", policy.DelayQueue(2))
+	assert.Equal(t, "etl.retry.1m0s", policy.DelayQueue(3))
+
+	failing := func(context.Context, Message) Outcome { return Requeue }
+
+	t.Run("successful messages are left alone", func(t *testing.T) {
+		r := &recorder{}
+		h := policy.Wrap(r, func(context.Context, Message) Outcome { return Ack })
+		assert.Equal(t, Ack, h(context.Background(), Message{}))
+		assert.Empty(t, r.sent)
+	})
+
+	t.Run("failed messages are delayed with an incremented retry count", func(t *testing.T) {
+		r := &recorder{}
+		h := policy.Wrap(r, failing)
+
+		msg := Message{ID: "1", Body: []byte("{}"), Options: map[string]interface{}{
+			"routingKey":     "etl",
+			"x-custom":       "kept",
+			RetryCountHeader: int32(1),
+		}}
+
+		assert.Equal(t, Ack, h(context.Background(), msg))
+		if assert.Len(t, r.sent["etl.retry.1m0s"], 1) {
+			sent := r.sent["etl.retry.1m0s"][0]
+			assert.Equal(t, "1", sent.ID)
+			assert.Equal(t, 2, RetryCount(sent))
+			assert.Equal(t, "kept", sent.Options["x-custom"])
+			assert.NotContains(t, sent.Options, "routingKey")
+		}
+	})
+
+	t.Run("messages are retried immediately without delays", func(t *testing.T) {
+		r := &recorder{}
+		h := RetryPolicy{Queue: "etl", MaxAttempts: 3}.Wrap(r, failing)
+
+		assert.Equal(t, Ack, h(context.Background(), Message{ID: "1"}))
+		if assert.Len(t, r.sent["etl"], 1) {
+			assert.Equal(t, 1, RetryCount(r.sent["etl"][0]))
+		}
+		assert.Len(t, r.sent, 1)
+	})
+
+	t.Run("messages are dead-lettered after the last attempt", func(t *testing.T) {
+		r := &recorder{}
+		h := policy.Wrap(r, failing)
+		assert.Equal(t, Reject, h(context.Background(), Message{Options: map[string]interface{}{RetryCountHeader: int64(3)}}))
+		assert.Empty(t, r.sent)
+	})
+
+	t.Run("messages are requeued if the retry cannot be scheduled", func(t *testing.T) {
+		r := &recorder{err: errors.New("broker down")}
+		h := policy.Wrap(r, failing)
+		assert.Equal(t, Requeue, h(context.Background(), Message{}))
+	})
+}
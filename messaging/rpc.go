@@ -0,0 +1,224 @@
+package messaging
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/9spokes/go/logging/v3"
+	"github.com/9spokes/go/middleware/recoverer"
+	"github.com/9spokes/go/misc"
+	"github.com/streadway/amqp"
+)
+
+const (
+	// DefaultCallTimeout is how long Call waits for a reply when the context has no deadline
+	DefaultCallTimeout = 30 * time.Second
+	// DirectReplyToQueue is the pseudo-queue RabbitMQ delivers replies through when direct reply-to is enabled
+	DirectReplyToQueue = "amq.rabbitmq.reply-to"
+	// RPCErrorHeader carries the error returned by the handler of a request in place of a reply
+	RPCErrorHeader = "x-rpc-error"
+)
+
+// RemoteError is returned by Call when the handler of the request failed
+type RemoteError struct {
+	Message string
+}
+
+func (e *RemoteError) Error() string {
+	return "remote error: " + e.Message
+}
+
+// RPCHandler handles a request received by Serve and returns the reply.  Only the ID, Body and Options (sent as
+// headers) of the reply are used.
+type RPCHandler func(ctx context.Context, request Message) (Message, error)
+
+// RPCTransport is implemented by the transports Serve can answer requests on
+type RPCTransport interface {
+	Consumer
+	Publish(key string, message Message, opts PublishOptions) error
+}
+
+// rpcReplies routes the replies received on the reply queue of a connection to the pending calls
+type rpcReplies struct {
+	replyTo string
+	calls   map[string]chan Message
+}
+
+// Call sends a request to a queue and waits for the reply until ctx is done, or for DefaultCallTimeout if ctx has
+// no deadline.  The request expires from the queue along with the call.  A correlation ID is generated unless the
+// request has one.  Replies are received on an exclusive, auto-delete queue of the connection, or through direct
+// reply-to if DirectReplyTo is set.
+func (_amqp *AMQP) Call(ctx context.Context, queue string, request Message) (Message, error) {
+
+	opts, err := PublishOptionsFromMap(request.Options)
+	if err != nil {
+		return Message{}, fmt.Errorf("Failed to send request: %s", err.Error())
+	}
+
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, DefaultCallTimeout)
+		defer cancel()
+	}
+
+	deadline, _ := ctx.Deadline()
+	if opts.TTL == 0 || opts.TTL > time.Until(deadline) {
+		opts.TTL = time.Until(deadline)
+		if opts.TTL < time.Millisecond {
+			return Message{}, fmt.Errorf("Failed to send request: %s", context.DeadlineExceeded.Error())
+		}
+	}
+
+	if request.CorrelationID == "" {
+		request.CorrelationID = misc.GenUUIDv4()
+	}
+
+	reply := make(chan Message, 1)
+
+	_amqp.mu.Lock()
+	replies, err := _amqp.listenForReplies()
+	if err == nil {
+		replies.calls[request.CorrelationID] = reply
+	}
+	_amqp.mu.Unlock()
+
+	if err != nil {
+		return Message{}, fmt.Errorf("Failed to receive replies: %s", err.Error())
+	}
+
+	defer func() {
+		_amqp.mu.Lock()
+		delete(replies.calls, request.CorrelationID)
+		_amqp.mu.Unlock()
+	}()
+
+	opts.ReplyTo = replies.replyTo
+
+	publish := _amqp.Publish
+	if _amqp.publish != nil {
+		publish = _amqp.publish
+	}
+
+	logging.Debugf("[%s] Sending request %s", queue, request.CorrelationID)
+	if err := publish(queue, request, opts); err != nil {
+		return Message{}, err
+	}
+
+	select {
+	case msg, ok := <-reply:
+		if !ok {
+			return Message{}, fmt.Errorf("connection lost while waiting for the reply to request %s", request.CorrelationID)
+		}
+		if e, ok := msg.Options[RPCErrorHeader].(string); ok {
+			return Message{}, &RemoteError{Message: e}
+		}
+		return msg, nil
+	case <-ctx.Done():
+		return Message{}, fmt.Errorf("no reply to request %s: %s", request.CorrelationID, ctx.Err().Error())
+	}
+}
+
+// listenForReplies starts consuming the reply queue of the current channel if not done yet.  The caller must hold
+// _amqp.mu.
+func (_amqp *AMQP) listenForReplies() (*rpcReplies, error) {
+
+	if _amqp.replies != nil {
+		return _amqp.replies, nil
+	}
+
+	if _amqp.Channel == nil || _amqp.closed {
+		return nil, ErrNotConnected
+	}
+
+	ch := _amqp.Channel
+
+	replyTo := DirectReplyToQueue
+	if !_amqp.DirectReplyTo {
+		q, err := ch.QueueDeclare("", false, true, true, false, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to declare reply queue: %s", err.Error())
+		}
+		replyTo = q.Name
+	}
+
+	deliveries, err := ch.Consume(replyTo, "", true, true, false, false, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to consume reply queue %s: %s", replyTo, err.Error())
+	}
+
+	replies := &rpcReplies{replyTo: replyTo, calls: make(map[string]chan Message)}
+	_amqp.replies = replies
+
+	_amqp.wg.Add(1)
+	go _amqp.routeReplies(replies, deliveries)
+
+	return replies, nil
+}
+
+// routeReplies hands the replies delivered on the reply queue over to the pending calls they correlate to, until the
+// channel is closed
+func (_amqp *AMQP) routeReplies(replies *rpcReplies, deliveries <-chan amqp.Delivery) {
+
+	defer _amqp.wg.Done()
+	defer recoverer.RecoverGoroutinePanic("AMQP reply consumer", nil, nil)
+
+	for d := range deliveries {
+		_amqp.mu.Lock()
+		call, ok := replies.calls[d.CorrelationId]
+		delete(replies.calls, d.CorrelationId)
+		_amqp.mu.Unlock()
+
+		if !ok {
+			logging.Warningf("[%s] Discarding reply to unknown or expired request %s", replies.replyTo, d.CorrelationId)
+			continue
+		}
+		call <- toMessage(d)
+	}
+
+	// The channel was closed: the reply queue is gone along with it, so pending calls cannot get a reply
+	_amqp.mu.Lock()
+	if _amqp.replies == replies {
+		_amqp.replies = nil
+	}
+	for id, call := range replies.calls {
+		close(call)
+		delete(replies.calls, id)
+	}
+	_amqp.mu.Unlock()
+}
+
+// Serve consumes requests from a queue until ctx is cancelled, passing them to handler and publishing its reply to
+// the queue named by the reply-to property of the request, with the same correlation ID.  An error returned by the
+// handler is sent back in the RPCErrorHeader header.  Requests without a reply-to property are rejected.
+func Serve(ctx context.Context, t RPCTransport, queue string, handler RPCHandler, opts ConsumeOptions) error {
+
+	return t.Consume(ctx, queue, func(ctx context.Context, request Message) Outcome {
+
+		replyTo, _ := request.Options["replyTo"].(string)
+		if replyTo == "" {
+			logging.Warningf("[%s] Rejecting request %s without a reply-to queue", queue, request.CorrelationID)
+			return Reject
+		}
+
+		reply, err := handler(ctx, request)
+
+		headers := make(map[string]interface{}, len(reply.Options)+1)
+		for k, v := range reply.Options {
+			headers[k] = v
+		}
+		if err != nil {
+			logging.Warningf("[%s] Request %s failed: %s", queue, request.CorrelationID, err.Error())
+			reply.Body = nil
+			headers = map[string]interface{}{RPCErrorHeader: err.Error()}
+		}
+
+		msg := Message{ID: reply.ID, CorrelationID: request.CorrelationID, Body: reply.Body}
+		if err := t.Publish(replyTo, msg, PublishOptions{Headers: headers}); err != nil {
+			logging.Errorf("[%s] Failed to reply to request %s: %s", queue, request.CorrelationID, err.Error())
+			return Requeue
+		}
+
+		return Ack
+	}, opts)
+}
@@ -0,0 +1,142 @@
+package messaging
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServe(t *testing.T) {
+
+	m := NewMemory()
+	assert.Nil(t, m.CreateQueue("validate", nil))
+	assert.Nil(t, m.CreateQueue("replies", nil))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go Serve(ctx, m, "validate", func(ctx context.Context, request Message) (Message, error) {
+		if string(request.Body) == "bad" {
+			return Message{}, fmt.Errorf("invalid credentials")
+		}
+		return Message{Body: []byte("ok"), Options: map[string]interface{}{"x-osp": "xero"}}, nil
+	}, ConsumeOptions{})
+
+	assert.Nil(t, m.Publish("validate", Message{CorrelationID: "1", Body: []byte("good")}, PublishOptions{ReplyTo: "replies"}))
+	assert.Nil(t, m.Publish("validate", Message{CorrelationID: "2", Body: []byte("bad")}, PublishOptions{ReplyTo: "replies"}))
+	assert.Nil(t, m.Publish("validate", Message{CorrelationID: "3"}, PublishOptions{}))
+
+	replies, err := m.WaitForPublished("replies", 2, time.Second)
+	if assert.Nil(t, err) {
+		assert.Equal(t, "1", replies[0].CorrelationID)
+		assert.Equal(t, "ok", string(replies[0].Body))
+		assert.Equal(t, "xero", replies[0].Options["x-osp"])
+
+		assert.Equal(t, "2", replies[1].CorrelationID)
+		assert.Equal(t, "invalid credentials", replies[1].Options[RPCErrorHeader])
+	}
+}
+
+// testCaller returns a client whose replies are delivered on the returned channel and whose requests are handed over
+// to send instead of a broker
+func testCaller(send func(key string, request Message, opts PublishOptions)) (*AMQP, chan amqp.Delivery) {
+
+	deliveries := make(chan amqp.Delivery)
+
+	a := &AMQP{}
+	a.replies = &rpcReplies{replyTo: "replies", calls: make(map[string]chan Message)}
+	a.publish = func(key string, request Message, opts PublishOptions) error {
+		send(key, request, opts)
+		return nil
+	}
+
+	a.wg.Add(1)
+	go a.routeReplies(a.replies, deliveries)
+
+	return a, deliveries
+}
+
+func pendingCalls(a *AMQP) int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return len(a.replies.calls)
+}
+
+func TestCall(t *testing.T) {
+
+	var deliveries chan amqp.Delivery
+	var a *AMQP
+	a, deliveries = testCaller(func(key string, request Message, opts PublishOptions) {
+		assert.Equal(t, "validate", key)
+		assert.Equal(t, "replies", opts.ReplyTo)
+		go func() {
+			// Replies to other requests are discarded
+			deliveries <- amqp.Delivery{CorrelationId: "unknown", Body: []byte("wrong")}
+			if string(request.Body) == "bad" {
+				deliveries <- amqp.Delivery{CorrelationId: request.CorrelationID, Headers: amqp.Table{RPCErrorHeader: "invalid credentials"}}
+				return
+			}
+			deliveries <- amqp.Delivery{CorrelationId: request.CorrelationID, Body: []byte("ok")}
+		}()
+	})
+	defer close(deliveries)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	reply, err := a.Call(ctx, "validate", Message{CorrelationID: "1", Body: []byte("good")})
+	if assert.Nil(t, err) {
+		assert.Equal(t, "1", reply.CorrelationID)
+		assert.Equal(t, "ok", string(reply.Body))
+	}
+
+	_, err = a.Call(ctx, "validate", Message{CorrelationID: "2", Body: []byte("bad")})
+	assert.Equal(t, &RemoteError{Message: "invalid credentials"}, err)
+
+	assert.Zero(t, pendingCalls(a))
+}
+
+func TestCallTimeout(t *testing.T) {
+
+	a, deliveries := testCaller(func(key string, request Message, opts PublishOptions) {
+		assert.LessOrEqual(t, opts.TTL, 50*time.Millisecond)
+	})
+	defer close(deliveries)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	_, err := a.Call(ctx, "validate", Message{CorrelationID: "1"})
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "no reply to request 1")
+	}
+
+	// A late reply is discarded
+	deliveries <- amqp.Delivery{CorrelationId: "1"}
+	assert.Zero(t, pendingCalls(a))
+}
+
+func TestCallConnectionLost(t *testing.T) {
+
+	var deliveries chan amqp.Delivery
+	var a *AMQP
+	a, deliveries = testCaller(func(key string, request Message, opts PublishOptions) {
+		// The channel is closed while the reply is pending
+		close(deliveries)
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	_, err := a.Call(ctx, "validate", Message{CorrelationID: "1"})
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "connection lost while waiting for the reply to request 1")
+	}
+
+	a.wg.Wait()
+	assert.Nil(t, a.replies)
+}
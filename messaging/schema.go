@@ -0,0 +1,304 @@
+package messaging
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Schema is a JSON Schema supporting the subset of keywords needed to describe message payloads: type, properties,
+// required, additionalProperties (as a boolean), items, enum, minimum, maximum, minLength, maxLength, pattern,
+// minItems and maxItems.  Other keywords, such as $ref, oneOf or format, are rejected by ParseSchema rather than
+// ignored, so that a schema never accepts more than it says.  Annotations ($schema, $id, $comment, title,
+// description, default, examples) are allowed.
+type Schema struct {
+	Type                 SchemaTypes        `json:"type,omitempty"`
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	Required             []string           `json:"required,omitempty"`
+	AdditionalProperties *bool              `json:"additionalProperties,omitempty"`
+	Items                *Schema            `json:"items,omitempty"`
+	Enum                 []interface{}      `json:"enum,omitempty"`
+	Minimum              *float64           `json:"minimum,omitempty"`
+	Maximum              *float64           `json:"maximum,omitempty"`
+	MinLength            *int               `json:"minLength,omitempty"`
+	MaxLength            *int               `json:"maxLength,omitempty"`
+	Pattern              string             `json:"pattern,omitempty"`
+	MinItems             *int               `json:"minItems,omitempty"`
+	MaxItems             *int               `json:"maxItems,omitempty"`
+
+	pattern     *regexp.Regexp
+	unsupported []string
+}
+
+// schemaKeywords are the keywords a Schema understands or may safely ignore
+var schemaKeywords = map[string]bool{
+	"type": true, "properties": true, "required": true, "additionalProperties": true, "items": true, "enum": true,
+	"minimum": true, "maximum": true, "minLength": true, "maxLength": true, "pattern": true, "minItems": true,
+	"maxItems": true,
+	// Annotations
+	"$schema": true, "$id": true, "$comment": true, "title": true, "description": true, "default": true, "examples": true,
+}
+
+// UnmarshalJSON records the keywords which are not supported, for compile to reject them
+func (s *Schema) UnmarshalJSON(b []byte) error {
+
+	var keywords map[string]json.RawMessage
+	if err := json.Unmarshal(b, &keywords); err != nil {
+		return err
+	}
+
+	// Decode the supported keywords without recursing into this method
+	type schema Schema
+	if err := json.Unmarshal(b, (*schema)(s)); err != nil {
+		return err
+	}
+
+	s.unsupported = nil
+	for k := range keywords {
+		if !schemaKeywords[k] {
+			s.unsupported = append(s.unsupported, k)
+		}
+	}
+	sort.Strings(s.unsupported)
+
+	return nil
+}
+
+// SchemaTypes is the "type" keyword of a schema, either a single type name or a list of them
+type SchemaTypes []string
+
+// UnmarshalJSON accepts both a single type name and a list of type names
+func (t *SchemaTypes) UnmarshalJSON(b []byte) error {
+
+	var one string
+	if err := json.Unmarshal(b, &one); err == nil {
+		*t = SchemaTypes{one}
+		return nil
+	}
+
+	var many []string
+	if err := json.Unmarshal(b, &many); err != nil {
+		return fmt.Errorf("type must be a string or an array of strings")
+	}
+	*t = many
+
+	return nil
+}
+
+// ParseSchema parses a JSON Schema document
+func ParseSchema(b []byte) (*Schema, error) {
+
+	var s Schema
+	if err := json.Unmarshal(b, &s); err != nil {
+		return nil, fmt.Errorf("failed to parse schema: %s", err.Error())
+	}
+
+	if err := s.compile(); err != nil {
+		return nil, err
+	}
+
+	return &s, nil
+}
+
+// compile checks the keywords of the schema and compiles its patterns
+func (s *Schema) compile() error {
+
+	if len(s.unsupported) > 0 {
+		return fmt.Errorf("unsupported schema keywords: %s", strings.Join(s.unsupported, ", "))
+	}
+
+	for _, t := range s.Type {
+		switch t {
+		case "object", "array", "string", "number", "integer", "boolean", "null":
+		default:
+			return fmt.Errorf("invalid schema type '%s'", t)
+		}
+	}
+
+	if s.Pattern != "" && s.pattern == nil {
+		re, err := regexp.Compile(s.Pattern)
+		if err != nil {
+			return fmt.Errorf("invalid schema pattern '%s': %s", s.Pattern, err.Error())
+		}
+		s.pattern = re
+	}
+
+	for _, p := range s.Properties {
+		if err := p.compile(); err != nil {
+			return err
+		}
+	}
+
+	if s.Items != nil {
+		return s.Items.compile()
+	}
+
+	return nil
+}
+
+// Validate checks a JSON document against the schema
+func (s *Schema) Validate(payload []byte) error {
+
+	if s == nil {
+		return nil
+	}
+
+	var v interface{}
+	if err := json.Unmarshal(payload, &v); err != nil {
+		return fmt.Errorf("invalid JSON: %s", err.Error())
+	}
+
+	return s.validate("$", v)
+}
+
+// validate checks a value decoded by encoding/json against the schema
+func (s *Schema) validate(path string, v interface{}) error {
+
+	if len(s.Type) > 0 {
+		matched := false
+		for _, t := range s.Type {
+			if jsonTypeMatches(t, v) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return fmt.Errorf("%s: expected %s, got %s", path, strings.Join(s.Type, " or "), jsonType(v))
+		}
+	}
+
+	if len(s.Enum) > 0 {
+		found := false
+		for _, e := range s.Enum {
+			if reflect.DeepEqual(normaliseJSON(e), v) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("%s: value %v is not one of %v", path, v, s.Enum)
+		}
+	}
+
+	switch value := v.(type) {
+
+	case map[string]interface{}:
+		for _, name := range s.Required {
+			if _, ok := value[name]; !ok {
+				return fmt.Errorf("%s: missing required property '%s'", path, name)
+			}
+		}
+
+		names := make([]string, 0, len(value))
+		for name := range value {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			p, ok := s.Properties[name]
+			if !ok {
+				if s.AdditionalProperties != nil && !*s.AdditionalProperties {
+					return fmt.Errorf("%s: unexpected property '%s'", path, name)
+				}
+				continue
+			}
+			if err := p.validate(path+"."+name, value[name]); err != nil {
+				return err
+			}
+		}
+
+	case []interface{}:
+		if s.MinItems != nil && len(value) < *s.MinItems {
+			return fmt.Errorf("%s: expected at least %d items, got %d", path, *s.MinItems, len(value))
+		}
+		if s.MaxItems != nil && len(value) > *s.MaxItems {
+			return fmt.Errorf("%s: expected at most %d items, got %d", path, *s.MaxItems, len(value))
+		}
+		if s.Items != nil {
+			for i, item := range value {
+				if err := s.Items.validate(fmt.Sprintf("%s[%d]", path, i), item); err != nil {
+					return err
+				}
+			}
+		}
+
+	case string:
+		n := len([]rune(value))
+		if s.MinLength != nil && n < *s.MinLength {
+			return fmt.Errorf("%s: expected at least %d characters, got %d", path, *s.MinLength, n)
+		}
+		if s.MaxLength != nil && n > *s.MaxLength {
+			return fmt.Errorf("%s: expected at most %d characters, got %d", path, *s.MaxLength, n)
+		}
+		if s.Pattern != "" && !s.matchPattern(value) {
+			return fmt.Errorf("%s: value '%s' does not match pattern '%s'", path, value, s.Pattern)
+		}
+
+	case float64:
+		if s.Minimum != nil && value < *s.Minimum {
+			return fmt.Errorf("%s: value %v is less than %v", path, value, *s.Minimum)
+		}
+		if s.Maximum != nil && value > *s.Maximum {
+			return fmt.Errorf("%s: value %v is greater than %v", path, value, *s.Maximum)
+		}
+	}
+
+	return nil
+}
+
+// matchPattern matches a string against the pattern of the schema, compiled by compile for schemas that were
+// checked beforehand
+func (s *Schema) matchPattern(value string) bool {
+	if s.pattern != nil {
+		return s.pattern.MatchString(value)
+	}
+	matched, err := regexp.MatchString(s.Pattern, value)
+	return err == nil && matched
+}
+
+// jsonType returns the JSON Schema type name of a value decoded by encoding/json
+func jsonType(v interface{}) string {
+	switch n := v.(type) {
+	case map[string]interface{}:
+		return "object"
+	case []interface{}:
+		return "array"
+	case string:
+		return "string"
+	case float64:
+		if n == math.Trunc(n) {
+			return "integer"
+		}
+		return "number"
+	case bool:
+		return "boolean"
+	}
+	return "null"
+}
+
+func jsonTypeMatches(t string, v interface{}) bool {
+	actual := jsonType(v)
+	return t == actual || (t == "number" && actual == "integer")
+}
+
+// normaliseJSON converts a Go value into the form encoding/json decodes it to, so that enum values declared in Go
+// compare equal to decoded ones
+func normaliseJSON(v interface{}) interface{} {
+
+	b, err := json.Marshal(v)
+	if err != nil {
+		return v
+	}
+
+	var ret interface{}
+	if err := json.Unmarshal(b, &ret); err != nil {
+		return v
+	}
+
+	return ret
+}
@@ -0,0 +1,220 @@
+// Package clientcert authenticates requests with the client certificate forwarded by nginx-ingress after
+// terminating mTLS.
+//
+// The middleware trusts the Ssl-Client-Cert and Ssl-Client-Verify headers, so it must only be deployed behind an
+// ingress which strips any client-supplied copies of both headers before setting its own, and services using it must
+// not be reachable other than through that ingress.
+package clientcert
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/9spokes/go/api"
+	"github.com/9spokes/go/crypto"
+	"github.com/9spokes/go/logging/v3"
+)
+
+// DefaultHeader is the header nginx-ingress forwards the client certificate in
+const DefaultHeader = "Ssl-Client-Cert"
+
+// DefaultVerifyHeader is the header nginx-ingress forwards the result of the client certificate verification in
+const DefaultVerifyHeader = "Ssl-Client-Verify"
+
+// Options configures the client certificate middleware.  A certificate must have been verified by the ingress, be
+// within its validity dates and either be pinned by its thumbprint or chain up to one of the Roots.  If Subjects or
+// SANs are set, its subject common name or one of its subject alternative names must also be listed.
+type Options struct {
+	Header        string         // Defaults to DefaultHeader
+	VerifyHeader  string         // Must be "SUCCESS" for a certificate to be accepted, defaults to DefaultVerifyHeader
+	SkipVerify    bool           // Skips the VerifyHeader check, only meant for ingresses not verifying certificates
+	Thumbprints   []string       // Hex SHA-256 thumbprints of the pinned certificates, colons and case are ignored
+	Roots         *x509.CertPool // The CAs client certificates may chain up to
+	Intermediates *x509.CertPool // Intermediate CAs not forwarded along with client certificates
+	Subjects      []string       // The allowed subject common names
+	SANs          []string       // The allowed DNS names, email addresses, IP addresses or URIs
+	// An additional check run on authenticated certificates, if set
+	Authorize func(*x509.Certificate) error
+
+	now func() time.Time
+}
+
+// Identity is the client authenticated by the middleware
+type Identity struct {
+	Subject     string // The subject common name of the certificate
+	Thumbprint  string // The hex SHA-256 thumbprint of the certificate
+	Certificate *x509.Certificate
+}
+
+type contextKey struct{}
+
+// NewContext returns a copy of ctx carrying the client identity
+func NewContext(ctx context.Context, id *Identity) context.Context {
+	return context.WithValue(ctx, contextKey{}, id)
+}
+
+// FromContext returns the client identity stored in ctx by the middleware, if any
+func FromContext(ctx context.Context) (*Identity, bool) {
+	id, ok := ctx.Value(contextKey{}).(*Identity)
+	return id, ok
+}
+
+// Middleware returns a net/http middleware that authenticates requests with the client certificate forwarded in a
+// header, and exposes the client identity through the request context (see FromContext).  Requests without a valid
+// certificate are rejected with a 401, and those whose certificate is not authorised with a 403.
+func Middleware(opts Options) func(next http.Handler) http.Handler {
+
+	opts.setDefaults()
+
+	pinned := make(map[string]bool, len(opts.Thumbprints))
+	for _, t := range opts.Thumbprints {
+		pinned[normaliseThumbprint(t)] = true
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+			header := r.Header.Get(opts.Header)
+			if header == "" {
+				api.ErrorResponse(w, "client certificate required", http.StatusUnauthorized)
+				return
+			}
+
+			if verify := r.Header.Get(opts.VerifyHeader); !opts.SkipVerify && verify != "SUCCESS" {
+				logging.Warningf("Rejecting request with a client certificate not verified by the ingress: %q", verify)
+				api.ErrorResponse(w, "client certificate not verified", http.StatusUnauthorized)
+				return
+			}
+
+			cert, err := crypto.ParseCertificateFromHTTPHeader(header)
+			if err != nil {
+				logging.Warningf("Rejecting request with an invalid client certificate: %s", err.Error())
+				api.ErrorResponse(w, "invalid client certificate", http.StatusUnauthorized)
+				return
+			}
+
+			id := &Identity{
+				Subject:     cert.Subject.CommonName,
+				Thumbprint:  thumbprint(cert),
+				Certificate: cert,
+			}
+
+			if err := opts.authenticate(cert, id.Thumbprint, pinned); err != nil {
+				logging.Warningf("[%s] Rejecting client certificate %s: %s", id.Subject, id.Thumbprint, err.Error())
+				api.ErrorResponse(w, "invalid client certificate", http.StatusUnauthorized)
+				return
+			}
+
+			if err := opts.authorize(cert); err != nil {
+				logging.Warningf("[%s] Client certificate %s not authorised: %s", id.Subject, id.Thumbprint, err.Error())
+				api.ErrorResponse(w, "client certificate not authorised", http.StatusForbidden)
+				return
+			}
+
+			next.ServeHTTP(w, r.WithContext(NewContext(r.Context(), id)))
+		})
+	}
+}
+
+func (opts *Options) setDefaults() {
+	if opts.Header == "" {
+		opts.Header = DefaultHeader
+	}
+	if opts.VerifyHeader == "" {
+		opts.VerifyHeader = DefaultVerifyHeader
+	}
+	if opts.now == nil {
+		opts.now = time.Now
+	}
+}
+
+// authenticate checks that a certificate is valid and either pinned or issued by one of the trusted CAs
+func (opts *Options) authenticate(cert *x509.Certificate, thumbprint string, pinned map[string]bool) error {
+
+	now := opts.now()
+	if now.Before(cert.NotBefore) {
+		return fmt.Errorf("certificate not valid before %s", cert.NotBefore.UTC().Format(time.RFC3339))
+	}
+	if now.After(cert.NotAfter) {
+		return fmt.Errorf("certificate expired on %s", cert.NotAfter.UTC().Format(time.RFC3339))
+	}
+
+	if pinned[thumbprint] {
+		return nil
+	}
+
+	if opts.Roots == nil {
+		return fmt.Errorf("certificate not pinned")
+	}
+
+	_, err := cert.Verify(x509.VerifyOptions{
+		Roots:         opts.Roots,
+		Intermediates: opts.Intermediates,
+		CurrentTime:   now,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	if err != nil {
+		return fmt.Errorf("certificate not pinned nor trusted: %s", err.Error())
+	}
+
+	return nil
+}
+
+// authorize checks the subject and subject alternative names of an authenticated certificate
+func (opts *Options) authorize(cert *x509.Certificate) error {
+
+	if len(opts.Subjects) > 0 || len(opts.SANs) > 0 {
+		if !matchesNames(cert, opts.Subjects, opts.SANs) {
+			return fmt.Errorf("subject and alternative names not allowed")
+		}
+	}
+
+	if opts.Authorize != nil {
+		return opts.Authorize(cert)
+	}
+
+	return nil
+}
+
+func matchesNames(cert *x509.Certificate, subjects, sans []string) bool {
+
+	for _, s := range subjects {
+		if cert.Subject.CommonName == s {
+			return true
+		}
+	}
+
+	names := append([]string{}, cert.DNSNames...)
+	names = append(names, cert.EmailAddresses...)
+	for _, ip := range cert.IPAddresses {
+		names = append(names, ip.String())
+	}
+	for _, uri := range cert.URIs {
+		names = append(names, uri.String())
+	}
+
+	for _, san := range sans {
+		for _, name := range names {
+			if strings.EqualFold(name, san) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func thumbprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+func normaliseThumbprint(t string) string {
+	return strings.ToLower(strings.ReplaceAll(strings.TrimSpace(t), ":", ""))
+}
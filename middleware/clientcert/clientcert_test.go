@@ -0,0 +1,125 @@
+package clientcert
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func issue(t *testing.T, template, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	assert.Nil(t, err)
+
+	cert, err := x509.ParseCertificate(der)
+	assert.Nil(t, err)
+
+	return cert, key
+}
+
+func header(cert *x509.Certificate) string {
+	return url.QueryEscape(string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})))
+}
+
+func TestMiddleware(t *testing.T) {
+
+	now := time.Now()
+
+	ca, caKey := issue(t, &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil, nil)
+
+	client, _ := issue(t, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "portal"},
+		DNSNames:     []string{"portal.example.com"},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca, caKey)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+
+	serveVerified := func(opts Options, cert *x509.Certificate, verify string) (int, *Identity) {
+
+		var id *Identity
+		handler := Middleware(opts)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			id, _ = FromContext(r.Context())
+		}))
+
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		if cert != nil {
+			r.Header.Set(DefaultHeader, header(cert))
+		}
+		if verify != "" {
+			r.Header.Set(DefaultVerifyHeader, verify)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+
+		return w.Code, id
+	}
+
+	serve := func(opts Options, cert *x509.Certificate) (int, *Identity) {
+		return serveVerified(opts, cert, "SUCCESS")
+	}
+
+	code, _ := serve(Options{Roots: roots}, nil)
+	assert.Equal(t, http.StatusUnauthorized, code)
+
+	code, id := serve(Options{Roots: roots}, client)
+	assert.Equal(t, http.StatusOK, code)
+	if assert.NotNil(t, id) {
+		assert.Equal(t, "portal", id.Subject)
+	}
+
+	code, _ = serve(Options{Thumbprints: []string{thumbprint(client)}}, client)
+	assert.Equal(t, http.StatusOK, code)
+
+	// The ingress must have verified the certificate unless told otherwise
+	code, _ = serveVerified(Options{Roots: roots}, client, "")
+	assert.Equal(t, http.StatusUnauthorized, code)
+
+	code, _ = serveVerified(Options{Roots: roots}, client, "FAILED:unable to verify the first certificate")
+	assert.Equal(t, http.StatusUnauthorized, code)
+
+	code, _ = serveVerified(Options{Roots: roots, SkipVerify: true}, client, "")
+	assert.Equal(t, http.StatusOK, code)
+
+	code, _ = serve(Options{Thumbprints: []string{thumbprint(ca)}}, client)
+	assert.Equal(t, http.StatusUnauthorized, code)
+
+	code, _ = serve(Options{Roots: roots, SANs: []string{"PORTAL.example.com"}}, client)
+	assert.Equal(t, http.StatusOK, code)
+
+	code, _ = serve(Options{Roots: roots, Subjects: []string{"billing"}}, client)
+	assert.Equal(t, http.StatusForbidden, code)
+
+	code, _ = serve(Options{Roots: roots, now: func() time.Time { return now.Add(2 * time.Hour) }}, client)
+	assert.Equal(t, http.StatusUnauthorized, code)
+}
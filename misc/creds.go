@@ -29,3 +29,15 @@ func LoadCredentials(path string) (map[string]string, error) {
 
 	return nil, nil
 }
+
+// SaveCredentials writes API client_id/client_secret pairs to a file readable by LoadCredentials, only accessible to
+// its owner.  Secrets should be hashed beforehand, see crypto.HashCredentials.
+func SaveCredentials(path string, creds map[string]string) error {
+
+	b, err := json.MarshalIndent(creds, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(path, append(b, '\n'), 0600)
+}
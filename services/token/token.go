@@ -1,12 +1,14 @@
 package token
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/url"
 	"strings"
 
 	"github.com/9spokes/go/api"
+	"github.com/9spokes/go/cache"
 	"github.com/9spokes/go/http"
 	"github.com/9spokes/go/logging/v3"
 	"github.com/9spokes/go/types"
@@ -24,11 +26,14 @@ const StatusNew = "NEW"
 
 // Context represents a connection object into the token service
 // If Redis is set, will try to use it for connection documents
+// If Keys is also set, cached connection documents are expected to be encrypted with cache.Seal using the
+// connection ID as additional data
 type Context struct {
 	URL          string
 	ClientID     string
 	ClientSecret string
 	Redis        *redis.Client
+	Keys         cache.KeyProvider
 }
 
 func (ctx Context) InitiateETL(id string) error {
@@ -84,10 +89,15 @@ func (ctx Context) getConnection(id string, refresh bool) (*types.Connection, er
 
 	if ctx.Redis != nil {
 		// try to get from cache
-		cached, err := ctx.Redis.Get(id).Result()
+		cached, err := ctx.Redis.Get(id).Bytes()
+		if err == nil && ctx.Keys != nil {
+			if cached, err = cache.Open(context.Background(), ctx.Keys, cached, []byte(id)); err != nil {
+				logging.Warningf("[%s] Failed to decrypt cached connection document: %s", id, err.Error())
+			}
+		}
 		if err == nil {
 			var conn types.Connection
-			if err = json.Unmarshal([]byte(cached), &conn); err == nil {
+			if err = json.Unmarshal(cached, &conn); err == nil {
 				return &conn, nil
 			}
 		}
@@ -0,0 +1,438 @@
+package session
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/9spokes/go/api"
+	"github.com/9spokes/go/logging/v3"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/go-redis/redis"
+)
+
+// Options configures the HTTP session middleware
+type Options struct {
+	Redis          Store         // Backing store for session values such as a *redis.Client, required
+	Secret         []byte        // Key used to sign the session and CSRF cookies, at least 32 random bytes
+	TokenKey       interface{}   // Key verifying bearer tokens, a []byte for HMAC or an *rsa.PublicKey for RSA signatures
+	CookieName     string        // Defaults to "session"
+	CSRFCookieName string        // Defaults to "csrf_token"
+	CSRFHeaderName string        // Defaults to "X-CSRF-Token"
+	CSRFFormField  string        // Defaults to "csrf_token"
+	Path           string        // Defaults to "/"
+	Domain         string        // Optional cookie domain
+	MaxAge         time.Duration // Lifetime of the session, defaults to 24 hours
+	SameSite       http.SameSite // Defaults to http.SameSiteLaxMode
+	Insecure       bool          // Omits the Secure cookie attribute, only meant for local development over plain HTTP
+}
+
+// Session is a server-side session attached to an HTTP request by the session middleware
+type Session struct {
+	ID     string // The session ID, also the Redis key holding the session values
+	Bearer bool   // Whether the session was loaded from a bearer token rather than a cookie
+	isNew  bool
+	csrf   string
+	opts   *Options
+	w      http.ResponseWriter
+}
+
+type contextKey struct{}
+
+// NewContext returns a copy of ctx carrying the session
+func NewContext(ctx context.Context, s *Session) context.Context {
+	return context.WithValue(ctx, contextKey{}, s)
+}
+
+// FromContext returns the session stored in ctx by the session middleware, if any
+func FromContext(ctx context.Context) (*Session, bool) {
+	s, ok := ctx.Value(contextKey{}).(*Session)
+	return s, ok
+}
+
+// Middleware returns a net/http middleware that loads the session from a signed cookie or a bearer token and
+// exposes it through the request context (see FromContext).  Either way the session must still exist in the store,
+// so that Destroy revokes it.  Requests using a state-changing method on a cookie session must carry a valid
+// double-submit CSRF token in either the CSRF header or form field.  Bearer tokens are rejected unless a TokenKey is
+// configured, and must carry an expiry.  It panics if the options are invalid.
+func Middleware(opts Options) func(next http.Handler) http.Handler {
+
+	if err := opts.validate(); err != nil {
+		panic("session: " + err.Error())
+	}
+
+	opts.setDefaults()
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+			s, err := opts.load(r)
+			if err != nil {
+				logging.Warningf("Rejecting request with invalid session: %s", err.Error())
+				api.ErrorResponse(w, "invalid session", http.StatusUnauthorized)
+				return
+			}
+			s.w = w
+
+			if !s.Bearer {
+				if s.isNew {
+					if err := s.create(); err != nil {
+						logging.Errorf("[%s] Failed to create session: %s", s.ID, err.Error())
+						api.ErrorResponse(w, "failed to initialise session", http.StatusInternalServerError)
+						return
+					}
+					s.writeCookie()
+				}
+				if !isSafeMethod(r.Method) && !opts.verifyCSRF(r, s.ID) {
+					logging.Warningf("[%s] Rejecting %s request with missing or invalid CSRF token", s.ID, r.Method)
+					api.ErrorResponse(w, "invalid CSRF token", http.StatusForbidden)
+					return
+				}
+				if c, err := r.Cookie(opts.CSRFCookieName); err == nil && opts.validCSRFToken(c.Value, s.ID) {
+					s.csrf = c.Value
+				} else {
+					if err := s.writeCSRFCookie(); err != nil {
+						logging.Errorf("[%s] Failed to issue CSRF token: %s", s.ID, err.Error())
+						api.ErrorResponse(w, "failed to initialise session", http.StatusInternalServerError)
+						return
+					}
+				}
+			}
+
+			next.ServeHTTP(w, r.WithContext(NewContext(r.Context(), s)))
+		})
+	}
+}
+
+// Get reads a value from the session
+func (s *Session) Get(key string) (string, error) {
+	return Get(s.opts.Redis, s.ID, key)
+}
+
+// Set stores a value into the session and extends its lifetime
+func (s *Session) Set(key string, value interface{}) error {
+
+	if err := Set(s.opts.Redis, s.ID, key, value); err != nil {
+		return err
+	}
+
+	if _, err := s.opts.Redis.Expire(s.ID, s.opts.MaxAge).Result(); err != nil {
+		return fmt.Errorf("failed to set session expiry: %s", err.Error())
+	}
+
+	return nil
+}
+
+// Rotate assigns a new ID to the session, carrying over its values, and issues new session and CSRF cookies.
+// It must be called on privilege changes such as a login, before the handler writes the response headers.
+func (s *Session) Rotate() error {
+
+	if s.Bearer {
+		return fmt.Errorf("cannot rotate a session loaded from a bearer token")
+	}
+
+	id, err := newID()
+	if err != nil {
+		return fmt.Errorf("failed to generate session ID: %s", err.Error())
+	}
+
+	n, err := s.opts.Redis.Exists(s.ID).Result()
+	if err != nil {
+		return fmt.Errorf("failed to look up session: %s", err.Error())
+	}
+	if n > 0 {
+		if _, err := s.opts.Redis.Rename(s.ID, id).Result(); err != nil {
+			return fmt.Errorf("failed to rotate session: %s", err.Error())
+		}
+	}
+
+	logging.Debugf("[%s] Session rotated to a new ID", s.ID)
+	s.ID = id
+	s.writeCookie()
+
+	return s.writeCSRFCookie()
+}
+
+// Destroy removes the session values and expires the session and CSRF cookies
+func (s *Session) Destroy() error {
+
+	if _, err := s.opts.Redis.Del(s.ID).Result(); err != nil {
+		return fmt.Errorf("failed to remove session: %s", err.Error())
+	}
+
+	if !s.Bearer {
+		http.SetCookie(s.w, s.opts.cookie(s.opts.CookieName, "", -1, true))
+		http.SetCookie(s.w, s.opts.cookie(s.opts.CSRFCookieName, "", -1, false))
+	}
+
+	return nil
+}
+
+// createdField is the session value recording when a session was started, so that the session exists in the store
+// before any other value is set
+const createdField = "_created"
+
+// create records a new session in the store, expiring along with its cookie unless extended by Set
+func (s *Session) create() error {
+
+	if err := Set(s.opts.Redis, s.ID, createdField, time.Now().Unix()); err != nil {
+		return err
+	}
+
+	if _, err := s.opts.Redis.Expire(s.ID, s.opts.MaxAge).Result(); err != nil {
+		return fmt.Errorf("failed to set session expiry: %s", err.Error())
+	}
+
+	return nil
+}
+
+// minSecretSize is the minimum length of the key signing the session and CSRF cookies
+const minSecretSize = 32
+
+func (opts *Options) validate() error {
+
+	if len(opts.Secret) < minSecretSize {
+		return fmt.Errorf("secret must be at least %d bytes long", minSecretSize)
+	}
+
+	if c, ok := opts.Redis.(*redis.Client); opts.Redis == nil || ok && c == nil {
+		return fmt.Errorf("redis client not specified")
+	}
+
+	switch k := opts.TokenKey.(type) {
+	case nil, *rsa.PublicKey:
+	case []byte:
+		if len(k) < minSecretSize {
+			return fmt.Errorf("token key must be at least %d bytes long", minSecretSize)
+		}
+	default:
+		return fmt.Errorf("unsupported token key type %T", opts.TokenKey)
+	}
+
+	return nil
+}
+
+func (opts *Options) setDefaults() {
+	if opts.CookieName == "" {
+		opts.CookieName = "session"
+	}
+	if opts.CSRFCookieName == "" {
+		opts.CSRFCookieName = "csrf_token"
+	}
+	if opts.CSRFHeaderName == "" {
+		opts.CSRFHeaderName = "X-CSRF-Token"
+	}
+	if opts.CSRFFormField == "" {
+		opts.CSRFFormField = "csrf_token"
+	}
+	if opts.Path == "" {
+		opts.Path = "/"
+	}
+	if opts.MaxAge == 0 {
+		opts.MaxAge = 24 * time.Hour
+	}
+	if opts.SameSite == 0 {
+		opts.SameSite = http.SameSiteLaxMode
+	}
+}
+
+// load resolves the session from the Authorization header if present, falling back to the session cookie.  A new
+// session is started when no valid cookie is found, or when the session it names has expired or was destroyed.
+func (opts *Options) load(r *http.Request) (*Session, error) {
+
+	if auth := r.Header.Get("Authorization"); auth != "" {
+
+		tokenStr, err := parseAuthHeader(auth)
+		if err != nil {
+			return nil, fmt.Errorf("while parsing authorization header: %s", err.Error())
+		}
+
+		sub, err := opts.verifyToken(tokenStr)
+		if err != nil {
+			return nil, fmt.Errorf("while validating JWT token: %s", err.Error())
+		}
+
+		n, err := opts.Redis.Exists(sub).Result()
+		if err != nil {
+			return nil, fmt.Errorf("while looking up session: %s", err.Error())
+		}
+		if n == 0 {
+			return nil, fmt.Errorf("session not found")
+		}
+
+		return &Session{ID: sub, Bearer: true, opts: opts}, nil
+	}
+
+	if c, err := r.Cookie(opts.CookieName); err == nil {
+		if id, ok := opts.unsign("session", c.Value); ok {
+			n, err := opts.Redis.Exists(id).Result()
+			if err != nil {
+				return nil, fmt.Errorf("while looking up session: %s", err.Error())
+			}
+			if n > 0 {
+				return &Session{ID: id, opts: opts}, nil
+			}
+			logging.Warningf("Discarding session cookie of an expired or destroyed session")
+		} else {
+			logging.Warningf("Discarding session cookie with an invalid signature")
+		}
+	}
+
+	id, err := newID()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate session ID: %s", err.Error())
+	}
+
+	return &Session{ID: id, opts: opts, isNew: true}, nil
+}
+
+// verifyToken checks the signature and validity dates of a bearer token against the token key and returns its
+// subject.  Tokens without an expiry are rejected.
+func (opts *Options) verifyToken(tokenStr string) (string, error) {
+
+	if opts.TokenKey == nil {
+		return "", fmt.Errorf("bearer tokens are not accepted")
+	}
+
+	var claims jwt.StandardClaims
+	token, err := jwt.ParseWithClaims(tokenStr, &claims, func(token *jwt.Token) (interface{}, error) {
+		switch opts.TokenKey.(type) {
+		case []byte:
+			if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+				return nil, fmt.Errorf("unexpected signing method %s", token.Header["alg"])
+			}
+		case *rsa.PublicKey:
+			if _, ok := token.Method.(*jwt.SigningMethodRSA); !ok {
+				return nil, fmt.Errorf("unexpected signing method %s", token.Header["alg"])
+			}
+		}
+		return opts.TokenKey, nil
+	})
+	if err != nil {
+		return "", err
+	}
+	if !token.Valid || claims.Subject == "" {
+		return "", fmt.Errorf("invalid token")
+	}
+	if !claims.VerifyExpiresAt(time.Now().Unix(), true) {
+		return "", fmt.Errorf("token has no expiry")
+	}
+
+	return claims.Subject, nil
+}
+
+func (s *Session) writeCookie() {
+	http.SetCookie(s.w, s.opts.cookie(s.opts.CookieName, s.opts.sign("session", s.ID), int(s.opts.MaxAge.Seconds()), true))
+}
+
+// writeCSRFCookie issues a new CSRF token bound to the session ID.  The cookie is deliberately readable from
+// JavaScript so that clients can echo it back in the CSRF header.
+func (s *Session) writeCSRFCookie() error {
+
+	nonce, err := newID()
+	if err != nil {
+		return fmt.Errorf("failed to generate CSRF token: %s", err.Error())
+	}
+
+	s.csrf = s.opts.csrfToken(nonce, s.ID)
+	http.SetCookie(s.w, s.opts.cookie(s.opts.CSRFCookieName, s.csrf, int(s.opts.MaxAge.Seconds()), false))
+
+	return nil
+}
+
+// CSRFToken returns the CSRF token for the session, for embedding into forms rendered server-side
+func (s *Session) CSRFToken() string {
+	return s.csrf
+}
+
+func (opts *Options) cookie(name, value string, maxAge int, httpOnly bool) *http.Cookie {
+	return &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     opts.Path,
+		Domain:   opts.Domain,
+		MaxAge:   maxAge,
+		HttpOnly: httpOnly,
+		Secure:   !opts.Insecure,
+		SameSite: opts.SameSite,
+	}
+}
+
+func (opts *Options) mac(purpose, value string) string {
+	h := hmac.New(sha256.New, opts.Secret)
+	h.Write([]byte(purpose + ":" + value))
+	return base64.RawURLEncoding.EncodeToString(h.Sum(nil))
+}
+
+func (opts *Options) sign(purpose, value string) string {
+	return value + "." + opts.mac(purpose, value)
+}
+
+func (opts *Options) unsign(purpose, signed string) (string, bool) {
+
+	i := strings.LastIndex(signed, ".")
+	if i < 1 {
+		return "", false
+	}
+
+	value := signed[:i]
+	if !hmac.Equal([]byte(signed[i+1:]), []byte(opts.mac(purpose, value))) {
+		return "", false
+	}
+
+	return value, true
+}
+
+// csrfToken builds a double-submit token whose signature binds it to the session ID so that a token planted by an
+// attacker for another session is rejected
+func (opts *Options) csrfToken(nonce, id string) string {
+	return nonce + "." + opts.mac("csrf", nonce+":"+id)
+}
+
+func (opts *Options) validCSRFToken(token, id string) bool {
+
+	i := strings.LastIndex(token, ".")
+	if i < 1 {
+		return false
+	}
+
+	return hmac.Equal([]byte(token), []byte(opts.csrfToken(token[:i], id)))
+}
+
+func (opts *Options) verifyCSRF(r *http.Request, id string) bool {
+
+	c, err := r.Cookie(opts.CSRFCookieName)
+	if err != nil || !opts.validCSRFToken(c.Value, id) {
+		return false
+	}
+
+	submitted := r.Header.Get(opts.CSRFHeaderName)
+	if submitted == "" {
+		submitted = r.PostFormValue(opts.CSRFFormField)
+	}
+
+	return hmac.Equal([]byte(submitted), []byte(c.Value))
+}
+
+func isSafeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return true
+	}
+	return false
+}
+
+func newID() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
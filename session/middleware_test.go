@@ -0,0 +1,295 @@
+package session
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/go-redis/redis"
+	"github.com/stretchr/testify/assert"
+)
+
+var (
+	testSecret = []byte("0123456789abcdef0123456789abcdef")
+	// Only used to validate options, never reached
+	testRedis = redis.NewClient(&redis.Options{Addr: "127.0.0.1:1"})
+)
+
+// memoryStore is an in-memory Store, ignoring expiry
+type memoryStore struct {
+	mu     sync.Mutex
+	hashes map[string]map[string]string
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{hashes: make(map[string]map[string]string)}
+}
+
+func (m *memoryStore) HGet(key, field string) *redis.StringCmd {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	v, ok := m.hashes[key][field]
+	if !ok {
+		return redis.NewStringResult("", redis.Nil)
+	}
+	return redis.NewStringResult(v, nil)
+}
+
+func (m *memoryStore) HSet(key, field string, value interface{}) *redis.BoolCmd {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.hashes[key] == nil {
+		m.hashes[key] = make(map[string]string)
+	}
+	_, exists := m.hashes[key][field]
+	m.hashes[key][field] = fmt.Sprint(value)
+	return redis.NewBoolResult(!exists, nil)
+}
+
+func (m *memoryStore) Expire(key string, expiration time.Duration) *redis.BoolCmd {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, ok := m.hashes[key]
+	return redis.NewBoolResult(ok, nil)
+}
+
+func (m *memoryStore) Exists(keys ...string) *redis.IntCmd {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var n int64
+	for _, key := range keys {
+		if _, ok := m.hashes[key]; ok {
+			n++
+		}
+	}
+	return redis.NewIntResult(n, nil)
+}
+
+func (m *memoryStore) Rename(key, newkey string) *redis.StatusCmd {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	v, ok := m.hashes[key]
+	if !ok {
+		return redis.NewStatusResult("", fmt.Errorf("ERR no such key"))
+	}
+	delete(m.hashes, key)
+	m.hashes[newkey] = v
+	return redis.NewStatusResult("OK", nil)
+}
+
+func (m *memoryStore) Del(keys ...string) *redis.IntCmd {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var n int64
+	for _, key := range keys {
+		if _, ok := m.hashes[key]; ok {
+			delete(m.hashes, key)
+			n++
+		}
+	}
+	return redis.NewIntResult(n, nil)
+}
+
+func TestMiddleware(t *testing.T) {
+
+	store := newMemoryStore()
+
+	var seen *Session
+	handler := Middleware(Options{Secret: testSecret, Redis: store})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen, _ = FromContext(r.Context())
+		if r.URL.Path == "/logout" {
+			assert.Nil(t, seen.Destroy())
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	cookies := func(rr *httptest.ResponseRecorder) map[string]*http.Cookie {
+		ret := make(map[string]*http.Cookie)
+		for _, c := range rr.Result().Cookies() {
+			ret[c.Name] = c
+		}
+		return ret
+	}
+
+	// A first visit starts a new session and issues both cookies
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/", nil))
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	issued := cookies(rr)
+	sess, csrf := issued["session"], issued["csrf_token"]
+	if assert.NotNil(t, sess) && assert.NotNil(t, csrf) {
+		assert.True(t, sess.HttpOnly)
+		assert.True(t, sess.Secure)
+		assert.Equal(t, http.SameSiteLaxMode, sess.SameSite)
+		assert.False(t, csrf.HttpOnly)
+	}
+	assert.Equal(t, csrf.Value, seen.CSRFToken())
+	id := seen.ID
+	assert.Equal(t, int64(1), store.Exists(id).Val())
+
+	t.Run("existing session is loaded from cookie", func(t *testing.T) {
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/", nil)
+		req.AddCookie(sess)
+		req.AddCookie(csrf)
+		handler.ServeHTTP(rr, req)
+
+		assert.Equal(t, http.StatusOK, rr.Code)
+		assert.Equal(t, id, seen.ID)
+		assert.Empty(t, rr.Result().Cookies())
+	})
+
+	t.Run("tampered cookie starts a new session", func(t *testing.T) {
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/", nil)
+		req.AddCookie(&http.Cookie{Name: "session", Value: "attacker." + sess.Value[len(id)+1:]})
+		handler.ServeHTTP(rr, req)
+
+		assert.Equal(t, http.StatusOK, rr.Code)
+		assert.NotEqual(t, id, seen.ID)
+		assert.NotEqual(t, "attacker", seen.ID)
+	})
+
+	tests := []struct {
+		name   string
+		header string
+		code   int
+	}{
+		{name: "POST without CSRF header is rejected", header: "", code: http.StatusForbidden},
+		{name: "POST with mismatching CSRF header is rejected", header: "bogus", code: http.StatusForbidden},
+		{name: "POST with matching CSRF header is accepted", header: csrf.Value, code: http.StatusOK},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			req := httptest.NewRequest("POST", "/", nil)
+			req.AddCookie(sess)
+			req.AddCookie(csrf)
+			if test.header != "" {
+				req.Header.Set("X-CSRF-Token", test.header)
+			}
+			handler.ServeHTTP(rr, req)
+			assert.Equal(t, test.code, rr.Code)
+		})
+	}
+
+	t.Run("CSRF token from another session is rejected", func(t *testing.T) {
+		other := httptest.NewRecorder()
+		handler.ServeHTTP(other, httptest.NewRequest("GET", "/", nil))
+		foreign := cookies(other)["csrf_token"]
+
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "/", nil)
+		req.AddCookie(sess)
+		req.AddCookie(foreign)
+		req.Header.Set("X-CSRF-Token", foreign.Value)
+		handler.ServeHTTP(rr, req)
+
+		assert.Equal(t, http.StatusForbidden, rr.Code)
+	})
+
+	t.Run("destroyed session cookie starts a new session", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/logout", nil)
+		req.AddCookie(sess)
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+		assert.Equal(t, int64(0), store.Exists(id).Val())
+
+		// A copy of the cookie kept by an attacker no longer resolves to the session
+		rr := httptest.NewRecorder()
+		req = httptest.NewRequest("GET", "/", nil)
+		req.AddCookie(sess)
+		handler.ServeHTTP(rr, req)
+
+		assert.Equal(t, http.StatusOK, rr.Code)
+		assert.NotEqual(t, id, seen.ID)
+		assert.NotNil(t, cookies(rr)["session"])
+	})
+}
+
+func TestMiddlewareOptions(t *testing.T) {
+
+	assert.Panics(t, func() { Middleware(Options{Redis: testRedis}) })
+	assert.Panics(t, func() { Middleware(Options{Secret: []byte("short"), Redis: testRedis}) })
+	assert.Panics(t, func() { Middleware(Options{Secret: testSecret}) })
+	assert.NotPanics(t, func() { Middleware(Options{Secret: testSecret, Redis: testRedis, TokenKey: testSecret}) })
+}
+
+func TestVerifyToken(t *testing.T) {
+
+	opts := &Options{TokenKey: testSecret}
+
+	expires := time.Now().Add(time.Hour).Unix()
+	sign := func(method jwt.SigningMethod, key interface{}) string {
+		s, err := jwt.NewWithClaims(method, jwt.StandardClaims{Subject: "session-1", ExpiresAt: expires}).SignedString(key)
+		assert.Nil(t, err)
+		return s
+	}
+
+	sub, err := opts.verifyToken(sign(jwt.SigningMethodHS256, testSecret))
+	assert.Nil(t, err)
+	assert.Equal(t, "session-1", sub)
+
+	_, err = opts.verifyToken(sign(jwt.SigningMethodHS256, []byte("forged-forged-forged-forged-forged")))
+	assert.NotNil(t, err)
+
+	_, err = opts.verifyToken(sign(jwt.SigningMethodNone, jwt.UnsafeAllowNoneSignatureType))
+	assert.NotNil(t, err)
+
+	_, err = (&Options{}).verifyToken(sign(jwt.SigningMethodHS256, testSecret))
+	assert.NotNil(t, err)
+
+	expires = time.Now().Add(-time.Minute).Unix()
+	_, err = opts.verifyToken(sign(jwt.SigningMethodHS256, testSecret))
+	assert.NotNil(t, err)
+
+	// Tokens without an expiry would stay valid forever
+	expires = 0
+	_, err = opts.verifyToken(sign(jwt.SigningMethodHS256, testSecret))
+	assert.EqualError(t, err, "token has no expiry")
+}
+
+func TestSessionValues(t *testing.T) {
+
+	store := newMemoryStore()
+	opts := Options{Secret: testSecret, Redis: store, TokenKey: testSecret}
+
+	var seen *Session
+	var err error
+	handler := Middleware(opts)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen, _ = FromContext(r.Context())
+		switch r.URL.Path {
+		case "/login":
+			if err = seen.Set("remote", "user-1"); err == nil {
+				err = seen.Rotate()
+			}
+		case "/logout":
+			err = seen.Destroy()
+		}
+	}))
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/login", nil))
+	assert.Nil(t, err)
+	id := seen.ID
+
+	// Rotation carries the values over to the new ID
+	user, err := seen.Get("remote")
+	assert.Nil(t, err)
+	assert.Equal(t, "user-1", user)
+	assert.Equal(t, int64(1), store.Exists(id).Val())
+
+	// Bearer tokens resolve to the session they name
+	token, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.StandardClaims{Subject: id, ExpiresAt: time.Now().Add(time.Hour).Unix()}).SignedString(testSecret)
+	req := httptest.NewRequest("GET", "/logout", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	assert.Nil(t, err)
+	assert.True(t, seen.Bearer)
+	assert.Equal(t, int64(0), store.Exists(id).Val())
+}
@@ -3,13 +3,25 @@ package session
 import (
 	"fmt"
 	"strings"
+	"time"
 
 	"github.com/dgrijalva/jwt-go"
 	"github.com/go-redis/redis"
 )
 
+// Store is the subset of the Redis client holding session values, satisfied by *redis.Client and by in-memory
+// implementations in tests
+type Store interface {
+	HGet(key, field string) *redis.StringCmd
+	HSet(key, field string, value interface{}) *redis.BoolCmd
+	Expire(key string, expiration time.Duration) *redis.BoolCmd
+	Exists(keys ...string) *redis.IntCmd
+	Rename(key, newkey string) *redis.StatusCmd
+	Del(keys ...string) *redis.IntCmd
+}
+
 // Set stores a value into the user session
-func Set(redisdb *redis.Client, sessionID, key string, value interface{}) error {
+func Set(redisdb Store, sessionID, key string, value interface{}) error {
 
 	if _, err := redisdb.HSet(sessionID, key, value).Result(); err != nil {
 		return fmt.Errorf("failed to write %s to session: %s", key, err.Error())
@@ -19,7 +31,7 @@ func Set(redisdb *redis.Client, sessionID, key string, value interface{}) error
 }
 
 // Get reads a value from the user session
-func Get(redisdb *redis.Client, sessionID, key string) (string, error) {
+func Get(redisdb Store, sessionID, key string) (string, error) {
 
 	value, err := redisdb.HGet(sessionID, key).Result()
 	if err != nil {
@@ -30,7 +42,7 @@ func Get(redisdb *redis.Client, sessionID, key string) (string, error) {
 }
 
 //Validate is used to ensure a bearer token represents a valid session in the cache.  If so, the user ID is retrieved and returned to the caller
-func Validate(redisdb *redis.Client, auth string) (string, error) {
+func Validate(redisdb Store, auth string) (string, error) {
 
 	// Extract the JWT token from the Authorization header
 	tokenStr, err := parseAuthHeader(auth)
@@ -0,0 +1,362 @@
+// Package webhook verifies the signatures of inbound webhooks, such as those sent by Xero, Shopify, Stripe and
+// QuickBooks, before they are handled.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/9spokes/go/api"
+	"github.com/9spokes/go/logging/v3"
+)
+
+// DefaultTolerance is how old a timestamped webhook may be unless configured otherwise
+const DefaultTolerance = 5 * time.Minute
+
+// DefaultMaxBodySize is the maximum size of a webhook body read by the middleware unless configured otherwise
+const DefaultMaxBodySize = 1 << 20
+
+var (
+	// ErrMissingSignature is returned when a webhook carries no signature
+	ErrMissingSignature = errors.New("missing webhook signature")
+	// ErrInvalidSignature is returned when the signature of a webhook matches none of the secrets
+	ErrInvalidSignature = errors.New("invalid webhook signature")
+	// ErrExpired is returned when the timestamp of a webhook is outside the tolerance, as for a replayed webhook
+	ErrExpired = errors.New("webhook timestamp outside of tolerance")
+	// ErrReplayed is returned when a webhook carries a signature already accepted, see ReplayCache
+	ErrReplayed = errors.New("webhook signature already used")
+)
+
+// ReplayCache records the signatures of accepted webhooks so that a webhook replayed within the tolerance of its
+// timestamp is rejected.  It must be shared between instances receiving the same webhooks, eg: backed by Redis
+// SET NX, for replays to be rejected across them.
+type ReplayCache interface {
+	// Seen records the signature for ttl and reports whether it was already recorded
+	Seen(ctx context.Context, signature string, ttl time.Duration) (bool, error)
+}
+
+// Verifier verifies the signature of a webhook request against its raw body
+type Verifier interface {
+	Verify(r *http.Request, body []byte) error
+}
+
+// Encoding is how an HMAC signature is encoded in its header
+type Encoding int
+
+const (
+	// Hex is lowercase or uppercase hexadecimal
+	Hex Encoding = iota
+	// Base64 is standard base64 with padding
+	Base64
+)
+
+// HMAC verifies webhooks carrying an HMAC of their raw body in a header.  Several secrets may be active at once so
+// that they can be rotated without dropping webhooks, and empty secrets never match.  If TimestampHeader is set, the
+// signed message is built by SignedPayload from the timestamp and body, and webhooks older than Tolerance are
+// rejected.
+//
+// On its own, the timestamp only bounds replays to the tolerance window, and webhooks without one can be replayed
+// at any time.  Set Replays to also reject a signature seen before within the tolerance.
+type HMAC struct {
+	Header          string           // The header carrying the signature
+	Prefix          string           // Stripped from the signature if present, eg: "sha256="
+	Encoding        Encoding         // Defaults to Hex
+	Hash            func() hash.Hash // Defaults to sha256.New
+	Secrets         [][]byte         // The active secrets, any of which may have signed the webhook
+	TimestampHeader string           // The header carrying the Unix timestamp of the webhook, if any
+	Tolerance       time.Duration    // Defaults to DefaultTolerance
+	// Defaults to "<timestamp>.<body>"
+	SignedPayload func(timestamp string, body []byte) []byte
+	Replays       ReplayCache // Optional, rejects signatures seen within Tolerance
+
+	now func() time.Time
+}
+
+// Shopify returns a verifier for the X-Shopify-Hmac-Sha256 header of Shopify webhooks.  It panics if no secret is
+// given or one is empty.
+func Shopify(secrets ...[]byte) *HMAC {
+	return &HMAC{Header: "X-Shopify-Hmac-Sha256", Encoding: Base64, Secrets: mustSecrets("Shopify", secrets)}
+}
+
+// Xero returns a verifier for the x-xero-signature header of Xero webhooks.  It panics if no secret is given or one
+// is empty.
+func Xero(secrets ...[]byte) *HMAC {
+	return &HMAC{Header: "X-Xero-Signature", Encoding: Base64, Secrets: mustSecrets("Xero", secrets)}
+}
+
+// QuickBooks returns a verifier for the intuit-signature header of QuickBooks webhooks.  It panics if no secret is
+// given or one is empty.
+func QuickBooks(secrets ...[]byte) *HMAC {
+	return &HMAC{Header: "Intuit-Signature", Encoding: Base64, Secrets: mustSecrets("QuickBooks", secrets)}
+}
+
+// mustSecrets panics unless at least one secret is given and none is empty, which would let anyone sign webhooks
+func mustSecrets(provider string, secrets [][]byte) [][]byte {
+
+	if len(secrets) == 0 {
+		panic(fmt.Sprintf("webhook: no %s secret specified", provider))
+	}
+
+	for _, secret := range secrets {
+		if len(secret) == 0 {
+			panic(fmt.Sprintf("webhook: empty %s secret", provider))
+		}
+	}
+
+	return secrets
+}
+
+// Verify implements Verifier
+func (v *HMAC) Verify(r *http.Request, body []byte) error {
+
+	signature := strings.TrimPrefix(strings.TrimSpace(r.Header.Get(v.Header)), v.Prefix)
+	if signature == "" {
+		return ErrMissingSignature
+	}
+
+	var expected []byte
+	var err error
+	if v.Encoding == Base64 {
+		expected, err = base64.StdEncoding.DecodeString(signature)
+	} else {
+		expected, err = hex.DecodeString(signature)
+	}
+	if err != nil {
+		return ErrInvalidSignature
+	}
+
+	message := body
+	if v.TimestampHeader != "" {
+		timestamp := r.Header.Get(v.TimestampHeader)
+		if err := checkTimestamp(timestamp, v.Tolerance, v.now); err != nil {
+			return err
+		}
+		if v.SignedPayload != nil {
+			message = v.SignedPayload(timestamp, body)
+		} else {
+			message = append([]byte(timestamp+"."), body...)
+		}
+	}
+
+	h := v.Hash
+	if h == nil {
+		h = sha256.New
+	}
+
+	for _, secret := range v.Secrets {
+		if len(secret) == 0 {
+			continue
+		}
+		if hmac.Equal(sign(h, secret, message), expected) {
+			return checkReplay(r.Context(), v.Replays, expected, v.Tolerance)
+		}
+	}
+
+	return ErrInvalidSignature
+}
+
+// Stripe verifies the Stripe-Signature header of Stripe webhooks, of the form "t=<timestamp>,v1=<signature>,..."
+// where each v1 signature is the hex HMAC-SHA256 of "<timestamp>.<body>".  As with HMAC, replays are only rejected
+// outside the tolerance unless Replays is set.
+type Stripe struct {
+	Secrets   [][]byte      // The active endpoint secrets, empty ones never match
+	Header    string        // Defaults to "Stripe-Signature"
+	Tolerance time.Duration // Defaults to DefaultTolerance
+	Replays   ReplayCache   // Optional, rejects signatures seen within Tolerance
+
+	now func() time.Time
+}
+
+// Verify implements Verifier
+func (v *Stripe) Verify(r *http.Request, body []byte) error {
+
+	header := v.Header
+	if header == "" {
+		header = "Stripe-Signature"
+	}
+
+	value := r.Header.Get(header)
+	if value == "" {
+		return ErrMissingSignature
+	}
+
+	var timestamp string
+	var signatures [][]byte
+	for _, pair := range strings.Split(value, ",") {
+		k, val, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok {
+			continue
+		}
+		switch k {
+		case "t":
+			timestamp = val
+		case "v1":
+			if sig, err := hex.DecodeString(val); err == nil {
+				signatures = append(signatures, sig)
+			}
+		}
+	}
+
+	if len(signatures) == 0 {
+		return ErrMissingSignature
+	}
+
+	if err := checkTimestamp(timestamp, v.Tolerance, v.now); err != nil {
+		return err
+	}
+
+	message := append([]byte(timestamp+"."), body...)
+	for _, secret := range v.Secrets {
+		if len(secret) == 0 {
+			continue
+		}
+		expected := sign(sha256.New, secret, message)
+		for _, sig := range signatures {
+			if hmac.Equal(expected, sig) {
+				return checkReplay(r.Context(), v.Replays, sig, v.Tolerance)
+			}
+		}
+	}
+
+	return ErrInvalidSignature
+}
+
+// Options configures the webhook middleware
+type Options struct {
+	MaxBodySize int64 // Defaults to DefaultMaxBodySize
+}
+
+// Middleware returns a net/http middleware that verifies webhooks with v before passing them on, and rejects them
+// with a 401 otherwise.  The body is read in full and made available again to the next handler.
+func Middleware(v Verifier, opts Options) func(next http.Handler) http.Handler {
+
+	if opts.MaxBodySize == 0 {
+		opts.MaxBodySize = DefaultMaxBodySize
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+			body, err := io.ReadAll(io.LimitReader(r.Body, opts.MaxBodySize+1))
+			if err != nil {
+				logging.Warningf("Failed to read webhook body: %s", err.Error())
+				api.ErrorResponse(w, "invalid webhook body", http.StatusBadRequest)
+				return
+			}
+			if int64(len(body)) > opts.MaxBodySize {
+				api.ErrorResponse(w, "webhook body too large", http.StatusRequestEntityTooLarge)
+				return
+			}
+
+			if err := v.Verify(r, body); err != nil {
+				logging.Warningf("Rejecting webhook to %s: %s", r.URL.Path, err.Error())
+				api.ErrorResponse(w, "invalid webhook signature", http.StatusUnauthorized)
+				return
+			}
+
+			r.Body = io.NopCloser(bytes.NewReader(body))
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func sign(h func() hash.Hash, secret, message []byte) []byte {
+	mac := hmac.New(h, secret)
+	mac.Write(message)
+	return mac.Sum(nil)
+}
+
+// checkReplay records a valid signature in the replay cache, if any, and rejects it if it was already recorded.
+// Signatures are kept for twice the tolerance, as timestamps are accepted on either side of the current time.
+func checkReplay(ctx context.Context, replays ReplayCache, signature []byte, tolerance time.Duration) error {
+
+	if replays == nil {
+		return nil
+	}
+
+	if tolerance == 0 {
+		tolerance = DefaultTolerance
+	}
+
+	seen, err := replays.Seen(ctx, hex.EncodeToString(signature), 2*tolerance)
+	if err != nil {
+		return fmt.Errorf("failed to check for replayed webhook: %s", err.Error())
+	}
+	if seen {
+		return ErrReplayed
+	}
+
+	return nil
+}
+
+// MemoryReplayCache is an in-process ReplayCache, only suitable for a single instance receiving webhooks
+type MemoryReplayCache struct {
+	mu      sync.Mutex
+	expires map[string]time.Time
+
+	now func() time.Time
+}
+
+// Seen implements ReplayCache
+func (c *MemoryReplayCache) Seen(ctx context.Context, signature string, ttl time.Duration) (bool, error) {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	if c.now != nil {
+		now = c.now()
+	}
+
+	if c.expires == nil {
+		c.expires = make(map[string]time.Time)
+	}
+	for sig, expires := range c.expires {
+		if !now.Before(expires) {
+			delete(c.expires, sig)
+		}
+	}
+
+	if _, ok := c.expires[signature]; ok {
+		return true, nil
+	}
+	c.expires[signature] = now.Add(ttl)
+
+	return false, nil
+}
+
+// checkTimestamp checks that a Unix timestamp is within tolerance of the current time
+func checkTimestamp(timestamp string, tolerance time.Duration, now func() time.Time) error {
+
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("%w: invalid timestamp '%s'", ErrExpired, timestamp)
+	}
+
+	if tolerance == 0 {
+		tolerance = DefaultTolerance
+	}
+	if now == nil {
+		now = time.Now
+	}
+
+	d := now().Sub(time.Unix(seconds, 0))
+	if d > tolerance || d < -tolerance {
+		return ErrExpired
+	}
+
+	return nil
+}
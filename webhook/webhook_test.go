@@ -0,0 +1,130 @@
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func mac(secret, message string) []byte {
+	h := hmac.New(sha256.New, []byte(secret))
+	h.Write([]byte(message))
+	return h.Sum(nil)
+}
+
+func TestHMAC(t *testing.T) {
+
+	body := `{"id":1}`
+
+	v := Shopify([]byte("old"), []byte("new"))
+
+	r := httptest.NewRequest(http.MethodPost, "/", nil)
+	assert.ErrorIs(t, v.Verify(r, []byte(body)), ErrMissingSignature)
+
+	r.Header.Set("X-Shopify-Hmac-Sha256", base64.StdEncoding.EncodeToString(mac("new", body)))
+	assert.Nil(t, v.Verify(r, []byte(body)))
+	assert.ErrorIs(t, v.Verify(r, []byte(`{"id":2}`)), ErrInvalidSignature)
+
+	now := time.Now()
+	v = &HMAC{Header: "X-Signature", Prefix: "sha256=", Secrets: [][]byte{[]byte("s")}, TimestampHeader: "X-Timestamp", now: func() time.Time { return now }}
+
+	ts := strconv.FormatInt(now.Unix(), 10)
+	r = httptest.NewRequest(http.MethodPost, "/", nil)
+	r.Header.Set("X-Timestamp", ts)
+	r.Header.Set("X-Signature", "sha256="+hex.EncodeToString(mac("s", ts+"."+body)))
+	assert.Nil(t, v.Verify(r, []byte(body)))
+
+	now = now.Add(10 * time.Minute)
+	assert.ErrorIs(t, v.Verify(r, []byte(body)), ErrExpired)
+
+	// Empty secrets would let anyone sign webhooks
+	r = httptest.NewRequest(http.MethodPost, "/", nil)
+	r.Header.Set("X-Signature", hex.EncodeToString(mac("", body)))
+	assert.ErrorIs(t, (&HMAC{Header: "X-Signature", Secrets: [][]byte{nil}}).Verify(r, []byte(body)), ErrInvalidSignature)
+	assert.Panics(t, func() { Xero() })
+	assert.Panics(t, func() { QuickBooks([]byte("s"), []byte{}) })
+}
+
+func TestStripe(t *testing.T) {
+
+	body := `{"type":"invoice.paid"}`
+	now := time.Now()
+	ts := strconv.FormatInt(now.Unix(), 10)
+
+	v := &Stripe{Secrets: [][]byte{[]byte("whsec_new")}, now: func() time.Time { return now }}
+
+	r := httptest.NewRequest(http.MethodPost, "/", nil)
+	r.Header.Set("Stripe-Signature", fmt.Sprintf("t=%s,v1=%s,v1=%s", ts, hex.EncodeToString(mac("whsec_old", ts+"."+body)), hex.EncodeToString(mac("whsec_new", ts+"."+body))))
+	assert.Nil(t, v.Verify(r, []byte(body)))
+
+	v.Secrets = [][]byte{[]byte("whsec_other")}
+	assert.ErrorIs(t, v.Verify(r, []byte(body)), ErrInvalidSignature)
+
+	v.Secrets = [][]byte{[]byte("whsec_new")}
+	now = now.Add(-time.Hour)
+	assert.ErrorIs(t, v.Verify(r, []byte(body)), ErrExpired)
+}
+
+func TestMiddleware(t *testing.T) {
+
+	body := `{"events":[]}`
+
+	handler := Middleware(Xero([]byte("key")), Options{})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		w.Write(b)
+	}))
+
+	r := httptest.NewRequest(http.MethodPost, "/webhooks/xero", strings.NewReader(body))
+	r.Header.Set("X-Xero-Signature", base64.StdEncoding.EncodeToString(mac("key", body)))
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, body, w.Body.String())
+
+	r = httptest.NewRequest(http.MethodPost, "/webhooks/xero", strings.NewReader(body))
+	r.Header.Set("X-Xero-Signature", base64.StdEncoding.EncodeToString(mac("wrong", body)))
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
+
+func TestReplays(t *testing.T) {
+
+	body := `{"type":"invoice.paid"}`
+	now := time.Now()
+	ts := strconv.FormatInt(now.Unix(), 10)
+	clock := func() time.Time { return now }
+
+	replays := &MemoryReplayCache{now: clock}
+	v := &Stripe{Secrets: [][]byte{[]byte("whsec")}, Replays: replays, now: clock}
+
+	r := httptest.NewRequest(http.MethodPost, "/", nil)
+	r.Header.Set("Stripe-Signature", fmt.Sprintf("t=%s,v1=%s", ts, hex.EncodeToString(mac("whsec", ts+"."+body))))
+	assert.Nil(t, v.Verify(r, []byte(body)))
+	assert.ErrorIs(t, v.Verify(r, []byte(body)), ErrReplayed)
+
+	// Invalid signatures are not recorded
+	assert.ErrorIs(t, v.Verify(r, []byte(`{}`)), ErrInvalidSignature)
+	assert.Len(t, replays.expires, 1)
+
+	// Signatures are forgotten once their timestamp is out of tolerance anyway
+	now = now.Add(2 * DefaultTolerance)
+	assert.ErrorIs(t, v.Verify(r, []byte(body)), ErrExpired)
+	h := &HMAC{Header: "X-Signature", Secrets: [][]byte{[]byte("s")}, Replays: replays}
+	r = httptest.NewRequest(http.MethodPost, "/", nil)
+	r.Header.Set("X-Signature", hex.EncodeToString(mac("s", body)))
+	assert.Nil(t, h.Verify(r, []byte(body)))
+	assert.ErrorIs(t, h.Verify(r, []byte(body)), ErrReplayed)
+	assert.Len(t, replays.expires, 1)
+}